@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/screwdriver-cd/meta-cli/internal/fetch"
+	"github.com/sirupsen/logrus"
+)
+
+// Locker is a lock, such as the flock of the meta space, that may fail to lock or unlock.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// externalMeta is the meta of an external job to store in its key of the local meta
+type externalMeta struct {
+	external       string
+	jobDescription *fetch.JobDescription
+	keyPath        *KeyPath
+	data           []byte
+}
+
+// FetchExternals stores the meta of each of the externals in the local meta, as get --external does, for externals
+// whose key is not in the local meta yet. Their meta is read from the file of the external meta when it exists
+// (i.e. the build was triggered by the external job); the rest is fetched concurrently. locker is only held while
+// reading the local meta and while writing it once with all of the meta, but not while fetching; keys that were set
+// in between (e.g. by a concurrent meta set) are kept rather than overwritten.
+func (m *MetaSpec) FetchExternals(externals []string, locker Locker) error {
+	var pending []*externalMeta
+	seen := map[string]bool{}
+	for _, external := range externals {
+		jobDescription, err := m.LastSuccessfulMetaRequest.ParseJobDescription(external)
+		if err != nil {
+			return err
+		}
+		metaKey := jobDescription.MetaKey()
+		if seen[metaKey] {
+			continue
+		}
+		seen[metaKey] = true
+		keyPath, err := ParseKeyPath(metaKey)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, &externalMeta{external: external, jobDescription: jobDescription, keyPath: keyPath})
+	}
+
+	toFetch, err := m.readExternals(pending, locker)
+	if err != nil {
+		return err
+	}
+	if len(toFetch) != 0 {
+		jobDescriptions := make([]*fetch.JobDescription, len(toFetch))
+		for i, external := range toFetch {
+			logrus.Debugf("Fetching metadata from %s", external.jobDescription.External())
+			jobDescriptions[i] = external.jobDescription
+		}
+		metas, err := m.LastSuccessfulMetaRequest.FetchMetas(jobDescriptions)
+		if err != nil {
+			return err
+		}
+		for i, external := range toFetch {
+			external.data = metas[i]
+		}
+	}
+	return m.storeExternals(pending, locker)
+}
+
+// readExternals reads the meta of the externals that are in neither the local meta nor the meta space under locker.
+// It returns the externals that still need to be fetched, which is none when fetching is skipped.
+func (m *MetaSpec) readExternals(externals []*externalMeta, locker Locker) ([]*externalMeta, error) {
+	if err := locker.Lock(); err != nil {
+		return nil, err
+	}
+	defer func() { _ = locker.Unlock() }()
+
+	defaultMetaSpec := m.CloneDefaultMeta()
+	meta, err := defaultMetaSpec.readMetaForUpdate()
+	if err != nil {
+		return nil, err
+	}
+	var toFetch []*externalMeta
+	for _, external := range externals {
+		if external.keyPath.Get(meta) != nil {
+			logrus.Debugf("Found data in external meta key %s", external.keyPath)
+			continue
+		}
+		externalMetaSpec := *m
+		externalMetaSpec.MetaFile = external.external
+		metaFilePath := externalMetaSpec.MetaFilePath()
+		data, err := ioutil.ReadFile(metaFilePath)
+		switch {
+		case err == nil:
+			external.data = data
+		case !os.IsNotExist(err):
+			return nil, err
+		case m.SkipFetchNonexistentExternal:
+			logrus.Debugf("%s doesn't exist; skipping fetch", metaFilePath)
+		default:
+			toFetch = append(toFetch, external)
+		}
+	}
+	return toFetch, nil
+}
+
+// storeExternals stores the meta of the externals that have any (without their sd key) in the local meta in a single
+// write under locker. The local meta is read again under locker, so externals whose key was set since readExternals
+// are not stored.
+func (m *MetaSpec) storeExternals(externals []*externalMeta, locker Locker) error {
+	if err := locker.Lock(); err != nil {
+		return err
+	}
+	defer func() { _ = locker.Unlock() }()
+
+	defaultMetaSpec := m.CloneDefaultMeta()
+	meta, err := defaultMetaSpec.readMetaForUpdate()
+	if err != nil {
+		return err
+	}
+	stored := 0
+	for _, external := range externals {
+		if external.data == nil {
+			continue
+		}
+		if external.keyPath.Get(meta) != nil {
+			logrus.Debugf("External meta key %s was set while fetching; keeping it", external.keyPath)
+			continue
+		}
+		metaObject, err := decodeMetaObject(external.data)
+		if err != nil {
+			return err
+		}
+		metaObject.Delete("sd")
+		logrus.Tracef("storing metadata %s in key %s", string(external.data), external.keyPath)
+		updatedMeta, err := external.keyPath.Set(meta, metaObject)
+		if err != nil {
+			return err
+		}
+		meta = updatedMeta.(*orderedObject)
+		stored++
+	}
+	if stored == 0 {
+		return nil
+	}
+	return defaultMetaSpec.writeMeta(meta)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/screwdriver-cd/meta-cli/internal/fetch"
+)
+
+// countingLocker counts the times it is locked, and calls onLock (when set) once it is locked
+type countingLocker struct {
+	locks  int
+	locked bool
+	onLock func(locks int)
+}
+
+func (l *countingLocker) Lock() error {
+	l.locks++
+	l.locked = true
+	if l.onLock != nil {
+		l.onLock(l.locks)
+	}
+	return nil
+}
+
+func (l *countingLocker) Unlock() error {
+	l.locked = false
+	return nil
+}
+
+// loggingMockServer is a fetch.MockServer that logs the paths of the requests it serves
+type loggingMockServer struct {
+	fetch.MockServer
+	paths []string
+	mutex sync.Mutex
+}
+
+func (m *loggingMockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	m.paths = append(m.paths, r.URL.Path)
+	m.mutex.Unlock()
+	m.MockServer.ServeHTTP(w, r)
+}
+
+// serveExternals serves the files (by path, e.g. v4/jobs/1/lastSuccessfulMeta.json) as the SD API of pipeline
+// 1016708, with its jobs, to the meta spec, and returns the server.
+func (s *MetaSuite) serveExternals(files map[string]string) *loggingMockServer {
+	dir, err := ioutil.TempDir("", "externals")
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { _ = os.RemoveAll(dir) })
+	files["v4/pipelines/1016708/jobs.json"] = s.JobsJSON
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		s.Require().NoError(os.MkdirAll(filepath.Dir(path), 0777))
+		s.Require().NoError(ioutil.WriteFile(path, []byte(data), 0666))
+	}
+	mockServer := &loggingMockServer{MockServer: fetch.MockServer{Dir: dir}}
+	testServer := httptest.NewServer(mockServer)
+	s.T().Cleanup(testServer.Close)
+
+	s.MetaSpec.LastSuccessfulMetaRequest.SdAPIURL = testServer.URL + fetch.MockServerPrefix
+	s.MetaSpec.LastSuccessfulMetaRequest.Transport = testServer.Client().Transport
+	s.MetaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID = 1016708
+	return mockServer
+}
+
+func (s *MetaSuite) TestMetaSpec_FetchExternals() {
+	mockServer := s.serveExternals(map[string]string{
+		"v4/jobs/392525/lastSuccessfulMeta.json": `{"job":"job1","sd":{"ignored":true}}`,
+		"v4/jobs/392543/lastSuccessfulMeta.json": `{"job":"competing-meta-1"}`,
+		"v4/jobs/392544/lastSuccessfulMeta.json": `{"job":"competing-meta-2"}`,
+	})
+	s.Require().NoError(s.CopyMockFile(externalFile))
+	s.MetaSpec.JSONValue = true
+	s.Require().NoError(s.MetaSpec.Set("sd.1016708.competing-meta-2", `{"job":"stored"}`))
+
+	var locker countingLocker
+	err := s.MetaSpec.FetchExternals([]string{
+		"job1", "sd@1016708:competing-meta-1", externalFile, "sd@1016708:competing-meta-2", "sd@1016708:job1",
+	}, &locker)
+	s.Require().NoError(err)
+	s.Assert().Equal(2, locker.locks)
+	s.Assert().False(locker.locked)
+	// The job list is fetched once, and the meta of externals that are stored or in the meta space isn't fetched
+	s.Assert().ElementsMatch([]string{"/v4/pipelines/1016708/jobs", "/v4/jobs/392525/lastSuccessfulMeta",
+		"/v4/jobs/392543/lastSuccessfulMeta"}, mockServer.paths)
+
+	got, err := s.MetaSpec.Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"1016708":{"competing-meta-2":{"job":"stored"},"job1":{"job":"job1"},`+
+		`"competing-meta-1":{"job":"competing-meta-1"}},"123":{"component":{"obj":{"abc":"def"},"str":"meow"}}}`, got)
+
+	// Once stored, get --external doesn't fetch
+	s.MetaSpec.MetaFile = "sd@1016708:competing-meta-1"
+	s.MetaSpec.JSONValue = false
+	got, err = s.MetaSpec.Get("job")
+	s.Require().NoError(err)
+	s.Assert().Equal("competing-meta-1", got)
+	s.Assert().Len(mockServer.paths, 3)
+}
+
+func (s *MetaSuite) TestMetaSpec_FetchExternals_concurrentSet() {
+	mockServer := s.serveExternals(map[string]string{
+		"v4/jobs/392525/lastSuccessfulMeta.json": `{"job":"job1"}`,
+		"v4/jobs/392543/lastSuccessfulMeta.json": `{"job":"competing-meta-1"}`,
+	})
+	s.MetaSpec.JSONValue = true
+
+	// A key set while fetching (i.e. before storing locks again) is not overwritten by the fetched meta
+	locker := countingLocker{onLock: func(locks int) {
+		if locks == 2 {
+			s.Require().NoError(s.MetaSpec.Set("sd.1016708.job1", `{"job":"set"}`))
+		}
+	}}
+	s.Require().NoError(s.MetaSpec.FetchExternals([]string{"job1", "competing-meta-1"}, &locker))
+	s.Assert().Len(mockServer.paths, 3)
+
+	got, err := s.MetaSpec.Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"1016708":{"job1":{"job":"set"},"competing-meta-1":{"job":"competing-meta-1"}}}`, got)
+}
+
+func (s *MetaSuite) TestMetaSpec_FetchExternals_skipFetch() {
+	s.MetaSpec.SkipFetchNonexistentExternal = true
+	s.MetaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID = 1016708
+
+	var locker countingLocker
+	s.Require().NoError(s.MetaSpec.FetchExternals([]string{"job1"}, &locker))
+	s.Assert().Equal(2, locker.locks)
+	got, err := s.MetaSpec.Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal("null", got)
+}
+
+func (s *MetaSuite) TestMetaSpec_FetchExternals_error() {
+	s.serveExternals(map[string]string{"v4/jobs/392525/lastSuccessfulMeta.json": `{"job":"job1"}`})
+
+	var locker countingLocker
+	err := s.MetaSpec.FetchExternals([]string{"job1", "does-not-exist"}, &locker)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, fetch.ErrJobNotFound), "%v", err)
+	s.Assert().Equal(1, locker.locks)
+
+	// Nothing is stored when any fetch fails
+	got, err := s.MetaSpec.Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal("null", got)
+
+	// Invalid externals fail before locking
+	locker = countingLocker{}
+	s.Require().Error(s.MetaSpec.FetchExternals([]string{"job1#build=x"}, &locker))
+	s.Assert().Equal(0, locker.locks)
+}
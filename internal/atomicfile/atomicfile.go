@@ -0,0 +1,50 @@
+// Package atomicfile writes files atomically, so that readers (including concurrent builds sharing a directory) never
+// observe a partially written file.
+package atomicfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WriteFile writes data to a temporary file next to path, syncs it and renames it over path so that readers never
+// observe a partially written file, even if the process is killed or the disk fills up mid-write. The directory of
+// path must exist. The temporary file starts with a dot, so that it may be told apart from the files being written.
+func WriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmpPath := filepath.Join(dir, fmt.Sprintf(".%s.%d.%d.tmp", filepath.Base(path), os.Getpid(), time.Now().UnixNano()))
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	// Clean up the temporary file on any failure; after a successful rename this is a no-op.
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename itself is durable; not all filesystems support this, so only log.
+	if dirFile, err := os.Open(dir); err == nil {
+		if err := dirFile.Sync(); err != nil {
+			logrus.Debugf("Unable to sync directory %s: %v", dir, err)
+		}
+		_ = dirFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AtomicFileSuite struct {
+	suite.Suite
+	Dir string
+}
+
+func TestAtomicFileSuite(t *testing.T) {
+	suite.Run(t, new(AtomicFileSuite))
+}
+
+func (s *AtomicFileSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	s.Require().NoError(err)
+	s.Dir = dir
+}
+
+func (s *AtomicFileSuite) TearDownTest() {
+	_ = os.RemoveAll(s.Dir)
+}
+
+func (s *AtomicFileSuite) TestWriteFile() {
+	path := filepath.Join(s.Dir, "meta.json")
+	s.Require().NoError(WriteFile(path, []byte(`{"foo":"bar"}`)))
+	s.Require().NoError(WriteFile(path, []byte(`{"foo":"baz"}`)))
+
+	data, err := ioutil.ReadFile(path)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"baz"}`, string(data))
+
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(s.Dir)
+	s.Require().NoError(err)
+	s.Require().Len(files, 1)
+	s.Assert().Equal("meta.json", files[0].Name())
+}
+
+func (s *AtomicFileSuite) TestWriteFile_missingDir() {
+	s.Assert().Error(WriteFile(filepath.Join(s.Dir, "missing", "meta.json"), []byte(`{}`)))
+}
@@ -0,0 +1,198 @@
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+// tokenRefreshMargin is how long before it expires that an exchanged token is refreshed
+const tokenRefreshMargin = time.Minute
+
+// Authenticator provides the bearer tokens for SD API calls. It must be safe for concurrent use.
+type Authenticator interface {
+	// Token returns the token for a call
+	Token(ctx context.Context) (string, error)
+	// Refresh is called when a call with token was rejected as unauthorized (401); it returns whether a new token may
+	// be used to retry the call.
+	Refresh(ctx context.Context, token string) bool
+}
+
+// StaticToken is an Authenticator with a token that never changes, such as SD_TOKEN.
+type StaticToken string
+
+// Token returns the token
+func (t StaticToken) Token(context.Context) (string, error) {
+	return string(t), nil
+}
+
+// Refresh returns false, since the token never changes
+func (t StaticToken) Refresh(context.Context, string) bool {
+	return false
+}
+
+// TokenFile is an Authenticator with the token in a file, which is read for every call so that it may be rotated.
+type TokenFile struct {
+	// Path is the path to the file; surrounding whitespace of the token is ignored
+	Path string
+}
+
+// Token reads the token from the file
+func (f *TokenFile) Token(context.Context) (string, error) {
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read token: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Refresh returns whether the token in the file has been rotated since token was read
+func (f *TokenFile) Refresh(ctx context.Context, token string) bool {
+	current, err := f.Token(ctx)
+	return err == nil && current != token
+}
+
+// APIKeyExchange is an Authenticator that exchanges a user API key (token) for a JWT with the SD API. The JWT is
+// exchanged again shortly before it expires or when it is rejected.
+type APIKeyExchange struct {
+	// APIKey is the user API key to exchange
+	APIKey string
+	// SdAPIURL is the base url to the screwdriver rest API.
+	SdAPIURL string
+	// Transport is the transport to use in calling the screwdriver REST apis (when nil, uses http.DefaultTransport)
+	Transport http.RoundTripper
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// AuthTokenURL returns the URL for exchanging the API key with the screwdriver auth REST API
+func (e *APIKeyExchange) AuthTokenURL() string {
+	return fmt.Sprintf("%sauth/token?api_token=%s", e.SdAPIURL, url.QueryEscape(e.APIKey))
+}
+
+// Token returns the exchanged JWT, exchanging the API key when there is none or it is about to expire
+func (e *APIKeyExchange) Token(ctx context.Context) (string, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.token != "" && (e.expires.IsZero() || time.Until(e.expires) > tokenRefreshMargin) {
+		return e.token, nil
+	}
+	token, err := e.exchange(ctx)
+	if err != nil {
+		return "", err
+	}
+	e.token = token
+	e.expires = jwtExpiry(token)
+	logrus.Debugf("Exchanged API key for a token that expires at %v", e.expires)
+	return token, nil
+}
+
+// Refresh discards token so that the next call exchanges the API key again
+func (e *APIKeyExchange) Refresh(_ context.Context, token string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.token == token {
+		e.token = ""
+	}
+	return true
+}
+
+// exchange exchanges the API key for a JWT.
+func (e *APIKeyExchange) exchange(ctx context.Context) (string, error) {
+	authTokenURL := e.AuthTokenURL()
+	// Don't log the API key
+	logURL := strings.SplitN(authTokenURL, "?", 2)[0]
+	request, err := http.NewRequestWithContext(ctx, "GET", authTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	transport := e.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	response, err := transport.RoundTrip(request)
+	if err != nil {
+		return "", fmt.Errorf("%w: GET %s: %w", ErrUnavailable, logURL, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("%w: GET %s: %w", ErrUnavailable, logURL, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		// The API key is unknown or revoked
+		return "", newAPIError(http.MethodGet, logURL, response, data, ErrUnauthorized)
+	}
+	token := gjson.GetBytes(data, "token").String()
+	if token == "" {
+		return "", fmt.Errorf("GET %s: no token in response", logURL)
+	}
+	return token, nil
+}
+
+// jwtClaims returns the (json) claims of the JWT, without verifying it, or nil when it isn't a JWT.
+func jwtClaims(token string) []byte {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil || !gjson.ValidBytes(payload) {
+		return nil
+	}
+	return payload
+}
+
+// jwtExpiry returns the expiry (exp claim) of the JWT, without verifying it, or the zero time when it has none.
+func jwtExpiry(token string) time.Time {
+	exp := gjson.GetBytes(jwtClaims(token), "exp")
+	if !exp.Exists() {
+		return time.Time{}
+	}
+	return time.Unix(exp.Int(), 0)
+}
+
+// jwtIdentity returns who the JWT identifies, without verifying it, or the empty string when it identifies no one.
+// The token of a build identifies the build, so for it (or any token with a pipelineId claim) this is the pipeline,
+// along with the scope and whether it is a PR build, which is the same for every build of the pipeline. Otherwise it
+// is the user (username claim). Both include the SCM context.
+func jwtIdentity(token string) string {
+	claims := jwtClaims(token)
+	scmContext := gjson.GetBytes(claims, "scmContext").String()
+	if pipelineID := gjson.GetBytes(claims, "pipelineId"); pipelineID.Exists() {
+		return fmt.Sprintf("pipeline:%s:%s:%s:pr=%t", scmContext, pipelineID.String(),
+			gjson.GetBytes(claims, "scope").Raw, gjson.GetBytes(claims, "isPR").Bool())
+	}
+	if username := gjson.GetBytes(claims, "username").String(); username != "" {
+		return fmt.Sprintf("user:%s:%s", scmContext, username)
+	}
+	return ""
+}
+
+// GetAuthenticator returns the Authenticator for SD API calls. When it is nil, it is an APIKeyExchange of SdAPIKey
+// (which is assigned, like GetTransport, so that the token is reused), a TokenFile of SdTokenFile or the StaticToken
+// SdToken, in that order.
+func (r *LastSuccessfulMetaRequest) GetAuthenticator() Authenticator {
+	switch {
+	case r.Authenticator != nil:
+		return r.Authenticator
+	case r.SdAPIKey != "":
+		r.Authenticator = &APIKeyExchange{APIKey: r.SdAPIKey, SdAPIURL: r.SdAPIURL, Transport: r.GetTransport()}
+		return r.Authenticator
+	case r.SdTokenFile != "":
+		return &TokenFile{Path: r.SdTokenFile}
+	default:
+		return StaticToken(r.SdToken)
+	}
+}
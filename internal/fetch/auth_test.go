@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthSuite struct {
+	suite.Suite
+	TestServer *httptest.Server
+	Request    LastSuccessfulMetaRequest
+	mutex      sync.Mutex
+	// validTokens are the tokens that the server accepts
+	validTokens map[string]bool
+	// exchanged are the tokens for the exchanges of the API key "api-key", in order
+	exchanged []string
+	// requests counts the requests by path
+	requests map[string]int
+	// onUnauthorized is called when a request is unauthorized
+	onUnauthorized func()
+}
+
+func TestAuthSuite(t *testing.T) {
+	suite.Run(t, new(AuthSuite))
+}
+
+func (s *AuthSuite) SetupTest() {
+	s.validTokens = map[string]bool{}
+	s.exchanged = nil
+	s.requests = map[string]int{}
+	s.onUnauthorized = func() {}
+	s.TestServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:            s.TestServer.URL + "/v4/",
+		Transport:           s.TestServer.Client().Transport,
+		DefaultSdPipelineID: 123,
+	}
+}
+
+func (s *AuthSuite) TearDownTest() {
+	s.TestServer.Close()
+}
+
+// serveHTTP exchanges the API key and serves the last successful meta of job publish of pipeline 123 for valid tokens.
+func (s *AuthSuite) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests[r.URL.Path]++
+	if r.URL.Path == "/v4/auth/token" {
+		if r.URL.Query().Get("api_token") != "api-key" || len(s.exchanged) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, `{"statusCode":401,"error":"Unauthorized","message":"Invalid token"}`)
+			return
+		}
+		token := s.exchanged[0]
+		s.exchanged = s.exchanged[1:]
+		_, _ = fmt.Fprintf(w, `{"token":%q}`, token)
+		return
+	}
+	if !s.validTokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		s.onUnauthorized()
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"statusCode":401,"error":"Unauthorized","message":"Token expired"}`)
+		return
+	}
+	switch r.URL.Path {
+	case "/v4/pipelines/123/jobs":
+		_, _ = io.WriteString(w, `[{"id":1,"name":"publish"}]`)
+	case "/v4/jobs/1/lastSuccessfulMeta":
+		_, _ = io.WriteString(w, `{"foo":"bar"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// jwt returns a JWT (with an invalid signature) that expires at exp.
+func jwt(name string, exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"name":%q,"exp":%d}`, name, exp.Unix())))
+	return "eyJhbGciOiJIUzI1NiJ9." + payload + ".signature"
+}
+
+// fetch fetches the last successful meta of publish.
+func (s *AuthSuite) fetch() ([]byte, error) {
+	return s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "publish"})
+}
+
+func (s *AuthSuite) TestStaticToken() {
+	s.validTokens["token"] = true
+	s.Request.SdToken = "token"
+	got, err := s.fetch()
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	s.Request.SdToken = "expired"
+	_, err = s.fetch()
+	s.Assert().True(errors.Is(err, ErrUnauthorized), "%v", err)
+}
+
+func (s *AuthSuite) TestTokenFile() {
+	dir, err := ioutil.TempDir("", "token")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	tokenFile := filepath.Join(dir, "token")
+	s.Require().NoError(ioutil.WriteFile(tokenFile, []byte("old\n"), 0600))
+	s.Request.SdTokenFile = tokenFile
+	s.Request.SdToken = "ignored"
+
+	// The token is rotated while the request is made, so it is retried with the new token
+	s.validTokens["new"] = true
+	s.onUnauthorized = func() {
+		s.Require().NoError(ioutil.WriteFile(tokenFile, []byte("new\n"), 0600))
+	}
+	got, err := s.fetch()
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	// When it isn't rotated, it is not retried
+	s.validTokens = map[string]bool{}
+	s.onUnauthorized = func() {}
+	_, err = s.fetch()
+	s.Assert().True(errors.Is(err, ErrUnauthorized), "%v", err)
+	s.Assert().Equal(2, s.requests["/v4/pipelines/123/jobs"])
+
+	s.Request.SdTokenFile = filepath.Join(dir, "missing")
+	_, err = s.fetch()
+	s.Assert().Error(err)
+}
+
+func (s *AuthSuite) TestAPIKeyExchange() {
+	first := jwt("first", time.Now().Add(time.Hour))
+	second := jwt("second", time.Now().Add(time.Hour))
+	s.exchanged = []string{first, second}
+	s.validTokens[first] = true
+	s.Request.SdAPIKey = "api-key"
+
+	// The token is exchanged once and reused
+	for i := 0; i < 2; i++ {
+		got, err := s.fetch()
+		s.Require().NoError(err)
+		s.Assert().Equal(`{"foo":"bar"}`, string(got))
+	}
+	s.Assert().Equal(1, s.requests["/v4/auth/token"])
+
+	// A rejected token is exchanged again
+	s.validTokens = map[string]bool{second: true}
+	_, err := s.fetch()
+	s.Require().NoError(err)
+	s.Assert().Equal(2, s.requests["/v4/auth/token"])
+}
+
+func (s *AuthSuite) TestAPIKeyExchange_expiring() {
+	expiring := jwt("expiring", time.Now().Add(tokenRefreshMargin/2))
+	second := jwt("second", time.Now().Add(time.Hour))
+	s.exchanged = []string{expiring, second}
+	s.validTokens[expiring] = true
+	s.validTokens[second] = true
+	s.Request.SdAPIKey = "api-key"
+
+	// A token that is about to expire is exchanged before it is used again
+	for i := 0; i < 2; i++ {
+		_, err := s.fetch()
+		s.Require().NoError(err)
+	}
+	s.Assert().Equal(2, s.requests["/v4/auth/token"])
+}
+
+func (s *AuthSuite) TestAPIKeyExchange_invalid() {
+	s.Request.SdAPIKey = "invalid"
+	_, err := s.fetch()
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrUnauthorized), "%v", err)
+	s.Assert().NotContains(err.Error(), "invalid")
+}
+
+func (s *AuthSuite) TestGetAuthenticator() {
+	s.Assert().Equal(StaticToken("token"), (&LastSuccessfulMetaRequest{SdToken: "token"}).GetAuthenticator())
+	s.Assert().Equal(&TokenFile{Path: "file"},
+		(&LastSuccessfulMetaRequest{SdToken: "token", SdTokenFile: "file"}).GetAuthenticator())
+
+	request := &LastSuccessfulMetaRequest{SdToken: "token", SdTokenFile: "file", SdAPIKey: "key"}
+	authenticator := request.GetAuthenticator()
+	s.Require().IsType(&APIKeyExchange{}, authenticator)
+	s.Assert().Equal("key", authenticator.(*APIKeyExchange).APIKey)
+	s.Assert().Same(authenticator, request.GetAuthenticator())
+
+	token := StaticToken("other")
+	request.Authenticator = token
+	s.Assert().Equal(token, request.GetAuthenticator())
+	got, err := request.GetAuthenticator().Token(context.Background())
+	s.Require().NoError(err)
+	s.Assert().Equal("other", got)
+}
+
+func (s *AuthSuite) TestJWTExpiry() {
+	exp := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	s.Assert().Equal(exp, jwtExpiry(jwt("name", exp)))
+	s.Assert().True(jwtExpiry("not-a-jwt").IsZero())
+	s.Assert().True(jwtExpiry("a.!!!.c").IsZero())
+	s.Assert().True(jwtExpiry("a." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".c").IsZero())
+}
+
+// jwtWithClaims returns a JWT (with an invalid signature) with the claims.
+func jwtWithClaims(claims string) string {
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+func (s *AuthSuite) TestJWTIdentity() {
+	tests := []struct {
+		name   string
+		token  string
+		expect string
+	}{
+		{name: "build", token: jwtWithClaims(`{"username":"456","scmContext":"github:github.com","scope":["build"],` +
+			`"isPR":false,"jobId":789,"pipelineId":123,"eventId":1}`),
+			expect: `pipeline:github:github.com:123:["build"]:pr=false`},
+		{name: "PR build", token: jwtWithClaims(`{"username":"457","scmContext":"github:github.com","scope":["build"],` +
+			`"isPR":true,"pipelineId":123}`),
+			expect: `pipeline:github:github.com:123:["build"]:pr=true`},
+		{name: "user", token: jwtWithClaims(`{"username":"octocat","scmContext":"github:github.com","scope":["user"]}`),
+			expect: "user:github:github.com:octocat"},
+		{name: "no identity", token: jwtWithClaims(`{"exp":1}`), expect: ""},
+		{name: "not a jwt", token: "token", expect: ""},
+	}
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.Assert().Equal(tt.expect, jwtIdentity(tt.token))
+		})
+	}
+}
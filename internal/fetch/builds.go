@@ -0,0 +1,198 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	buildStatusSuccess = "SUCCESS"
+	// jobBuildsPageSize is the number of builds to request per page when looking for a build by SHA
+	jobBuildsPageSize = 50
+)
+
+// build is the part of a screwdriver build that is needed to select it and get its meta.
+type build struct {
+	ID      int64           `json:"id"`
+	JobID   int64           `json:"jobId"`
+	EventID int64           `json:"eventId"`
+	SHA     string          `json:"sha"`
+	Status  string          `json:"status"`
+	Meta    json.RawMessage `json:"meta"`
+}
+
+// metaJSON returns the meta of the build as json; a build without meta has the empty object.
+func (b *build) metaJSON() []byte {
+	if len(b.Meta) == 0 || string(b.Meta) == "null" {
+		return []byte("{}")
+	}
+	return b.Meta
+}
+
+// BuildURL returns the URL for using the screwdriver builds REST API for a given buildID
+func (r *LastSuccessfulMetaRequest) BuildURL(buildID int64) string {
+	return fmt.Sprintf("%sbuilds/%d", r.SdAPIURL, buildID)
+}
+
+// EventBuildsURL returns the URL for using the screwdriver event builds REST API for a given eventID
+func (r *LastSuccessfulMetaRequest) EventBuildsURL(eventID int64) string {
+	return fmt.Sprintf("%sevents/%d/builds", r.SdAPIURL, eventID)
+}
+
+// JobBuildsURL returns the URL for a page (starting at 1) of the builds of a given jobID, latest first
+func (r *LastSuccessfulMetaRequest) JobBuildsURL(jobID int64, page int) string {
+	return fmt.Sprintf("%sjobs/%d/builds?sort=descending&page=%d&count=%d", r.SdAPIURL, jobID, page, jobBuildsPageSize)
+}
+
+// GetBuildMeta gets the meta of the build with buildID, e.g. that of the current build, which is an empty object when
+// the build has none.
+func (r *LastSuccessfulMetaRequest) GetBuildMeta(buildID int64) ([]byte, error) {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	data, err := r.get(ctx, r.BuildURL(buildID), ErrBuildNotFound)
+	if err != nil {
+		return nil, err
+	}
+	var b build
+	if err = json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	return b.metaJSON(), nil
+}
+
+// PutBuildMeta replaces the meta of the build with buildID with the json meta.
+func (r *LastSuccessfulMetaRequest) PutBuildMeta(buildID int64, meta []byte) error {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	body, err := json.Marshal(struct {
+		Meta json.RawMessage `json:"meta"`
+	}{Meta: meta})
+	if err != nil {
+		return err
+	}
+	_, err = r.do(ctx, http.MethodPut, r.BuildURL(buildID), body, ErrBuildNotFound)
+	return err
+}
+
+// FetchMeta fetches the meta described by jobDescription: that of its build, event or SHA when it has one, or the last
+// successful meta otherwise.
+func (r *LastSuccessfulMetaRequest) FetchMeta(jobDescription *JobDescription) ([]byte, error) {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	return r.FetchMetaContext(ctx, jobDescription)
+}
+
+// FetchMetaContext is like FetchMeta, but the API calls are bound by ctx rather than Timeout
+func (r *LastSuccessfulMetaRequest) FetchMetaContext(ctx context.Context, jobDescription *JobDescription) ([]byte,
+	error) {
+	if jobDescription.Selector() == "" {
+		return r.FetchLastSuccessfulMetaContext(ctx, jobDescription)
+	}
+	return r.cached(ctx, jobDescription, func() ([]byte, error) {
+		jobID, err := r.FetchJobIDContext(ctx, jobDescription)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Tracef("jobID=%d", jobID)
+		switch {
+		case jobDescription.BuildID != 0:
+			return r.FetchBuildMetaContext(ctx, jobDescription, jobID)
+		case jobDescription.EventID != 0:
+			return r.FetchEventMetaContext(ctx, jobDescription, jobID)
+		default:
+			return r.FetchSHAMetaContext(ctx, jobDescription, jobID)
+		}
+	})
+}
+
+// FetchBuildMetaContext fetches the meta of the build with jobDescription.BuildID, which must be a build of jobID.
+func (r *LastSuccessfulMetaRequest) FetchBuildMetaContext(ctx context.Context, jobDescription *JobDescription,
+	jobID int64) ([]byte, error) {
+	data, err := r.get(ctx, r.BuildURL(jobDescription.BuildID), ErrBuildNotFound)
+	if err != nil {
+		return nil, err
+	}
+	var b build
+	if err = json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	if b.JobID != jobID {
+		return nil, fmt.Errorf("%w: build %d is not a build of %s", ErrBuildNotFound, jobDescription.BuildID,
+			jobDescription.External())
+	}
+	return b.metaJSON(), nil
+}
+
+// FetchEventMetaContext fetches the meta of the latest successful build of jobID in the event with
+// jobDescription.EventID.
+func (r *LastSuccessfulMetaRequest) FetchEventMetaContext(ctx context.Context, jobDescription *JobDescription,
+	jobID int64) ([]byte, error) {
+	data, err := r.get(ctx, r.EventBuildsURL(jobDescription.EventID), ErrBuildNotFound)
+	if err != nil {
+		return nil, err
+	}
+	var builds []build
+	if err = json.Unmarshal(data, &builds); err != nil {
+		return nil, err
+	}
+	var found *build
+	hasBuild := false
+	for i := range builds {
+		if builds[i].JobID != jobID {
+			continue
+		}
+		hasBuild = true
+		// A job may be restarted within an event, so use its latest successful build
+		if builds[i].Status == buildStatusSuccess && (found == nil || builds[i].ID > found.ID) {
+			found = &builds[i]
+		}
+	}
+	if !hasBuild {
+		return nil, fmt.Errorf("%w: event %d has no build of %s", ErrBuildNotFound, jobDescription.EventID,
+			jobDescription.External())
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: event %d has no successful build of %s", ErrNoSuccessfulBuild,
+			jobDescription.EventID, jobDescription.External())
+	}
+	return found.metaJSON(), nil
+}
+
+// FetchSHAMetaContext fetches the meta of the latest successful build of jobID whose SHA starts with
+// jobDescription.SHA, paging through the builds of the job from the latest.
+func (r *LastSuccessfulMetaRequest) FetchSHAMetaContext(ctx context.Context, jobDescription *JobDescription,
+	jobID int64) ([]byte, error) {
+	seen := map[int64]bool{}
+	for page := 1; ; page++ {
+		data, err := r.get(ctx, r.JobBuildsURL(jobID, page), ErrJobNotFound)
+		if err != nil {
+			return nil, err
+		}
+		var builds []build
+		if err = json.Unmarshal(data, &builds); err != nil {
+			return nil, err
+		}
+		added := 0
+		for i := range builds {
+			if seen[builds[i].ID] {
+				continue
+			}
+			seen[builds[i].ID] = true
+			added++
+			if builds[i].Status == buildStatusSuccess && strings.HasPrefix(strings.ToLower(builds[i].SHA),
+				jobDescription.SHA) {
+				return builds[i].metaJSON(), nil
+			}
+		}
+		// Stop after the last page, or when the API doesn't page the builds and returns the same ones on every page
+		if len(builds) < jobBuildsPageSize || added == 0 {
+			return nil, fmt.Errorf("%w: %s has no successful build at sha %s", ErrNoSuccessfulBuild,
+				jobDescription.External(), jobDescription.SHA)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const buildsJobsJSON = `[{"id":392525,"name":"publish"}]`
+
+type BuildsSuite struct {
+	suite.Suite
+	MockServer countingMockServer
+	TestServer *httptest.Server
+	Request    LastSuccessfulMetaRequest
+}
+
+func TestBuildsSuite(t *testing.T) {
+	suite.Run(t, new(BuildsSuite))
+}
+
+func (s *BuildsSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "builds")
+	s.Require().NoError(err)
+	s.MockServer = countingMockServer{MockServer: MockServer{Dir: dir, Token: "test-token"}}
+	s.TestServer = httptest.NewServer(&s.MockServer)
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:  s.TestServer.URL + MockServerPrefix,
+		SdToken:   "test-token",
+		Transport: s.TestServer.Client().Transport,
+	}
+	writeMockFile(s.T(), dir, "v4/pipelines/123/jobs.json", buildsJobsJSON)
+}
+
+func (s *BuildsSuite) TearDownTest() {
+	s.TestServer.Close()
+	_ = os.RemoveAll(s.MockServer.Dir)
+}
+
+// respond writes the body as the file of the mock server for path, e.g. v4/builds/456.
+func (s *BuildsSuite) respond(path string, body string) {
+	writeMockFile(s.T(), s.MockServer.Dir, path+".json", body)
+}
+
+// fetch fetches the meta of the external job description.
+func (s *BuildsSuite) fetch(external string) ([]byte, error) {
+	jobDescription, err := ParseJobDescription(0, external)
+	s.Require().NoError(err)
+	return s.Request.FetchMeta(jobDescription)
+}
+
+func (s *BuildsSuite) TestFetchMeta_build() {
+	s.respond("v4/builds/456", `{"id":456,"jobId":392525,"status":"FAILURE","meta":{"b":1,"a":2}}`)
+
+	got, err := s.fetch("sd@123:publish#build=456")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"b":1,"a":2}`, string(got))
+	s.Assert().Equal(map[string]int{"/v4/pipelines/123/jobs?page=1&count=50": 1, "/v4/builds/456": 1},
+		s.MockServer.requests())
+}
+
+func (s *BuildsSuite) TestFetchMeta_buildWithoutMeta() {
+	s.respond("v4/builds/456", `{"id":456,"jobId":392525,"status":"SUCCESS"}`)
+
+	got, err := s.fetch("sd@123:publish#build=456")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{}`, string(got))
+}
+
+func (s *BuildsSuite) TestFetchMeta_buildOfOtherJob() {
+	s.respond("v4/builds/456", `{"id":456,"jobId":1,"status":"SUCCESS","meta":{}}`)
+
+	_, err := s.fetch("sd@123:publish#build=456")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrBuildNotFound), "%v", err)
+	s.Assert().Contains(err.Error(), "build 456 is not a build of sd@123:publish#build=456")
+}
+
+func (s *BuildsSuite) TestFetchMeta_buildNotFound() {
+	_, err := s.fetch("sd@123:publish#build=456")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrBuildNotFound), "%v", err)
+}
+
+func (s *BuildsSuite) TestFetchMeta_event() {
+	s.respond("v4/events/789/builds", `[
+		{"id":1,"jobId":1,"status":"SUCCESS","meta":{"other":true}},
+		{"id":2,"jobId":392525,"status":"SUCCESS","meta":{"attempt":1}},
+		{"id":4,"jobId":392525,"status":"FAILURE","meta":{"attempt":3}},
+		{"id":3,"jobId":392525,"status":"SUCCESS","meta":{"attempt":2}}
+	]`)
+
+	got, err := s.fetch("sd@123:publish#event=789")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"attempt":2}`, string(got))
+	s.Assert().Equal(map[string]int{"/v4/pipelines/123/jobs?page=1&count=50": 1, "/v4/events/789/builds": 1},
+		s.MockServer.requests())
+}
+
+func (s *BuildsSuite) TestFetchMeta_eventWithoutBuild() {
+	s.respond("v4/events/789/builds", `[{"id":1,"jobId":1,"status":"SUCCESS"}]`)
+
+	_, err := s.fetch("sd@123:publish#event=789")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrBuildNotFound), "%v", err)
+}
+
+func (s *BuildsSuite) TestFetchMeta_eventWithoutSuccessfulBuild() {
+	s.respond("v4/events/789/builds", `[{"id":1,"jobId":392525,"status":"FAILURE"}]`)
+
+	_, err := s.fetch("sd@123:publish#event=789")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+}
+
+func (s *BuildsSuite) TestFetchMeta_sha() {
+	// The builds fill the first page, so the second page is requested too
+	var builds []string
+	for i := 0; i < jobBuildsPageSize; i++ {
+		builds = append(builds, fmt.Sprintf(`{"id":%d,"jobId":392525,"sha":"fff%d","status":"SUCCESS"}`, 1000-i, i))
+	}
+	s.respond("v4/jobs/392525/builds", "["+strings.Join(append(builds,
+		`{"id":900,"jobId":392525,"sha":"abc123def","status":"FAILURE","meta":{"failed":true}}`,
+		`{"id":899,"jobId":392525,"sha":"abc123def","status":"SUCCESS","meta":{"version":"1.2.3"}}`), ",")+"]")
+
+	got, err := s.fetch("sd@123:publish@sha=ABC123")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"version":"1.2.3"}`, string(got))
+	s.Assert().Equal(map[string]int{
+		"/v4/pipelines/123/jobs?page=1&count=50":                 1,
+		"/v4/jobs/392525/builds?sort=descending&page=1&count=50": 1,
+		"/v4/jobs/392525/builds?sort=descending&page=2&count=50": 1,
+	}, s.MockServer.requests())
+}
+
+func (s *BuildsSuite) TestFetchMeta_shaNotFound() {
+	s.respond("v4/jobs/392525/builds", `[{"id":1,"jobId":392525,"sha":"fff","status":"SUCCESS"}]`)
+
+	_, err := s.fetch("sd@123:publish@sha=abc123")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+	s.Assert().Contains(err.Error(), "sd@123:publish@sha=abc123 has no successful build at sha abc123")
+}
+
+func (s *BuildsSuite) TestFetchMeta_shaNotPaged() {
+	// The API ignores the page and returns the same full page every time, so no further pages are requested
+	var builds []string
+	for i := 0; i < jobBuildsPageSize; i++ {
+		builds = append(builds, fmt.Sprintf(`{"id":%d,"jobId":392525,"sha":"fff%d","status":"SUCCESS"}`, 1000-i, i))
+	}
+	buildsRequests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v4/pipelines/123/jobs":
+			_, _ = io.WriteString(w, buildsJobsJSON)
+		case r.URL.Path == "/v4/jobs/392525/builds" && buildsRequests < 3:
+			buildsRequests++
+			_, _ = io.WriteString(w, "["+strings.Join(builds, ",")+"]")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+	s.Request.SdAPIURL = testServer.URL + "/v4/"
+
+	_, err := s.fetch("sd@123:publish@sha=abc123")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+	s.Assert().Equal(2, buildsRequests)
+}
+
+func (s *BuildsSuite) TestGetBuildMeta() {
+	s.respond("v4/builds/456", `{"id":456,"jobId":392525,"status":"RUNNING","meta":{"b":1,"a":2}}`)
+
+	got, err := s.Request.GetBuildMeta(456)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"b":1,"a":2}`, string(got))
+
+	_, err = s.Request.GetBuildMeta(457)
+	s.Assert().True(errors.Is(err, ErrBuildNotFound), "%v", err)
+}
+
+func (s *BuildsSuite) TestPutBuildMeta() {
+	// The mock server only serves GET
+	var body []byte
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer test-token" ||
+			r.Header.Get("Content-Type") != "application/json" || r.Method != http.MethodPut:
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == "/v4/builds/456":
+			body, _ = ioutil.ReadAll(r.Body)
+			_, _ = io.WriteString(w, `{"id":456,"meta":{"b":1,"a":2}}`)
+		default:
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.WriteString(w, `{"statusCode":409,"error":"Conflict"}`)
+		}
+	}))
+	defer testServer.Close()
+	s.Request.SdAPIURL = testServer.URL + "/v4/"
+
+	s.Require().NoError(s.Request.PutBuildMeta(456, []byte(`{"b":1,"a":2}`)))
+	s.Assert().Equal(`{"meta":{"b":1,"a":2}}`, string(body))
+
+	err := s.Request.PutBuildMeta(457, []byte(`{}`))
+	s.Assert().True(errors.Is(err, ErrConflict), "%v", err)
+	s.Assert().Contains(err.Error(), "PUT "+testServer.URL+"/v4/builds/457: 409 Conflict")
+}
@@ -0,0 +1,277 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/screwdriver-cd/meta-cli/internal/atomicfile"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cacheFileExt = ".json"
+	// cacheJobsFile is the name of the file for the job list of a pipeline, which is not a valid job name
+	cacheJobsFile = "@jobs" + cacheFileExt
+)
+
+// Cache is an on-disk cache of fetched external meta, which may be shared by builds on the same host. Entries are kept
+// per namespace (see CacheNamespace) and pipeline in files named for the escaped job name and build selector, e.g.
+// <Dir>/<namespace>/123/publish#build=456.json, along with the job list of the pipeline in
+// <Dir>/<namespace>/123/@jobs.json. A Cache with an empty Dir (or a nil *Cache) is disabled.
+type Cache struct {
+	// Dir is the cache directory
+	Dir string
+	// TTL is how long entries are used after they are fetched (0 for forever)
+	TTL time.Duration
+	// MaxSize is the total size in bytes of the entries to keep when pruning (0 for no limit)
+	MaxSize int64
+}
+
+// CacheEntry describes an entry of a Cache.
+type CacheEntry struct {
+	// External is the external job description of the meta, e.g. sd@123:publish#build=456, or sd@123 for the job list
+	// of the pipeline
+	External string
+	// Path is the path to the file of the entry
+	Path string
+	// Size is the size of the entry in bytes
+	Size int64
+	// ModTime is when the entry was stored
+	ModTime time.Time
+	// Expired is whether the entry is older than the TTL
+	Expired bool
+}
+
+// Enabled returns whether the cache is enabled.
+func (c *Cache) Enabled() bool {
+	return c != nil && c.Dir != ""
+}
+
+// CacheNamespace returns the namespace of Cache entries fetched from the SD API at sdAPIURL with the credential (an
+// API key, the identity of a token or else the token itself), so that a cache shared by builds serves meta to the
+// builds of the same pipeline (or user), but not to other pipelines or users, nor meta of another SD API.
+func CacheNamespace(sdAPIURL string, credential string) string {
+	sum := sha256.Sum256([]byte(sdAPIURL + "\n" + credential))
+	return hex.EncodeToString(sum[:16])
+}
+
+// path returns the path of the file for the job description in the namespace.
+func (c *Cache) path(namespace string, jobDescription *JobDescription) string {
+	return filepath.Join(c.Dir, namespace, strconv.FormatInt(jobDescription.PipelineID, 10),
+		escapeCacheJobName(jobDescription.JobName)+jobDescription.Selector()+cacheFileExt)
+}
+
+// escapeCacheJobName escapes the job name for the name of a file, so that it cannot have path separators (and so
+// cannot be outside the directory of the pipeline) nor start with a dot, like temporary files.
+func escapeCacheJobName(jobName string) string {
+	escaped := url.PathEscape(jobName)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+// jobsPath returns the path of the file for the job list of the pipeline in the namespace.
+func (c *Cache) jobsPath(namespace string, pipelineID int64) string {
+	return filepath.Join(c.Dir, namespace, strconv.FormatInt(pipelineID, 10), cacheJobsFile)
+}
+
+// expired returns whether an entry stored at modTime has expired.
+func (c *Cache) expired(modTime time.Time) bool {
+	return c.TTL > 0 && time.Since(modTime) > c.TTL
+}
+
+// Get gets the meta for the job description in the namespace, or false when it is not cached or has expired.
+func (c *Cache) Get(namespace string, jobDescription *JobDescription) ([]byte, bool) {
+	if !c.Enabled() {
+		return nil, false
+	}
+	return c.read(c.path(namespace, jobDescription))
+}
+
+// Put stores the meta for the job description in the namespace. When MaxSize is set, the cache is then pruned.
+func (c *Cache) Put(namespace string, jobDescription *JobDescription, data []byte) error {
+	if !c.Enabled() {
+		return nil
+	}
+	return c.write(c.path(namespace, jobDescription), data)
+}
+
+// GetJobs gets the job list of the pipeline in the namespace, or false when it is not cached or has expired.
+func (c *Cache) GetJobs(namespace string, pipelineID int64) ([]byte, bool) {
+	if !c.Enabled() {
+		return nil, false
+	}
+	return c.read(c.jobsPath(namespace, pipelineID))
+}
+
+// PutJobs stores the job list of the pipeline in the namespace. When MaxSize is set, the cache is then pruned.
+func (c *Cache) PutJobs(namespace string, pipelineID int64, data []byte) error {
+	if !c.Enabled() {
+		return nil
+	}
+	return c.write(c.jobsPath(namespace, pipelineID), data)
+}
+
+// read reads the entry at path, or false when it does not exist or has expired.
+func (c *Cache) read(path string) ([]byte, bool) {
+	info, err := os.Stat(path)
+	if err != nil || c.expired(info.ModTime()) {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		logrus.Warnf("Cannot read cache entry %s: %v", path, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// write writes the entry at path. When MaxSize is set, the cache is then pruned.
+func (c *Cache) write(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err == nil {
+		err = atomicfile.WriteFile(path, data)
+	}
+	if err == nil && c.MaxSize > 0 {
+		_, err = c.Prune()
+	}
+	return err
+}
+
+// Entries lists the entries of the cache, oldest first.
+func (c *Cache) Entries() ([]CacheEntry, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	var ret []CacheEntry
+	err := filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, cacheFileExt) || strings.HasPrefix(name, ".") {
+			return nil
+		}
+		external := "sd@" + filepath.Base(filepath.Dir(path))
+		if name != cacheJobsFile {
+			jobName := strings.TrimSuffix(name, cacheFileExt)
+			if unescaped, err := url.PathUnescape(jobName); err == nil {
+				jobName = unescaped
+			}
+			external += ":" + jobName
+		}
+		ret = append(ret, CacheEntry{
+			External: external,
+			Path:     path,
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			Expired:  c.expired(info.ModTime()),
+		})
+		return nil
+	})
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].ModTime.Before(ret[j].ModTime)
+	})
+	return ret, err
+}
+
+// Clear removes all the entries of the cache.
+func (c *Cache) Clear() error {
+	entries, err := c.Entries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes the expired entries and then the oldest entries until the cache is no larger than MaxSize. It returns
+// the number of entries removed.
+func (c *Cache) Prune() (int, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Expired && (c.MaxSize <= 0 || size <= c.MaxSize) {
+			continue
+		}
+		if err = os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		logrus.Debugf("Pruned cached meta %s", entry.Path)
+		size -= entry.Size
+		removed++
+	}
+	return removed, nil
+}
+
+// cacheNamespace returns the namespace of the Cache entries of the request, for SdAPIURL and the API key or the
+// identity of the token (see jwtIdentity), as every build gets a new token, or else the token itself. It returns false
+// when the Cache is disabled or there is no credential (in which case the API call fails with a better error).
+func (r *LastSuccessfulMetaRequest) cacheNamespace(ctx context.Context) (string, bool) {
+	if !r.Cache.Enabled() {
+		return "", false
+	}
+	credential := r.SdAPIKey
+	if credential == "" {
+		token, err := r.GetAuthenticator().Token(ctx)
+		if err != nil {
+			logrus.Debugf("Not using the cache: %v", err)
+			return "", false
+		}
+		credential = token
+		if identity := jwtIdentity(token); identity != "" {
+			credential = identity
+		}
+	}
+	return CacheNamespace(r.SdAPIURL, credential), true
+}
+
+// cached gets the meta for the job description from Cache when possible; otherwise it is fetched with fetch and stored
+// in Cache. Errors are never cached.
+func (r *LastSuccessfulMetaRequest) cached(ctx context.Context, jobDescription *JobDescription,
+	fetch func() ([]byte, error)) ([]byte, error) {
+	namespace, ok := r.cacheNamespace(ctx)
+	if !ok {
+		return fetch()
+	}
+	cacheDescription := *jobDescription
+	if cacheDescription.PipelineID == 0 {
+		cacheDescription.PipelineID = r.DefaultSdPipelineID
+	}
+	if data, ok := r.Cache.Get(namespace, &cacheDescription); ok {
+		logrus.Debugf("Using cached meta for %s", cacheDescription.External())
+		return data, nil
+	}
+	data, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Cache.Put(namespace, &cacheDescription, data); err != nil {
+		logrus.Warnf("Cannot cache meta for %s: %v", cacheDescription.External(), err)
+	}
+	return data, nil
+}
@@ -0,0 +1,241 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type CacheSuite struct {
+	suite.Suite
+	Cache     *Cache
+	Namespace string
+}
+
+func TestCacheSuite(t *testing.T) {
+	suite.Run(t, new(CacheSuite))
+}
+
+func (s *CacheSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "cache")
+	s.Require().NoError(err)
+	s.Cache = &Cache{Dir: dir, TTL: time.Hour}
+	s.Namespace = CacheNamespace("https://api.screwdriver.cd/v4/", "token")
+}
+
+func (s *CacheSuite) TearDownTest() {
+	_ = os.RemoveAll(s.Cache.Dir)
+}
+
+// put stores data for the external job description and sets its modification time to age ago.
+func (s *CacheSuite) put(external string, data string, age time.Duration) *JobDescription {
+	jobDescription, err := ParseJobDescription(0, external)
+	s.Require().NoError(err)
+	s.Require().NoError(s.Cache.Put(s.Namespace, jobDescription, []byte(data)))
+	modTime := time.Now().Add(-age)
+	s.Require().NoError(os.Chtimes(s.Cache.path(s.Namespace, jobDescription), modTime, modTime))
+	return jobDescription
+}
+
+func (s *CacheSuite) TestGetPut() {
+	jobDescription := s.put("sd@123:publish", `{"foo":"bar"}`, 0)
+	got, ok := s.Cache.Get(s.Namespace, jobDescription)
+	s.Require().True(ok)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	// Builds are cached apart from the last successful meta
+	build := s.put("sd@123:publish#build=456", `{"foo":"baz"}`, 0)
+	got, ok = s.Cache.Get(s.Namespace, build)
+	s.Require().True(ok)
+	s.Assert().Equal(`{"foo":"baz"}`, string(got))
+	got, _ = s.Cache.Get(s.Namespace, jobDescription)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	_, ok = s.Cache.Get(s.Namespace, &JobDescription{PipelineID: 123, JobName: "other"})
+	s.Assert().False(ok)
+}
+
+func (s *CacheSuite) TestGetPut_namespaces() {
+	jobDescription := s.put("sd@123:publish", `{"foo":"bar"}`, 0)
+
+	// Entries are not shared by other credentials or SD APIs
+	for _, namespace := range []string{
+		CacheNamespace("https://api.screwdriver.cd/v4/", "other-token"),
+		CacheNamespace("https://other.screwdriver.cd/v4/", "token"),
+	} {
+		s.Assert().NotEqual(s.Namespace, namespace)
+		_, ok := s.Cache.Get(namespace, jobDescription)
+		s.Assert().False(ok, namespace)
+	}
+}
+
+func (s *CacheSuite) TestCacheNamespace_buildTokens() {
+	namespace := func(token string) string {
+		request := LastSuccessfulMetaRequest{SdAPIURL: "https://api.screwdriver.cd/v4/", SdToken: token, Cache: s.Cache}
+		namespace, ok := request.cacheNamespace(context.Background())
+		s.Require().True(ok)
+		return namespace
+	}
+	buildToken := func(buildID int, pipelineID int) string {
+		return jwtWithClaims(fmt.Sprintf(`{"username":"%d","scmContext":"github:github.com","scope":["build"],`+
+			`"isPR":false,"pipelineId":%d}`, buildID, pipelineID))
+	}
+
+	// Every build gets a new token, but the builds of a pipeline share the cache
+	s.Assert().Equal(namespace(buildToken(1, 123)), namespace(buildToken(2, 123)))
+	s.Assert().NotEqual(namespace(buildToken(1, 123)), namespace(buildToken(1, 456)))
+	// Tokens that identify no one are only shared by the same token
+	s.Assert().Equal(namespace("token"), namespace("token"))
+	s.Assert().NotEqual(namespace("token"), namespace("other-token"))
+}
+
+func (s *CacheSuite) TestGetPut_escapesJobNames() {
+	jobNames := []string{"../../x", `..\x`, "a/b", "..", "a%2Fb"}
+	for _, jobName := range jobNames {
+		s.Run(jobName, func() {
+			jobDescription := &JobDescription{PipelineID: 1, JobName: jobName}
+			s.Require().NoError(s.Cache.Put(s.Namespace, jobDescription, []byte(jobName)))
+			path := s.Cache.path(s.Namespace, jobDescription)
+			s.Assert().Equal(filepath.Join(s.Cache.Dir, s.Namespace, "1"), filepath.Dir(path))
+			got, ok := s.Cache.Get(s.Namespace, jobDescription)
+			s.Require().True(ok)
+			s.Assert().Equal(jobName, string(got))
+		})
+	}
+	entries, err := s.Cache.Entries()
+	s.Require().NoError(err)
+	var externals []string
+	for _, entry := range entries {
+		externals = append(externals, strings.TrimPrefix(entry.External, "sd@1:"))
+	}
+	s.Assert().ElementsMatch(jobNames, externals)
+}
+
+func (s *CacheSuite) TestGet_expired() {
+	jobDescription := s.put("sd@123:publish", `{}`, 2*time.Hour)
+	_, ok := s.Cache.Get(s.Namespace, jobDescription)
+	s.Assert().False(ok)
+
+	// Without a TTL, entries never expire
+	s.Cache.TTL = 0
+	_, ok = s.Cache.Get(s.Namespace, jobDescription)
+	s.Assert().True(ok)
+}
+
+func (s *CacheSuite) TestDisabled() {
+	var cache *Cache
+	s.Assert().False(cache.Enabled())
+	s.Assert().NoError(cache.Put(s.Namespace, &JobDescription{PipelineID: 1, JobName: "job"}, []byte(`{}`)))
+	_, ok := cache.Get(s.Namespace, &JobDescription{PipelineID: 1, JobName: "job"})
+	s.Assert().False(ok)
+	s.Assert().False((&Cache{}).Enabled())
+}
+
+func (s *CacheSuite) TestEntries() {
+	s.put("sd@123:publish", `{"a":1}`, time.Minute)
+	s.put("sd@456:deploy#event=789", `{}`, 2*time.Hour)
+
+	entries, err := s.Cache.Entries()
+	s.Require().NoError(err)
+	s.Require().Len(entries, 2)
+	s.Assert().Equal("sd@456:deploy#event=789", entries[0].External)
+	s.Assert().True(entries[0].Expired)
+	s.Assert().Equal(int64(2), entries[0].Size)
+	s.Assert().Equal("sd@123:publish", entries[1].External)
+	s.Assert().False(entries[1].Expired)
+
+	s.Require().NoError(s.Cache.Clear())
+	entries, err = s.Cache.Entries()
+	s.Require().NoError(err)
+	s.Assert().Empty(entries)
+}
+
+func (s *CacheSuite) TestEntries_missingDir() {
+	s.Cache.Dir += "/missing"
+	entries, err := s.Cache.Entries()
+	s.Require().NoError(err)
+	s.Assert().Empty(entries)
+}
+
+func (s *CacheSuite) TestPrune() {
+	s.put("sd@1:expired", `{"a":1}`, 2*time.Hour)
+	s.put("sd@1:oldest", `{"a":1}`, 30*time.Minute)
+	s.put("sd@1:older", `{"a":1}`, 20*time.Minute)
+	s.put("sd@1:newest", `{"a":1}`, 10*time.Minute)
+
+	s.Cache.MaxSize = 14
+	removed, err := s.Cache.Prune()
+	s.Require().NoError(err)
+	s.Assert().Equal(2, removed)
+	entries, err := s.Cache.Entries()
+	s.Require().NoError(err)
+	s.Require().Len(entries, 2)
+	s.Assert().Equal("sd@1:older", entries[0].External)
+	s.Assert().Equal("sd@1:newest", entries[1].External)
+}
+
+func (s *CacheSuite) TestFetchLastSuccessfulMeta_cached() {
+	var mockHandler MockHandler
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/pipelines/123/jobs"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), `[{"id":1,"name":"publish"}]`)
+		})
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/jobs/1/lastSuccessfulMeta"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			w := args.Get(0).(http.ResponseWriter)
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"statusCode":404,"error":"Not Found"}`)
+		})
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/jobs/1/lastSuccessfulMeta"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), `{"foo":"bar"}`)
+		})
+	testServer := httptest.NewServer(&mockHandler)
+	defer testServer.Close()
+
+	request := LastSuccessfulMetaRequest{
+		SdAPIURL:            testServer.URL + "/v4/",
+		Transport:           testServer.Client().Transport,
+		DefaultSdPipelineID: 123,
+		Cache:               s.Cache,
+	}
+	namespace, ok := request.cacheNamespace(context.Background())
+	s.Require().True(ok)
+	s.Assert().Equal(CacheNamespace(request.SdAPIURL, ""), namespace)
+
+	// Errors are not cached, but the job list is
+	_, err := request.FetchLastSuccessfulMeta(&JobDescription{JobName: "publish"})
+	s.Require().Error(err)
+	entries, err := s.Cache.Entries()
+	s.Require().NoError(err)
+	s.Require().Len(entries, 1)
+	s.Assert().Equal("sd@123", entries[0].External)
+
+	// Only the first fetch calls the API; the second uses the cache, and neither fetches the job list again
+	for i := 0; i < 2; i++ {
+		got, err := request.FetchMeta(&JobDescription{JobName: "publish"})
+		s.Require().NoError(err)
+		s.Assert().Equal(`{"foo":"bar"}`, string(got))
+	}
+	mockHandler.AssertExpectations(s.T())
+}
@@ -0,0 +1,94 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// ErrUnauthorized is the error when the SD API rejects the token (401)
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrForbidden is the error when the token may not read the pipeline (403)
+	ErrForbidden = errors.New("forbidden")
+	// ErrJobNotFound is the error when the pipeline or job does not exist
+	ErrJobNotFound = errors.New("job not found")
+	// ErrNoSuccessfulBuild is the error when the job has no successful build to get meta from
+	ErrNoSuccessfulBuild = errors.New("no successful build")
+	// ErrBuildNotFound is the error when the build or event does not exist or has no build of the job
+	ErrBuildNotFound = errors.New("build not found")
+	// ErrConflict is the error when the meta of the build was changed by someone else since it was synced (or 409)
+	ErrConflict = errors.New("conflict")
+	// ErrUnavailable is the error when the SD API fails (5xx), times out or cannot be reached, even after retrying
+	ErrUnavailable = errors.New("api unavailable")
+)
+
+// APIError is an error response from the SD API. It wraps one of the Err errors above (when its status has one), so
+// use errors.Is to check for them.
+type APIError struct {
+	// Method is the method of the request (GET when empty)
+	Method string
+	// URL is the requested url
+	URL string
+	// StatusCode is the status code of the response, e.g. 404
+	StatusCode int
+	// Status is the status of the response, e.g. "404 Not Found"
+	Status string
+	// Reason is the "error" of the SD error payload, e.g. "Not Found"
+	Reason string
+	// Message is the "message" of the SD error payload, e.g. "Job does not exist"
+	Message string
+	// Err is the error for the status code, or nil when there is none
+	Err error
+}
+
+// newAPIError creates an APIError from the response status and body; notFound is the error for a 404 response, which
+// depends on what was requested.
+func newAPIError(method string, url string, response *http.Response, body []byte, notFound error) *APIError {
+	ret := &APIError{
+		Method:     method,
+		URL:        url,
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+	}
+	// Screwdriver errors are of the form {"statusCode":404,"error":"Not Found","message":"Job does not exist"}
+	if gjson.ValidBytes(body) {
+		ret.Reason = gjson.GetBytes(body, "error").String()
+		ret.Message = gjson.GetBytes(body, "message").String()
+	}
+	switch {
+	case response.StatusCode == http.StatusUnauthorized:
+		ret.Err = ErrUnauthorized
+	case response.StatusCode == http.StatusForbidden:
+		ret.Err = ErrForbidden
+	case response.StatusCode == http.StatusNotFound:
+		ret.Err = notFound
+	case response.StatusCode == http.StatusConflict:
+		ret.Err = ErrConflict
+	case response.StatusCode >= http.StatusInternalServerError:
+		ret.Err = ErrUnavailable
+	}
+	return ret
+}
+
+func (e *APIError) Error() string {
+	method := e.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	ret := fmt.Sprintf("%s %s: %s", method, e.URL, e.Status)
+	if e.Err != nil {
+		ret = fmt.Sprintf("%s: %s", e.Err, ret)
+	}
+	if e.Message != "" {
+		ret = fmt.Sprintf("%s: %s", ret, e.Message)
+	}
+	return ret
+}
+
+// Unwrap returns Err so that errors.Is works with the errors above.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
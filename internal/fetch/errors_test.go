@@ -0,0 +1,128 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorsSuite struct {
+	suite.Suite
+}
+
+func TestErrorsSuite(t *testing.T) {
+	suite.Run(t, new(ErrorsSuite))
+}
+
+func (s *ErrorsSuite) TestFetchLastSuccessfulMeta_errors() {
+	tests := []struct {
+		name           string
+		jobsStatus     int
+		jobsBody       string
+		metaStatus     int
+		metaBody       string
+		expected       error
+		expectedString string
+	}{
+		{
+			name:       "unauthorized",
+			jobsStatus: http.StatusUnauthorized,
+			jobsBody:   `{"statusCode":401,"error":"Unauthorized","message":"Missing authentication"}`,
+			expected:   ErrUnauthorized,
+			expectedString: "unauthorized: GET %s/v4/pipelines/1016708/jobs?page=1&count=50: 401 Unauthorized: " +
+				"Missing authentication",
+		},
+		{
+			name:       "forbidden",
+			jobsStatus: http.StatusForbidden,
+			jobsBody:   `{"statusCode":403,"error":"Forbidden","message":"User does not have read permission"}`,
+			expected:   ErrForbidden,
+		},
+		{
+			name:       "pipeline not found",
+			jobsStatus: http.StatusNotFound,
+			jobsBody:   `{"statusCode":404,"error":"Not Found","message":"Pipeline does not exist"}`,
+			expected:   ErrJobNotFound,
+		},
+		{
+			name:       "job not found",
+			jobsStatus: http.StatusOK,
+			jobsBody:   `[]`,
+			expected:   ErrJobNotFound,
+		},
+		{
+			name:       "no successful build",
+			jobsStatus: http.StatusOK,
+			jobsBody:   `[{"id":392525,"name":"job1"}]`,
+			metaStatus: http.StatusNotFound,
+			metaBody:   `{"statusCode":404,"error":"Not Found","message":"There is no successful build"}`,
+			expected:   ErrNoSuccessfulBuild,
+			expectedString: "no successful build: GET %s/v4/jobs/392525/lastSuccessfulMeta: 404 Not Found: " +
+				"There is no successful build",
+		},
+		{
+			name:       "server error",
+			jobsStatus: http.StatusOK,
+			jobsBody:   `[{"id":392525,"name":"job1"}]`,
+			metaStatus: http.StatusInternalServerError,
+			metaBody:   `not json`,
+			expected:   ErrUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			var mockHandler MockHandler
+			respond := func(path string, status int, body string) {
+				mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+					return req.URL.Path == path
+				})).
+					Once().
+					Run(func(args mock.Arguments) {
+						w := args.Get(0).(http.ResponseWriter)
+						w.WriteHeader(status)
+						_, _ = io.WriteString(w, body)
+					})
+			}
+			respond("/v4/pipelines/1016708/jobs", tt.jobsStatus, tt.jobsBody)
+			if tt.metaStatus != 0 {
+				respond("/v4/jobs/392525/lastSuccessfulMeta", tt.metaStatus, tt.metaBody)
+			}
+			testServer := httptest.NewServer(&mockHandler)
+			defer testServer.Close()
+
+			request := LastSuccessfulMetaRequest{
+				SdAPIURL:  testServer.URL + "/v4/",
+				Transport: testServer.Client().Transport,
+			}
+			got, err := request.FetchLastSuccessfulMeta(&JobDescription{PipelineID: 1016708, JobName: "job1"})
+			s.Require().Error(err)
+			s.Assert().Nil(got)
+			s.Assert().True(errors.Is(err, tt.expected), "%v is not %v", err, tt.expected)
+			if tt.expectedString != "" {
+				s.Assert().EqualError(err, fmt.Sprintf(tt.expectedString, testServer.URL))
+			}
+			mockHandler.AssertExpectations(s.T())
+		})
+	}
+}
+
+func (s *ErrorsSuite) TestAPIError() {
+	err := error(&APIError{URL: "https://sd/v4/jobs/1/lastSuccessfulMeta", StatusCode: 418, Status: "418 I'm a teapot"})
+	s.Assert().EqualError(err, "GET https://sd/v4/jobs/1/lastSuccessfulMeta: 418 I'm a teapot")
+	var apiError *APIError
+	s.Require().True(errors.As(err, &apiError))
+	s.Assert().Equal(418, apiError.StatusCode)
+	s.Assert().Nil(errors.Unwrap(err))
+
+	err = &APIError{Method: http.MethodPut, URL: "https://sd/v4/builds/1", StatusCode: 409, Status: "409 Conflict",
+		Err: ErrConflict}
+	s.Assert().EqualError(err, "conflict: PUT https://sd/v4/builds/1: 409 Conflict")
+	s.Assert().True(errors.Is(err, ErrConflict))
+}
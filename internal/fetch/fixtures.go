@@ -0,0 +1,227 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/screwdriver-cd/meta-cli/internal/atomicfile"
+	"github.com/sirupsen/logrus"
+)
+
+const fixtureFileExt = ".json"
+
+// FixtureFile returns the path of the fixture for a GET of u in dir: the path of u below dir, followed by its escaped
+// query, e.g. <dir>/v4/pipelines/123/jobs%3Fpage=1&count=50.json. The host of u is ignored, so that fixtures may be
+// replayed against any SD API url.
+func FixtureFile(dir string, u *url.URL) string {
+	name := strings.TrimPrefix(u.Path, "/")
+	if u.RawQuery != "" {
+		name += url.PathEscape("?" + u.RawQuery)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)) + fixtureFileExt
+}
+
+// NewFixtureTransport returns an http.RoundTripper that replays the SD API responses at path, which is either a
+// directory of fixtures (as recorded by a RecordingTransport) or a HAR file, instead of calling the API. Requests
+// without a fixture get a 404 response.
+func NewFixtureTransport(path string) (http.RoundTripper, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read fixtures: %w", err)
+	}
+	if info.IsDir() {
+		return &FixtureTransport{Dir: path}, nil
+	}
+	return LoadHAR(path)
+}
+
+// FixtureTransport is an http.RoundTripper that replays the fixtures in a directory, so that external meta can be
+// fetched offline and deterministically. Only GET requests are replayed, with status 200. The directory has the same
+// layout as that of a MockServer.
+type FixtureTransport struct {
+	// Dir is the directory of fixtures, as written by a RecordingTransport
+	Dir string
+}
+
+// RoundTrip responds with the fixture of the request
+func (t *FixtureTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.Method != http.MethodGet {
+		return fixtureResponse(request, http.StatusMethodNotAllowed,
+			fixtureErrorBody(http.StatusMethodNotAllowed, "fixtures can only be replayed for GET")), nil
+	}
+	status, data, err := readFixture(t.Dir, request)
+	if err != nil {
+		return nil, err
+	}
+	return fixtureResponse(request, status, data), nil
+}
+
+// readFixture reads the fixture in dir for the GET request: the file recorded for its url (see FixtureFile) or else,
+// when the url has a query, the file for its path alone, which is filtered and paged for the query like the SD API
+// does (see mockQuery). Requests without a fixture get a 404 error payload, and invalid queries a 400 one.
+func readFixture(dir string, request *http.Request) (int, []byte, error) {
+	path := FixtureFile(dir, request.URL)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && request.URL.RawQuery != "" {
+		pathOnly := *request.URL
+		pathOnly.RawQuery = ""
+		var queryErr error
+		if data, err = ioutil.ReadFile(FixtureFile(dir, &pathOnly)); err == nil {
+			if data, queryErr = mockQuery(data, request); queryErr != nil {
+				return http.StatusBadRequest, fixtureErrorBody(http.StatusBadRequest, queryErr.Error()), nil
+			}
+		}
+	}
+	if os.IsNotExist(err) {
+		logrus.Debugf("No fixture %s", path)
+		return http.StatusNotFound, fixtureErrorBody(http.StatusNotFound, "no fixture "+path), nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	logrus.Debugf("Replaying fixture for %s", request.URL.RequestURI())
+	return http.StatusOK, data, nil
+}
+
+// HARTransport is an http.RoundTripper that replays the responses of a HAR (HTTP archive) file, e.g. as saved by the
+// developer tools of a browser. Requests are matched by method, path and query; when a request was made more than
+// once, the last response is replayed.
+type HARTransport struct {
+	responses map[string]harResponse
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method string `json:"method"`
+				URL    string `json:"url"`
+			} `json:"request"`
+			Response harResponse `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harResponse struct {
+	Status  int `json:"status"`
+	Content struct {
+		Text     string `json:"text"`
+		Encoding string `json:"encoding"`
+	} `json:"content"`
+}
+
+// harKey returns the key of a request with method to u
+func harKey(method string, u *url.URL) string {
+	return method + " " + u.Path + "?" + u.RawQuery
+}
+
+// LoadHAR loads the HAR file at path for replaying.
+func LoadHAR(path string) (*HARTransport, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read fixtures: %w", err)
+	}
+	var har harFile
+	if err = json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("cannot read fixtures: %s is not a HAR file: %w", path, err)
+	}
+	ret := &HARTransport{responses: map[string]harResponse{}}
+	for _, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read fixtures: %s: %w", path, err)
+		}
+		ret.responses[harKey(entry.Request.Method, u)] = entry.Response
+	}
+	return ret, nil
+}
+
+// RoundTrip responds with the recorded response of the request
+func (t *HARTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, ok := t.responses[harKey(request.Method, request.URL)]
+	if !ok {
+		logrus.Debugf("No fixture for %s %s", request.Method, request.URL)
+		return fixtureResponse(request, http.StatusNotFound, fixtureErrorBody(http.StatusNotFound,
+			fmt.Sprintf("no fixture for %s %s", request.Method, request.URL.RequestURI()))), nil
+	}
+	body := []byte(response.Content.Text)
+	if response.Content.Encoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(response.Content.Text)
+		if err != nil {
+			return nil, fmt.Errorf("fixture for %s %s: %w", request.Method, request.URL.RequestURI(), err)
+		}
+		body = decoded
+	}
+	return fixtureResponse(request, response.Status, body), nil
+}
+
+// RecordingTransport is an http.RoundTripper that records the successful responses to GET requests of Transport as
+// fixtures in Dir, for replaying with a FixtureTransport. API key exchanges are never recorded.
+type RecordingTransport struct {
+	// Dir is the directory to record the fixtures in
+	Dir string
+	// Transport is the transport whose responses are recorded (when nil, uses http.DefaultTransport)
+	Transport http.RoundTripper
+}
+
+// RoundTrip makes the request with Transport and records the response
+func (t *RecordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	response, err := transport.RoundTrip(request)
+	if err != nil || request.Method != http.MethodGet || response.StatusCode != http.StatusOK ||
+		strings.HasSuffix(request.URL.Path, "/auth/token") {
+		return response, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(data))
+	path := FixtureFile(t.Dir, request.URL)
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err == nil {
+		err = atomicfile.WriteFile(path, data)
+	}
+	if err != nil {
+		logrus.Warnf("Cannot record fixture %s: %v", path, err)
+	} else {
+		logrus.Debugf("Recorded fixture %s", path)
+	}
+	return response, nil
+}
+
+// fixtureResponse returns a response to request with the status and json body.
+func fixtureResponse(request *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       request,
+	}
+}
+
+// fixtureErrorBody returns a Screwdriver error payload with the status and message.
+func fixtureErrorBody(status int, message string) []byte {
+	data, _ := json.Marshal(struct {
+		StatusCode int    `json:"statusCode"`
+		Error      string `json:"error"`
+		Message    string `json:"message"`
+	}{StatusCode: status, Error: http.StatusText(status), Message: message})
+	return data
+}
@@ -0,0 +1,148 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FixturesSuite struct {
+	suite.Suite
+	Dir string
+}
+
+func TestFixturesSuite(t *testing.T) {
+	suite.Run(t, new(FixturesSuite))
+}
+
+func (s *FixturesSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "fixtures")
+	s.Require().NoError(err)
+	s.Dir = dir
+}
+
+func (s *FixturesSuite) TearDownTest() {
+	_ = os.RemoveAll(s.Dir)
+}
+
+// request returns a request of pipeline 123 with the transport
+func request(transport http.RoundTripper) LastSuccessfulMetaRequest {
+	return LastSuccessfulMetaRequest{
+		SdAPIURL:            "https://api.screwdriver.cd/v4/",
+		Transport:           transport,
+		DefaultSdPipelineID: 123,
+	}
+}
+
+func (s *FixturesSuite) TestFixtureFile() {
+	u, err := url.Parse("https://api.screwdriver.cd/v4/pipelines/123/jobs?page=1&count=50")
+	s.Require().NoError(err)
+	s.Assert().Equal(filepath.Join(s.Dir, "v4", "pipelines", "123", "jobs%3Fpage=1&count=50.json"),
+		FixtureFile(s.Dir, u))
+
+	u, err = url.Parse("https://api.screwdriver.cd/v4/jobs/1/lastSuccessfulMeta")
+	s.Require().NoError(err)
+	s.Assert().Equal(filepath.Join(s.Dir, "v4", "jobs", "1", "lastSuccessfulMeta.json"), FixtureFile(s.Dir, u))
+}
+
+func (s *FixturesSuite) TestRecordAndReplay() {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v4/auth/token":
+			_, _ = io.WriteString(w, `{"token":"secret"}`)
+		case "/v4/pipelines/123/jobs":
+			_, _ = io.WriteString(w, `[{"id":1,"name":"publish"}]`)
+		case "/v4/jobs/1/lastSuccessfulMeta":
+			_, _ = io.WriteString(w, `{"foo":"bar"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	recording := request(&RecordingTransport{Dir: s.Dir, Transport: testServer.Client().Transport})
+	recording.SdAPIURL = testServer.URL + "/v4/"
+	recording.SdAPIKey = "api-key"
+	got, err := recording.FetchLastSuccessfulMeta(&JobDescription{JobName: "publish"})
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+	_, err = recording.FetchLastSuccessfulMeta(&JobDescription{JobName: "missing"})
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+	testServer.Close()
+
+	// Only the successful responses were recorded, and never the exchanged token
+	var recorded []string
+	s.Require().NoError(filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(s.Dir, path)
+			recorded = append(recorded, filepath.ToSlash(rel))
+		}
+		return err
+	}))
+	s.Assert().Equal([]string{"v4/jobs/1/lastSuccessfulMeta.json", "v4/pipelines/123/jobs%3Fpage=1&count=50.json"},
+		recorded)
+
+	// They are replayed offline, against any SD API url
+	transport, err := NewFixtureTransport(s.Dir)
+	s.Require().NoError(err)
+	replaying := request(transport)
+	got, err = replaying.FetchLastSuccessfulMeta(&JobDescription{JobName: "publish"})
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	_, err = replaying.FetchLastSuccessfulMeta(&JobDescription{PipelineID: 456, JobName: "publish"})
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+	s.Assert().Contains(err.Error(), "404 Not Found: no fixture "+filepath.Join(s.Dir, "v4", "pipelines", "456"))
+
+	err = replaying.PutBuildMeta(1, []byte(`{}`))
+	var apiError *APIError
+	s.Require().True(errors.As(err, &apiError), "%v", err)
+	s.Assert().Equal(http.StatusMethodNotAllowed, apiError.StatusCode)
+}
+
+func (s *FixturesSuite) TestHAR() {
+	harPath := filepath.Join(s.Dir, "sd.har")
+	s.Require().NoError(ioutil.WriteFile(harPath, []byte(`{"log":{"entries":[
+		{"request":{"method":"GET","url":"https://sd/v4/pipelines/123/jobs?page=1&count=50"},
+		 "response":{"status":200,"content":{"text":"[{\"id\":1,\"name\":\"publish\"},{\"id\":2,\"name\":\"main\"}]"}}},
+		{"request":{"method":"GET","url":"https://sd/v4/jobs/1/lastSuccessfulMeta"},
+		 "response":{"status":200,"content":{"text":"eyJmb28iOiJiYXIifQ==","encoding":"base64"}}},
+		{"request":{"method":"GET","url":"https://sd/v4/jobs/2/lastSuccessfulMeta"},
+		 "response":{"status":404,"content":{"text":"{\"statusCode\":404,\"error\":\"Not Found\"}"}}}
+	]}}`), 0666))
+
+	transport, err := NewFixtureTransport(harPath)
+	s.Require().NoError(err)
+	s.Require().IsType(&HARTransport{}, transport)
+	replaying := request(transport)
+	got, err := replaying.FetchLastSuccessfulMeta(&JobDescription{JobName: "publish"})
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	_, err = replaying.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+
+	_, err = replaying.GetBuildMeta(5)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrBuildNotFound), "%v", err)
+	s.Assert().Contains(err.Error(), "no fixture for GET /v4/builds/5")
+}
+
+func (s *FixturesSuite) TestNewFixtureTransport_errors() {
+	_, err := NewFixtureTransport(filepath.Join(s.Dir, "missing"))
+	s.Assert().Error(err)
+
+	notHAR := filepath.Join(s.Dir, "not.har")
+	s.Require().NoError(ioutil.WriteFile(notHAR, []byte("not json"), 0666))
+	_, err = NewFixtureTransport(notHAR)
+	s.Assert().EqualError(err, fmt.Sprintf("cannot read fixtures: %s is not a HAR file: "+
+		"invalid character 'o' in literal null (expecting 'u')", notHAR))
+}
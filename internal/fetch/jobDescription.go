@@ -7,7 +7,10 @@ import (
 	"strings"
 )
 
-var jobDescriptionSDRegExp = regexp.MustCompile(`^sd@(\d+):([\w-]+)$`)
+var jobDescriptionSDRegExp = regexp.MustCompile(
+	`^(?:sd@(\d+):)?((?:PR-\d+:)?[\w-]+)(?:#(build|event)=(\d+)|@sha=([0-9a-fA-F]+))?$`)
+var pullRequestRegExp = regexp.MustCompile(`^\d+$`)
+var prJobNameRegExp = regexp.MustCompile(`^PR-\d+:`)
 
 // JobDescription describes a screwdriver job.
 type JobDescription struct {
@@ -15,11 +18,19 @@ type JobDescription struct {
 	MetaFile string
 	// The pipeline ID for this job
 	PipelineID int64
-	// The name of the job
+	// The name of the job, e.g. publish or PR-12:publish
 	JobName string
+	// The ID of the build to get the meta of, rather than the last successful build (#build=456)
+	BuildID int64
+	// The ID of the event whose build of the job to get the meta of (#event=789)
+	EventID int64
+	// The commit SHA (or a prefix of it) of the last successful build to get the meta of (@sha=abc123)
+	SHA string
 }
 
-// ParseJobDescription parses the string of the form sd@123:jobName or jobName to create a new JobDescription object
+// ParseJobDescription parses the string of the form sd@123:jobName or jobName to create a new JobDescription object.
+// The jobName may be that of a PR job, e.g. sd@123:PR-12:publish.
+// Either may be followed by #build=456, #event=789 or @sha=abc123 to describe a particular build of the job.
 func ParseJobDescription(defaultPipelineID int64, external string) (*JobDescription, error) {
 	if strings.HasPrefix(external, "-") {
 		return nil, fmt.Errorf(`--external "%s" appears to be a flag; not an external description`, external)
@@ -30,24 +41,80 @@ func ParseJobDescription(defaultPipelineID int64, external string) (*JobDescript
 	}
 	matches := jobDescriptionSDRegExp.FindStringSubmatch(external)
 	if len(matches) == 0 {
+		if strings.Contains(external, "#") || strings.Contains(external, "@sha=") {
+			return nil, fmt.Errorf(`--external "%s" must select a build with #build=<id>, #event=<id> or @sha=<sha>`,
+				external)
+		}
 		ret.JobName = external
 		return ret, nil
 	}
 	var err error
-	ret.PipelineID, err = strconv.ParseInt(matches[1], 10, 0)
-	if err != nil {
-		return nil, err
+	if matches[1] != "" {
+		if ret.PipelineID, err = strconv.ParseInt(matches[1], 10, 0); err != nil {
+			return nil, err
+		}
 	}
 	ret.JobName = matches[2]
+	if matches[3] != "" {
+		id, err := strconv.ParseInt(matches[4], 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		if matches[3] == "build" {
+			ret.BuildID = id
+		} else {
+			ret.EventID = id
+		}
+	}
+	ret.SHA = strings.ToLower(matches[5])
 	return ret, nil
 }
 
+// ParseJobDescription parses external like the ParseJobDescription func, with DefaultSdPipelineID as the default
+// pipeline. In a PR build (when DefaultPullRequest is set), a job without sd@pipelineId: is the job of the same PR,
+// e.g. publish is PR-45:publish, so that PR builds read the meta of their sibling PR jobs. Use sd@pipelineId:publish
+// for the job of the main branch.
+func (r *LastSuccessfulMetaRequest) ParseJobDescription(external string) (*JobDescription, error) {
+	ret, err := ParseJobDescription(r.DefaultSdPipelineID, external)
+	if err != nil || r.DefaultPullRequest == "" {
+		return ret, err
+	}
+	if !pullRequestRegExp.MatchString(r.DefaultPullRequest) {
+		return nil, fmt.Errorf(`pull request "%s" is not a number`, r.DefaultPullRequest)
+	}
+	if matches := jobDescriptionSDRegExp.FindStringSubmatch(external); matches != nil && matches[1] == "" &&
+		!prJobNameRegExp.MatchString(ret.JobName) {
+		ret.JobName = fmt.Sprintf("PR-%s:%s", r.DefaultPullRequest, ret.JobName)
+	}
+	return ret, nil
+}
+
+// Selector returns the part of the description that selects a build, e.g. #build=456, or "" for the last successful
+// build.
+func (jd *JobDescription) Selector() string {
+	switch {
+	case jd.BuildID != 0:
+		return fmt.Sprintf("#build=%d", jd.BuildID)
+	case jd.EventID != 0:
+		return fmt.Sprintf("#event=%d", jd.EventID)
+	case jd.SHA != "":
+		return "@sha=" + jd.SHA
+	default:
+		return ""
+	}
+}
+
 // External returns a representation of the JobDescription appropriate for use in meta get's --external flag
 func (jd *JobDescription) External() string {
-	return fmt.Sprintf("sd@%d:%s", jd.PipelineID, jd.JobName)
+	return fmt.Sprintf("sd@%d:%s%s", jd.PipelineID, jd.JobName, jd.Selector())
 }
 
-// MetaKey returns a valid meta key unique to this job-description, which may be used for storing metadata
+// MetaKey returns a valid meta key unique to this job-description, which may be used for storing metadata. The meta of
+// a particular build is stored under a quoted name, e.g. sd.123."publish#build=456", so it is kept apart from that of
+// the last successful build.
 func (jd *JobDescription) MetaKey() string {
+	if selector := jd.Selector(); selector != "" {
+		return fmt.Sprintf(`sd.%d."%s%s"`, jd.PipelineID, jd.JobName, selector)
+	}
 	return fmt.Sprintf("sd.%d.%s", jd.PipelineID, jd.JobName)
 }
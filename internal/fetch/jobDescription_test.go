@@ -53,6 +53,75 @@ func (s *JobDescriptionSuite) Test_parseJobDescription() {
 			defaultPipelineID: 123,
 			wantErr:           true,
 		},
+		{
+			jobDescription:    `sd@123:publish#build=456`,
+			defaultPipelineID: 999,
+			want: &JobDescription{
+				MetaFile:   `sd@123:publish#build=456`,
+				PipelineID: 123,
+				JobName:    "publish",
+				BuildID:    456,
+			},
+		},
+		{
+			jobDescription:    `sd@123:publish#event=789`,
+			defaultPipelineID: 999,
+			want: &JobDescription{
+				MetaFile:   `sd@123:publish#event=789`,
+				PipelineID: 123,
+				JobName:    "publish",
+				EventID:    789,
+			},
+		},
+		{
+			jobDescription:    `sd@123:publish@sha=ABC123`,
+			defaultPipelineID: 999,
+			want: &JobDescription{
+				MetaFile:   `sd@123:publish@sha=ABC123`,
+				PipelineID: 123,
+				JobName:    "publish",
+				SHA:        "abc123",
+			},
+		},
+		{
+			jobDescription:    `publish#build=456`,
+			defaultPipelineID: 123,
+			want: &JobDescription{
+				MetaFile:   `publish#build=456`,
+				PipelineID: 123,
+				JobName:    "publish",
+				BuildID:    456,
+			},
+		},
+		{
+			jobDescription:    `sd@123:PR-12:publish`,
+			defaultPipelineID: 999,
+			want: &JobDescription{
+				MetaFile:   `sd@123:PR-12:publish`,
+				PipelineID: 123,
+				JobName:    "PR-12:publish",
+			},
+		},
+		{
+			jobDescription:    `PR-12:publish#event=789`,
+			defaultPipelineID: 123,
+			want: &JobDescription{
+				MetaFile:   `PR-12:publish#event=789`,
+				PipelineID: 123,
+				JobName:    "PR-12:publish",
+				EventID:    789,
+			},
+		},
+		{
+			jobDescription:    `sd@123:publish#build=latest`,
+			defaultPipelineID: 123,
+			wantErr:           true,
+		},
+		{
+			jobDescription:    `sd@123:publish@sha=xyz`,
+			defaultPipelineID: 123,
+			wantErr:           true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -80,6 +149,22 @@ func (s *JobDescriptionSuite) TestJobDescription_External() {
 				JobName:    "fooBar",
 			},
 		},
+		{
+			name: "sd@123:fooBar#build=456",
+			jobDescription: JobDescription{
+				PipelineID: 123,
+				JobName:    "fooBar",
+				BuildID:    456,
+			},
+		},
+		{
+			name: "sd@123:fooBar@sha=abc123",
+			jobDescription: JobDescription{
+				PipelineID: 123,
+				JobName:    "fooBar",
+				SHA:        "abc123",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -102,6 +187,21 @@ func (s *JobDescriptionSuite) TestJobDescription_MetaKey() {
 				JobName:    "fooBar",
 			},
 		},
+		{
+			name: `sd.123."fooBar#event=789"`,
+			jobDescription: JobDescription{
+				PipelineID: 123,
+				JobName:    "fooBar",
+				EventID:    789,
+			},
+		},
+		{
+			name: "sd.123.PR-12:fooBar",
+			jobDescription: JobDescription{
+				PipelineID: 123,
+				JobName:    "PR-12:fooBar",
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -111,3 +211,35 @@ func (s *JobDescriptionSuite) TestJobDescription_MetaKey() {
 		})
 	}
 }
+
+func (s *JobDescriptionSuite) TestLastSuccessfulMetaRequest_ParseJobDescription() {
+	tests := []struct {
+		external    string
+		pullRequest string
+		want        string
+		wantErr     bool
+	}{
+		{external: "publish", want: "sd@123:publish"},
+		{external: "publish", pullRequest: "45", want: "sd@123:PR-45:publish"},
+		{external: "publish#build=456", pullRequest: "45", want: "sd@123:PR-45:publish#build=456"},
+		{external: "PR-12:publish", pullRequest: "45", want: "sd@123:PR-12:publish"},
+		{external: "sd@123:publish", pullRequest: "45", want: "sd@123:publish"},
+		{external: "sd@999:publish", pullRequest: "45", want: "sd@999:publish"},
+		{external: "sd@123:PR-45:publish", want: "sd@123:PR-45:publish"},
+		{external: "publish", pullRequest: "false", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.external+"/"+tt.pullRequest, func() {
+			request := LastSuccessfulMetaRequest{DefaultSdPipelineID: 123, DefaultPullRequest: tt.pullRequest}
+			got, err := request.ParseJobDescription(tt.external)
+			if tt.wantErr {
+				s.Require().Error(err)
+				return
+			}
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.want, got.External())
+			s.Assert().Equal(tt.external, got.MetaFile)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jobsPageSize is the number of jobs to request per page of the job list of a pipeline
+const jobsPageSize = 50
+
+// pipelineJob is the part of a screwdriver job that is needed to look up its ID by name.
+type pipelineJob struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// jobLists holds the job list of each pipeline that a LastSuccessfulMetaRequest (and its copies) looked up.
+type jobLists struct {
+	mutex sync.Mutex
+	lists map[int64]*jobList
+}
+
+// jobList is the job list of a pipeline. Its mutex is held while it is read or fetched, so concurrent lookups in the
+// same pipeline wait for a single fetch.
+type jobList struct {
+	mutex sync.Mutex
+	// data is the json array of the id and name of the jobs, or nil until it is read or fetched
+	data []byte
+	// fetched is whether data was fetched from the API by this process, rather than read from the Cache
+	fetched bool
+}
+
+// get returns the job list of the pipeline, adding it when there is none.
+func (l *jobLists) get(pipelineID int64) *jobList {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lists == nil {
+		l.lists = map[int64]*jobList{}
+	}
+	if l.lists[pipelineID] == nil {
+		l.lists[pipelineID] = &jobList{}
+	}
+	return l.lists[pipelineID]
+}
+
+// JobsForPipelinePageURL returns the URL for a page (starting at 1) of the jobs of a given pipelineID
+func (r *LastSuccessfulMetaRequest) JobsForPipelinePageURL(pipelineID int64, page int) string {
+	return fmt.Sprintf("%s?page=%d&count=%d", r.JobsForPipelineURL(pipelineID), page, jobsPageSize)
+}
+
+// getJobLists returns the job lists that have been looked up, assigning them when nil. Like GetTransport, call it
+// before sharing the request between goroutines.
+func (r *LastSuccessfulMetaRequest) getJobLists() *jobLists {
+	if r.jobLists == nil {
+		r.jobLists = &jobLists{}
+	}
+	return r.jobLists
+}
+
+// FetchJobs fetches the full job list of the pipeline, which includes its PR jobs (e.g. PR-12:publish), and returns a
+// json array of the id and name of the jobs.
+func (r *LastSuccessfulMetaRequest) FetchJobs(pipelineID int64) ([]byte, error) {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	return r.FetchJobsContext(ctx, pipelineID)
+}
+
+// FetchJobsContext is like FetchJobs, but the API calls are bound by ctx rather than Timeout
+func (r *LastSuccessfulMetaRequest) FetchJobsContext(ctx context.Context, pipelineID int64) ([]byte, error) {
+	jobs := []pipelineJob{}
+	seen := map[int64]bool{}
+	for page := 1; ; page++ {
+		data, err := r.get(ctx, r.JobsForPipelinePageURL(pipelineID, page), ErrJobNotFound)
+		if err != nil {
+			return nil, err
+		}
+		var pageJobs []pipelineJob
+		if err = json.Unmarshal(data, &pageJobs); err != nil {
+			return nil, err
+		}
+		added := 0
+		for _, job := range pageJobs {
+			if !seen[job.ID] {
+				seen[job.ID] = true
+				jobs = append(jobs, job)
+				added++
+			}
+		}
+		// Stop after the last page, or when the API doesn't page the jobs and returns all of them on every page
+		if len(pageJobs) != jobsPageSize || added == 0 {
+			break
+		}
+	}
+	logrus.Tracef("Fetched %d jobs of pipeline %d", len(jobs), pipelineID)
+	return json.Marshal(jobs)
+}
+
+// pipelineJobs returns the job list of the pipeline, which is only fetched once per process and is stored in Cache.
+// With refresh, a job list that was read from Cache is fetched again. It also returns whether the job list was fetched
+// by this process.
+func (r *LastSuccessfulMetaRequest) pipelineJobs(ctx context.Context, pipelineID int64, refresh bool) ([]byte, bool,
+	error) {
+	list := r.getJobLists().get(pipelineID)
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if list.data != nil && (list.fetched || !refresh) {
+		return list.data, list.fetched, nil
+	}
+	namespace, useCache := r.cacheNamespace(ctx)
+	if !refresh && useCache {
+		if data, ok := r.Cache.GetJobs(namespace, pipelineID); ok {
+			logrus.Debugf("Using cached jobs of pipeline %d", pipelineID)
+			list.data = data
+			return data, false, nil
+		}
+	}
+	data, err := r.FetchJobsContext(ctx, pipelineID)
+	if err != nil {
+		return nil, false, err
+	}
+	if useCache {
+		if err = r.Cache.PutJobs(namespace, pipelineID, data); err != nil {
+			logrus.Warnf("Cannot cache jobs of pipeline %d: %v", pipelineID, err)
+		}
+	}
+	list.data, list.fetched = data, true
+	return data, true, nil
+}
+
+// lookUpJobID looks up the ID of the job by name in the job list of the pipeline. When the job is not in a job list
+// that was read from Cache, it may have been added since, so the job list is fetched again.
+func (r *LastSuccessfulMetaRequest) lookUpJobID(ctx context.Context, pipelineID int64, jobName string) (int64, error) {
+	jobsJSON, fetched, err := r.pipelineJobs(ctx, pipelineID, false)
+	if err != nil {
+		return 0, err
+	}
+	jobID, err := r.JobIDFromJSONByName(string(jobsJSON), jobName)
+	if !errors.Is(err, ErrJobNotFound) || fetched {
+		return jobID, err
+	}
+	logrus.Debugf("jobName %s not found in the cached jobs of pipeline %d; fetching them", jobName, pipelineID)
+	if jobsJSON, _, err = r.pipelineJobs(ctx, pipelineID, true); err != nil {
+		return 0, err
+	}
+	return r.JobIDFromJSONByName(string(jobsJSON), jobName)
+}
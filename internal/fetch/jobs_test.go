@@ -0,0 +1,146 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type JobsSuite struct {
+	suite.Suite
+	MockHandler MockHandler
+	TestServer  *httptest.Server
+	Request     LastSuccessfulMetaRequest
+}
+
+func TestJobsSuite(t *testing.T) {
+	suite.Run(t, new(JobsSuite))
+}
+
+func (s *JobsSuite) SetupTest() {
+	s.MockHandler = MockHandler{}
+	s.TestServer = httptest.NewServer(&s.MockHandler)
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:            s.TestServer.URL + "/v4/",
+		Transport:           s.TestServer.Client().Transport,
+		DefaultSdPipelineID: 123,
+	}
+}
+
+func (s *JobsSuite) TearDownTest() {
+	s.TestServer.Close()
+}
+
+// respondJobs expects a request for the page of the jobs of pipeline 123 and responds with the jobs.
+func (s *JobsSuite) respondJobs(page int, jobs ...string) *mock.Call {
+	query := fmt.Sprintf("page=%d&count=50", page)
+	return s.MockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/pipelines/123/jobs" && req.URL.RawQuery == query
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), "["+strings.Join(jobs, ",")+"]")
+		})
+}
+
+// jobs returns count jobs named job<id> starting at id.
+func jobs(id int, count int) []string {
+	var ret []string
+	for i := id; i < id+count; i++ {
+		ret = append(ret, fmt.Sprintf(`{"id":%d,"name":"job%d","permutations":[{"commands":[]}]}`, i, i))
+	}
+	return ret
+}
+
+// fetchJobID fetches the id of the job of the external job description.
+func (s *JobsSuite) fetchJobID(external string) (int64, error) {
+	jobDescription, err := ParseJobDescription(0, external)
+	s.Require().NoError(err)
+	return s.Request.FetchJobID(jobDescription)
+}
+
+func (s *JobsSuite) TestFetchJobs_pages() {
+	s.respondJobs(1, jobs(1, 50)...)
+	s.respondJobs(2, `{"id":51,"name":"main"}`, `{"id":52,"name":"PR-12:main"}`)
+
+	got, err := s.Request.FetchJobs(123)
+	s.Require().NoError(err)
+	s.Assert().True(strings.HasPrefix(string(got), `[{"id":1,"name":"job1"},{"id":2,"name":"job2"},`), string(got))
+	s.Assert().True(strings.HasSuffix(string(got), `{"id":51,"name":"main"},{"id":52,"name":"PR-12:main"}]`),
+		string(got))
+	s.MockHandler.AssertExpectations(s.T())
+}
+
+func (s *JobsSuite) TestFetchJobs_notPaged() {
+	// When the API ignores the page, it returns all of the jobs for every page
+	s.respondJobs(1, jobs(1, 50)...)
+	s.respondJobs(2, jobs(1, 50)...)
+
+	got, err := s.Request.FetchJobs(123)
+	s.Require().NoError(err)
+	s.Assert().Equal(50, strings.Count(string(got), `"id"`))
+	s.MockHandler.AssertExpectations(s.T())
+
+	s.respondJobs(1, jobs(1, 60)...)
+	got, err = s.Request.FetchJobs(123)
+	s.Require().NoError(err)
+	s.Assert().Equal(60, strings.Count(string(got), `"id"`))
+	s.MockHandler.AssertExpectations(s.T())
+}
+
+func (s *JobsSuite) TestFetchJobID() {
+	s.respondJobs(1, `{"id":1,"name":"main"}`, `{"id":2,"name":"PR-12:main"}`, `{"id":3,"name":"publish"}`)
+
+	// The job list is only fetched once
+	for external, expected := range map[string]int64{
+		"main": 1, "sd@123:PR-12:main": 2, "PR-12:main#build=5": 2, "publish": 3,
+	} {
+		got, err := s.fetchJobID(external)
+		s.Require().NoError(err, external)
+		s.Assert().Equal(expected, got, external)
+	}
+
+	// Nor is it fetched again for a job that doesn't exist
+	_, err := s.fetchJobID("PR-13:main")
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+	s.MockHandler.AssertExpectations(s.T())
+}
+
+func (s *JobsSuite) TestFetchJobID_cached() {
+	dir, err := ioutil.TempDir("", "cache")
+	s.Require().NoError(err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	s.Request.Cache = &Cache{Dir: dir, TTL: time.Hour}
+	namespace, ok := s.Request.cacheNamespace(context.Background())
+	s.Require().True(ok)
+	s.Require().NoError(s.Request.Cache.PutJobs(namespace, 123, []byte(`[{"id":1,"name":"main"}]`)))
+
+	got, err := s.fetchJobID("main")
+	s.Require().NoError(err)
+	s.Assert().Equal(int64(1), got)
+
+	// A job that was added since the job list was cached is found by fetching it again, which updates the cache
+	s.respondJobs(1, `{"id":1,"name":"main"}`, `{"id":2,"name":"added"}`)
+	got, err = s.fetchJobID("added")
+	s.Require().NoError(err)
+	s.Assert().Equal(int64(2), got)
+	data, ok := s.Request.Cache.GetJobs(namespace, 123)
+	s.Require().True(ok)
+	s.Assert().Equal(`[{"id":1,"name":"main"},{"id":2,"name":"added"}]`, string(data))
+
+	_, err = s.fetchJobID("missing")
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+	s.MockHandler.AssertExpectations(s.T())
+}
@@ -1,9 +1,10 @@
 package fetch
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
@@ -13,14 +14,43 @@ import (
 type LastSuccessfulMetaRequest struct {
 	// SdToken is the screwdriver OAuth2 token
 	SdToken string
+	// SdTokenFile is the path to a file with the token, which is read for every call so that it may be rotated
+	SdTokenFile string
+	// SdAPIKey is a user API key to exchange for a token, which is refreshed before it expires or when it is rejected
+	SdAPIKey string
+	// Authenticator provides the tokens for API calls; when nil, it is made from the fields above (see
+	// GetAuthenticator)
+	Authenticator Authenticator
 	// SdAPIURL is the base url to the screwdriver rest API.
 	SdAPIURL string
 
 	// DefaultSdPipelineID is the default pipeline id to handle external names with just the jobName (no sd@pipelineId)
 	DefaultSdPipelineID int64
+	// DefaultPullRequest is the number of the PR of the current build (SD_PULL_REQUEST), e.g. 45, or empty when it is
+	// not a PR build. Job names without a pipeline are then those of the PR jobs (see ParseJobDescription).
+	DefaultPullRequest string
 
 	// Is the transport to use in calling the screwdriver REST apis (when nil, uses http.DefaultTransport)
 	Transport http.RoundTripper
+
+	// Retries is the number of times to retry an API call after a network error or 5xx response
+	Retries int
+	// RequestTimeout limits each API call (including each retry) when not zero
+	RequestTimeout time.Duration
+	// Timeout limits a whole fetch, including all of its API calls, retries and backoff, when not zero
+	Timeout time.Duration
+	// MinBackoff is the backoff before the first retry, which doubles for each retry after that (0 for the default)
+	MinBackoff time.Duration
+	// MaxBackoff is the longest backoff between retries (0 for the default)
+	MaxBackoff time.Duration
+	// Parallelism is the number of metas that FetchMetas fetches at once (0 for the default)
+	Parallelism int
+
+	// Cache is consulted before fetching and stores what is fetched when it is enabled
+	Cache *Cache
+
+	// jobLists holds the job lists of the pipelines looked up so far, which are shared by copies of the request
+	jobLists *jobLists
 }
 
 // GetTransport returns a non-nil transport, assigning the default when nil
@@ -50,13 +80,22 @@ func (r *LastSuccessfulMetaRequest) JobForPipelineURL(piplineID int64, jobName s
 func (r *LastSuccessfulMetaRequest) JobIDFromJSONByName(json, jobName string) (int64, error) {
 	result := gjson.Get(json, fmt.Sprintf("#(name==%#v).id", jobName))
 	if !result.Exists() {
-		return 0, fmt.Errorf("jobName %v not found in json", jobName)
+		return 0, fmt.Errorf("%w: jobName %v not found in json", ErrJobNotFound, jobName)
 	}
 	return result.Int(), nil
 }
 
-// FetchJobID fetches the job information from the given jobDescription, parses and returns the job id
+// FetchJobID looks up the id of the job of the given jobDescription in the job list of its pipeline, which is fetched
+// once and cached
 func (r *LastSuccessfulMetaRequest) FetchJobID(jobDescription *JobDescription) (int64, error) {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	return r.FetchJobIDContext(ctx, jobDescription)
+}
+
+// FetchJobIDContext is like FetchJobID, but the API calls are bound by ctx rather than Timeout
+func (r *LastSuccessfulMetaRequest) FetchJobIDContext(ctx context.Context, jobDescription *JobDescription) (int64,
+	error) {
 	if jobDescription.PipelineID == 0 {
 		logrus.Debugf("Defaulting pipelineId to %d", r.DefaultSdPipelineID)
 		jobDescription.PipelineID = r.DefaultSdPipelineID
@@ -64,45 +103,30 @@ func (r *LastSuccessfulMetaRequest) FetchJobID(jobDescription *JobDescription) (
 	if jobDescription.PipelineID == 0 {
 		return 0, fmt.Errorf("jobDescription does not have pipelineID %#v", jobDescription)
 	}
-	jobForPipelineURL := r.JobForPipelineURL(jobDescription.PipelineID, jobDescription.JobName)
-	logrus.Tracef("jobForPipelineURL=%s", jobForPipelineURL)
-	request, err := http.NewRequest("GET", jobForPipelineURL, nil)
-	if err != nil {
-		return 0, err
-	}
-	request.Header.Add("Authorization", "Bearer "+r.SdToken)
-	response, err := r.GetTransport().RoundTrip(request)
-	if err != nil {
-		return 0, err
-	}
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return 0, err
-	}
-	return r.JobIDFromJSONByName(string(data), jobDescription.JobName)
+	return r.lookUpJobID(ctx, jobDescription.PipelineID, jobDescription.JobName)
 }
 
 // FetchLastSuccessfulMeta fetches the last successful meta from the given jobDescription and returns raw data
 func (r *LastSuccessfulMetaRequest) FetchLastSuccessfulMeta(jobDescription *JobDescription) ([]byte, error) {
-	jobID, err := r.FetchJobID(jobDescription)
-	if err != nil {
-		return nil, err
-	}
-	logrus.Tracef("jobID=%d", jobID)
-	lastSuccessfulMetaURL := r.LastSuccessfulMetaURL(jobID)
-	logrus.Tracef("lastSuccessfulMetaURL=%s", lastSuccessfulMetaURL)
-	request, err := http.NewRequest("GET", lastSuccessfulMetaURL, nil)
-	if err != nil {
-		return nil, err
-	}
-	request.Header.Add("Authorization", "Bearer "+r.SdToken)
-	response, err := r.GetTransport().RoundTrip(request)
-	if err != nil {
-		return nil, err
-	}
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	return r.FetchLastSuccessfulMetaContext(ctx, jobDescription)
+}
+
+// FetchLastSuccessfulMetaContext is like FetchLastSuccessfulMeta, but the API calls are bound by ctx rather than
+// Timeout
+func (r *LastSuccessfulMetaRequest) FetchLastSuccessfulMetaContext(ctx context.Context,
+	jobDescription *JobDescription) ([]byte, error) {
+	// Any build selector is ignored, so the last successful meta is cached for the job itself
+	cacheDescription := &JobDescription{PipelineID: jobDescription.PipelineID, JobName: jobDescription.JobName}
+	return r.cached(ctx, cacheDescription, func() ([]byte, error) {
+		jobID, err := r.FetchJobIDContext(ctx, jobDescription)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Tracef("jobID=%d", jobID)
+		lastSuccessfulMetaURL := r.LastSuccessfulMetaURL(jobID)
+		logrus.Tracef("lastSuccessfulMetaURL=%s", lastSuccessfulMetaURL)
+		return r.get(ctx, lastSuccessfulMetaURL, ErrNoSuccessfulBuild)
+	})
 }
@@ -1,10 +1,10 @@
 package fetch
 
 import (
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -42,6 +42,18 @@ func (s *LastSuccessfulMetaSuite) SetupSuite() {
 	s.LastSuccessfulMetaJSON = string(data)
 }
 
+// newMockServer starts a mock server of pipeline 1016708 with the jobs and last successful meta of job1 in mockHttp,
+// which counts the requests it serves.
+func (s *LastSuccessfulMetaSuite) newMockServer() (*httptest.Server, *countingMockServer) {
+	dir, err := ioutil.TempDir("", "lastSuccessfulMeta")
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { _ = os.RemoveAll(dir) })
+	writeMockFile(s.T(), dir, "v4/pipelines/1016708/jobs.json", s.JobsJSON)
+	writeMockFile(s.T(), dir, "v4/jobs/392525/lastSuccessfulMeta.json", s.LastSuccessfulMetaJSON)
+	mockServer := &countingMockServer{MockServer: MockServer{Dir: dir, Token: "test-token"}}
+	return httptest.NewServer(mockServer), mockServer
+}
+
 func TestLastSuccessfulMetaSuite(t *testing.T) {
 	suite.Run(t, new(LastSuccessfulMetaSuite))
 }
@@ -144,19 +156,10 @@ func (s *LastSuccessfulMetaSuite) TestLastSuccessfulMetaRequest_GetOrFetchJobId(
 
 	for _, tt := range tests {
 		s.Run(tt.name, func() {
-			var mockHandler MockHandler
-			mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
-				return req.URL.Path == "/v4/pipelines/1016708/jobs" &&
-					req.Header.Get("Authorization") == "Bearer test-token"
-			})).
-				Once().
-				Run(func(args mock.Arguments) {
-					_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), s.JobsJSON)
-				})
-			testServer := httptest.NewServer(&mockHandler)
+			testServer, mockServer := s.newMockServer()
 			defer testServer.Close()
 
-			tt.request.SdAPIURL = testServer.URL + "/v4/"
+			tt.request.SdAPIURL = testServer.URL + MockServerPrefix
 			tt.request.SdToken = "test-token"
 			tt.request.Transport = testServer.Client().Transport
 			got, err := tt.request.FetchJobID(&tt.jobDescription)
@@ -166,7 +169,7 @@ func (s *LastSuccessfulMetaSuite) TestLastSuccessfulMetaRequest_GetOrFetchJobId(
 			}
 			s.Require().NoError(err)
 			s.Assert().Equal(tt.expected, got)
-			mockHandler.AssertExpectations(s.T())
+			s.Assert().Equal(map[string]int{"/v4/pipelines/1016708/jobs?page=1&count=50": 1}, mockServer.requests())
 		})
 	}
 }
@@ -191,27 +194,10 @@ func (s *LastSuccessfulMetaSuite) TestLastSuccessfulMetaRequest_GetLastSuccessfu
 
 	for _, tt := range tests {
 		s.Run(tt.name, func() {
-			var mockHandler MockHandler
-			mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
-				return req.URL.Path == "/v4/pipelines/1016708/jobs" &&
-					req.Header.Get("Authorization") == "Bearer test-token"
-			})).
-				Once().
-				Run(func(args mock.Arguments) {
-					_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), s.JobsJSON)
-				})
-			mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
-				return req.URL.Path == "/v4/jobs/392525/lastSuccessfulMeta" &&
-					req.Header.Get("Authorization") == "Bearer test-token"
-			})).
-				Once().
-				Run(func(args mock.Arguments) {
-					_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), s.LastSuccessfulMetaJSON)
-				})
-			testServer := httptest.NewServer(&mockHandler)
+			testServer, mockServer := s.newMockServer()
 			defer testServer.Close()
 
-			tt.request.SdAPIURL = testServer.URL + "/v4/"
+			tt.request.SdAPIURL = testServer.URL + MockServerPrefix
 			tt.request.SdToken = "test-token"
 			tt.request.Transport = testServer.Client().Transport
 			got, err := tt.request.FetchLastSuccessfulMeta(&tt.jobDescription)
@@ -221,7 +207,10 @@ func (s *LastSuccessfulMetaSuite) TestLastSuccessfulMetaRequest_GetLastSuccessfu
 			}
 			s.Require().NoError(err)
 			s.Assert().Equal(tt.expected, string(got))
-			mockHandler.AssertExpectations(s.T())
+			s.Assert().Equal(map[string]int{
+				"/v4/pipelines/1016708/jobs?page=1&count=50": 1,
+				"/v4/jobs/392525/lastSuccessfulMeta":         1,
+			}, mockServer.requests())
 		})
 	}
 }
@@ -0,0 +1,121 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MockServerPrefix is the path of the SD API of a MockServer, so that SD_API_URL is e.g. http://localhost:8080/v4/
+const MockServerPrefix = "/v4/"
+
+// MockServer is an http.Handler that mocks the SD API with JSON files in Dir, so that pipeline scripts can be run
+// end-to-end locally by pointing SD_API_URL at it. Dir has the layout of the fixtures of a FixtureTransport, so that
+// fixtures recorded with a RecordingTransport may be served too: a GET of a path is answered with <Dir>/<path>.json,
+// e.g. <Dir>/v4/pipelines/123/jobs.json for the jobs of pipeline 123 and <Dir>/v4/jobs/456/lastSuccessfulMeta.json
+// for the last successful meta of job 456; builds/<id>.json, events/<id>/builds.json and jobs/<id>/builds.json are
+// served the same way. Arrays are paged with the page and count query parameters, and jobs are filtered by jobName,
+// unless a file was recorded for the query.
+type MockServer struct {
+	// Dir is the directory of JSON files
+	Dir string
+	// Token is the token that requests must have (any token is accepted when empty)
+	Token string
+}
+
+// ServeHTTP responds with the JSON file of the request, or with an SD error payload
+func (s *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("%s %s", r.Method, r.URL)
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeMockError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeMockError(w, http.StatusMethodNotAllowed, "the mock server only serves GET")
+		return
+	}
+	// Clean the path so that requests cannot read files outside of Dir
+	u := *r.URL
+	u.Path = path.Clean("/" + u.Path)
+	if u.Path == "/" {
+		writeMockError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	status, data, err := readFixture(s.Dir, &http.Request{Method: r.Method, URL: &u})
+	if err != nil {
+		writeMockError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// mockQuery filters an array by the jobName query parameter and returns the page of it for the page and count query
+// parameters; other data is returned as is.
+func mockQuery(data []byte, r *http.Request) ([]byte, error) {
+	query := r.URL.Query()
+	jobName := query.Get("jobName")
+	if query.Get("page") == "" && query.Get("count") == "" && jobName == "" {
+		return data, nil
+	}
+	var items []json.RawMessage
+	if json.Unmarshal(data, &items) != nil {
+		return data, nil
+	}
+	if jobName != "" {
+		var filtered []json.RawMessage
+		for _, item := range items {
+			var job pipelineJob
+			if json.Unmarshal(item, &job) == nil && job.Name == jobName {
+				filtered = append(filtered, item)
+			}
+		}
+		items = filtered
+	}
+	if count, err := strconv.Atoi(query.Get("count")); err == nil && count > 0 {
+		page := 1
+		if query.Get("page") != "" {
+			if page, err = strconv.Atoi(query.Get("page")); err != nil || page < 1 {
+				return nil, fmt.Errorf("invalid page %q", query.Get("page"))
+			}
+		}
+		if page-1 > math.MaxInt/count {
+			return nil, fmt.Errorf("page %q of count %q is out of range", query.Get("page"), query.Get("count"))
+		}
+		start := clampIndex((page-1)*count, len(items))
+		// start+count may overflow, but then count is more than the items left
+		end := len(items)
+		if count < len(items)-start {
+			end = start + count
+		}
+		items = items[start:end]
+	}
+	if items == nil {
+		items = []json.RawMessage{}
+	}
+	return json.Marshal(items)
+}
+
+// clampIndex clamps index to [0, length].
+func clampIndex(index int, length int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > length {
+		return length
+	}
+	return index
+}
+
+// writeMockError writes a Screwdriver error payload with the status and message.
+func writeMockError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(fixtureErrorBody(status, message))
+}
@@ -0,0 +1,198 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MockServerSuite struct {
+	suite.Suite
+	MockServer MockServer
+	TestServer *httptest.Server
+	Request    LastSuccessfulMetaRequest
+}
+
+func TestMockServerSuite(t *testing.T) {
+	suite.Run(t, new(MockServerSuite))
+}
+
+func (s *MockServerSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "mockserver")
+	s.Require().NoError(err)
+	s.MockServer = MockServer{Dir: dir}
+	s.TestServer = httptest.NewServer(&s.MockServer)
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:            s.TestServer.URL + MockServerPrefix,
+		Transport:           s.TestServer.Client().Transport,
+		DefaultSdPipelineID: 123,
+	}
+	s.writeFile("v4/pipelines/123/jobs.json", `[{"id":1,"name":"main"},{"id":2,"name":"PR-12:main"}]`)
+	s.writeFile("v4/jobs/1/lastSuccessfulMeta.json", `{"foo":"bar"}`)
+	s.writeFile("v4/builds/456.json", `{"id":456,"jobId":1,"status":"FAILURE","meta":{"b":1,"a":2}}`)
+}
+
+func (s *MockServerSuite) TearDownTest() {
+	s.TestServer.Close()
+	_ = os.RemoveAll(s.MockServer.Dir)
+}
+
+// writeMockFile writes the JSON file at name, e.g. v4/builds/456.json, in the directory of a mock server.
+func writeMockFile(t *testing.T, dir string, name string, data string) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0777))
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0666))
+}
+
+// countingMockServer is a MockServer that counts the requests it serves by request URI (path and query).
+type countingMockServer struct {
+	MockServer
+	counts map[string]int
+	mutex  sync.Mutex
+}
+
+func (m *countingMockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	if m.counts == nil {
+		m.counts = map[string]int{}
+	}
+	m.counts[r.URL.RequestURI()]++
+	m.mutex.Unlock()
+	m.MockServer.ServeHTTP(w, r)
+}
+
+// requests returns the number of requests served by request URI.
+func (m *countingMockServer) requests() map[string]int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ret := map[string]int{}
+	for requestURI, count := range m.counts {
+		ret[requestURI] = count
+	}
+	return ret
+}
+
+// writeFile writes the JSON file at name in the directory of the mock server.
+func (s *MockServerSuite) writeFile(name string, data string) {
+	writeMockFile(s.T(), s.MockServer.Dir, name, data)
+}
+
+// get returns the status and body of a GET of path of the mock server.
+func (s *MockServerSuite) get(path string) (int, string) {
+	response, err := http.Get(s.TestServer.URL + path)
+	s.Require().NoError(err)
+	defer func() { _ = response.Body.Close() }()
+	data, err := ioutil.ReadAll(response.Body)
+	s.Require().NoError(err)
+	return response.StatusCode, string(data)
+}
+
+func (s *MockServerSuite) TestFetchMeta() {
+	got, err := s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+
+	jobDescription, err := ParseJobDescription(0, "sd@123:main#build=456")
+	s.Require().NoError(err)
+	got, err = s.Request.FetchMeta(jobDescription)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"b":1,"a":2}`, string(got))
+
+	_, err = s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "PR-12:main"})
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+
+	_, err = s.Request.FetchLastSuccessfulMeta(&JobDescription{PipelineID: 789, JobName: "main"})
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+}
+
+func (s *MockServerSuite) TestPages() {
+	var jobs []string
+	for i := 1; i <= 60; i++ {
+		jobs = append(jobs, fmt.Sprintf(`{"id":%d,"name":"job%d"}`, i, i))
+	}
+	s.writeFile("v4/pipelines/123/jobs.json", "["+strings.Join(jobs, ",")+"]")
+
+	id, err := s.Request.FetchJobID(&JobDescription{JobName: "job60"})
+	s.Require().NoError(err)
+	s.Assert().Equal(int64(60), id)
+
+	status, body := s.get("/v4/pipelines/123/jobs?page=2&count=50")
+	s.Assert().Equal(http.StatusOK, status)
+	s.Assert().Equal("["+strings.Join(jobs[50:], ",")+"]", body)
+	_, body = s.get("/v4/pipelines/123/jobs?page=3&count=50")
+	s.Assert().Equal("[]", body)
+	_, body = s.get("/v4/pipelines/123/jobs?jobName=job2")
+	s.Assert().Equal(`[{"id":2,"name":"job2"}]`, body)
+	status, _ = s.get("/v4/pipelines/123/jobs?page=0&count=50")
+	s.Assert().Equal(http.StatusBadRequest, status)
+
+	// Pages and counts that overflow are rejected or clamped rather than panicking
+	status, _ = s.get("/v4/pipelines/123/jobs?page=9223372036854775807&count=50")
+	s.Assert().Equal(http.StatusBadRequest, status)
+	status, body = s.get("/v4/pipelines/123/jobs?page=2&count=9223372036854775807")
+	s.Assert().Equal(http.StatusOK, status)
+	s.Assert().Equal("[]", body)
+	status, body = s.get("/v4/pipelines/123/jobs?page=1&count=9223372036854775807")
+	s.Assert().Equal(http.StatusOK, status)
+	s.Assert().Equal("["+strings.Join(jobs, ",")+"]", body)
+}
+
+func (s *MockServerSuite) TestRecordedFixtures() {
+	// Fixtures recorded with a RecordingTransport are served, including the pages recorded for their query
+	recording := &RecordingTransport{Dir: s.MockServer.Dir, Transport: s.TestServer.Client().Transport}
+	s.Request.Transport = recording
+	_, err := s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Require().NoError(err)
+	s.Require().FileExists(filepath.Join(s.MockServer.Dir, "v4", "pipelines", "123", "jobs%3Fpage=1&count=50.json"))
+
+	s.writeFile("v4/pipelines/123/jobs.json", `[]`)
+	_, body := s.get("/v4/pipelines/123/jobs?page=1&count=50")
+	s.Assert().Equal(`[{"id":1,"name":"main"},{"id":2,"name":"PR-12:main"}]`, body)
+	_, body = s.get("/v4/pipelines/123/jobs")
+	s.Assert().Equal(`[]`, body)
+
+	// And the same directory is replayed by a FixtureTransport
+	transport, err := NewFixtureTransport(s.MockServer.Dir)
+	s.Require().NoError(err)
+	s.Request.Transport = transport
+	got, err := s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+}
+
+func (s *MockServerSuite) TestErrors() {
+	status, body := s.get("/v4/builds/457")
+	s.Assert().Equal(http.StatusNotFound, status)
+	s.Assert().Contains(body, `"message":"no fixture `)
+	status, _ = s.get("/v4/")
+	s.Assert().Equal(http.StatusNotFound, status)
+	status, _ = s.get("/jobs/1/lastSuccessfulMeta")
+	s.Assert().Equal(http.StatusNotFound, status)
+	// Only files in Dir are served
+	status, body = s.get("/v4/../../../etc/hosts")
+	s.Assert().Equal(http.StatusNotFound, status)
+	s.Assert().Contains(body, "no fixture "+filepath.Join(s.MockServer.Dir, "etc", "hosts.json"))
+
+	s.MockServer.Token = "token"
+	_, err := s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Assert().True(errors.Is(err, ErrUnauthorized), "%v", err)
+	s.Request.SdToken = "token"
+	_, err = s.Request.FetchLastSuccessfulMeta(&JobDescription{JobName: "main"})
+	s.Assert().NoError(err)
+
+	err = s.Request.PutBuildMeta(456, []byte(`{}`))
+	var apiError *APIError
+	s.Require().True(errors.As(err, &apiError), "%v", err)
+	s.Assert().Equal(http.StatusMethodNotAllowed, apiError.StatusCode)
+}
@@ -0,0 +1,75 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DefaultParallelism is the number of metas fetched at once by FetchMetas when Parallelism is not set
+const DefaultParallelism = 4
+
+// GetParallelism returns the number of metas to fetch at once.
+func (r *LastSuccessfulMetaRequest) GetParallelism() int {
+	if r.Parallelism <= 0 {
+		return DefaultParallelism
+	}
+	return r.Parallelism
+}
+
+// FetchMetas fetches the meta of each of the job descriptions (see FetchMeta) concurrently, with at most Parallelism
+// fetches at once and all of them bound by Timeout. It returns the metas in the order of the job descriptions.
+func (r *LastSuccessfulMetaRequest) FetchMetas(jobDescriptions []*JobDescription) ([][]byte, error) {
+	ctx, cancel := r.withTimeout(context.Background())
+	defer cancel()
+	return r.FetchMetasContext(ctx, jobDescriptions)
+}
+
+// FetchMetasContext is like FetchMetas, but the API calls are bound by ctx rather than Timeout. The first error cancels
+// the fetches that are still running and is returned.
+func (r *LastSuccessfulMetaRequest) FetchMetasContext(ctx context.Context, jobDescriptions []*JobDescription) ([][]byte,
+	error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Assign the default transport, the authenticator and the job lists before they are shared
+	r.GetTransport()
+	r.GetAuthenticator()
+	r.getJobLists()
+
+	ret := make([][]byte, len(jobDescriptions))
+	var firstErr error
+	var errOnce sync.Once
+	semaphore := make(chan struct{}, r.GetParallelism())
+	var wg sync.WaitGroup
+	for i, jobDescription := range jobDescriptions {
+		wg.Add(1)
+		go func(i int, jobDescription *JobDescription) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				return
+			}
+			data, err := r.FetchMetaContext(ctx, jobDescription)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("cannot fetch %s: %w", jobDescription.External(), err)
+					cancel()
+				})
+				return
+			}
+			ret[i] = data
+		}(i, jobDescription)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	// The context may be done before any fetch fails
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,114 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ParallelSuite struct {
+	suite.Suite
+	TestServer  *httptest.Server
+	Request     LastSuccessfulMetaRequest
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func TestParallelSuite(t *testing.T) {
+	suite.Run(t, new(ParallelSuite))
+}
+
+func (s *ParallelSuite) SetupTest() {
+	s.inFlight = 0
+	s.maxInFlight = 0
+	s.TestServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:    s.TestServer.URL + "/v4/",
+		Transport:   s.TestServer.Client().Transport,
+		Parallelism: 2,
+	}
+}
+
+func (s *ParallelSuite) TearDownTest() {
+	s.TestServer.Close()
+}
+
+// serveHTTP serves job 1 to 3 of pipeline 123 (job3 is in pipeline 456 too), whose meta is {"job":<id>}, and counts
+// the requests in flight.
+func (s *ParallelSuite) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.inFlight--
+		s.mutex.Unlock()
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	switch {
+	case r.URL.Path == "/v4/pipelines/123/jobs":
+		_, _ = io.WriteString(w, `[{"id":1,"name":"job1"},{"id":2,"name":"job2"},{"id":3,"name":"job3"}]`)
+	case r.URL.Path == "/v4/pipelines/456/jobs":
+		_, _ = io.WriteString(w, `[{"id":3,"name":"job3"}]`)
+	case strings.HasSuffix(r.URL.Path, "/lastSuccessfulMeta"):
+		_, _ = fmt.Fprintf(w, `{"job":%s}`, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v4/jobs/"),
+			"/lastSuccessfulMeta"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.WriteString(w, `{"statusCode":404,"error":"Not Found"}`)
+	}
+}
+
+// jobDescriptions parses the externals.
+func (s *ParallelSuite) jobDescriptions(externals ...string) []*JobDescription {
+	var ret []*JobDescription
+	for _, external := range externals {
+		jobDescription, err := ParseJobDescription(123, external)
+		s.Require().NoError(err)
+		ret = append(ret, jobDescription)
+	}
+	return ret
+}
+
+func (s *ParallelSuite) TestFetchMetas() {
+	got, err := s.Request.FetchMetas(s.jobDescriptions("job3", "sd@123:job1", "job2"))
+	s.Require().NoError(err)
+	s.Require().Len(got, 3)
+	s.Assert().Equal(`{"job":3}`, string(got[0]))
+	s.Assert().Equal(`{"job":1}`, string(got[1]))
+	s.Assert().Equal(`{"job":2}`, string(got[2]))
+	s.Assert().Equal(2, s.maxInFlight)
+}
+
+func (s *ParallelSuite) TestFetchMetas_empty() {
+	got, err := s.Request.FetchMetas(nil)
+	s.Require().NoError(err)
+	s.Assert().Empty(got)
+}
+
+func (s *ParallelSuite) TestFetchMetas_error() {
+	_, err := s.Request.FetchMetas(s.jobDescriptions("job1", "sd@456:missing", "job2"))
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrJobNotFound), "%v", err)
+	s.Assert().Contains(err.Error(), "cannot fetch sd@456:missing")
+}
+
+func (s *ParallelSuite) TestFetchMetas_timeout() {
+	s.Request.Timeout = time.Millisecond
+	_, err := s.Request.FetchMetas(s.jobDescriptions("job1", "job2", "job3"))
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrUnavailable), "%v", err)
+}
@@ -0,0 +1,145 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMinBackoff is the backoff before the first retry when MinBackoff is not set
+	DefaultMinBackoff = 500 * time.Millisecond
+	// DefaultMaxBackoff is the longest backoff between retries when MaxBackoff is not set
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// GetMinBackoff returns the backoff before the first retry, which doubles for each retry after that.
+func (r *LastSuccessfulMetaRequest) GetMinBackoff() time.Duration {
+	if r.MinBackoff <= 0 {
+		return DefaultMinBackoff
+	}
+	return r.MinBackoff
+}
+
+// GetMaxBackoff returns the longest backoff between retries.
+func (r *LastSuccessfulMetaRequest) GetMaxBackoff() time.Duration {
+	if r.MaxBackoff <= 0 {
+		return DefaultMaxBackoff
+	}
+	return r.MaxBackoff
+}
+
+// withTimeout returns a context, which is done after the overall Timeout when set, and its cancel function.
+func (r *LastSuccessfulMetaRequest) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.Timeout)
+}
+
+// backoff returns the time to wait before the given retry (starting at 1); it grows exponentially from MinBackoff up to
+// MaxBackoff, with jitter so that builds retrying at once don't hit the API in lockstep.
+func (r *LastSuccessfulMetaRequest) backoff(retry int) time.Duration {
+	backoff := r.GetMinBackoff()
+	maxBackoff := r.GetMaxBackoff()
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	// Wait at least half the backoff
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// get performs an authorized GET of url (see do).
+func (r *LastSuccessfulMetaRequest) get(ctx context.Context, url string, notFound error) ([]byte, error) {
+	return r.do(ctx, http.MethodGet, url, nil, notFound)
+}
+
+// do performs an authorized request of url with the json body (when not nil), retrying network errors and 5xx
+// responses up to Retries times with backoff. A call that is rejected as unauthorized is retried once more, when the
+// Authenticator has a new token. Each attempt is limited to RequestTimeout when set, and ctx bounds all of them. Error
+// responses are returned as an *APIError, in which a 404 is notFound.
+func (r *LastSuccessfulMetaRequest) do(ctx context.Context, method string, url string, body []byte,
+	notFound error) ([]byte, error) {
+	authenticator := r.GetAuthenticator()
+	refreshed := false
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			backoff := r.backoff(retry)
+			logrus.Debugf("Retrying %s %s in %v (retry %d of %d)", method, url, backoff, retry, r.Retries)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("%w: %s %s: %w", ErrUnavailable, method, url, ctx.Err())
+			case <-timer.C:
+			}
+		}
+		var data []byte
+		var retryable bool
+		token, err := authenticator.Token(ctx)
+		if err != nil {
+			// The token may need to be fetched too
+			retryable = errors.Is(err, ErrUnavailable)
+		} else if data, retryable, err = r.doOnce(ctx, method, url, body, token, notFound); err == nil {
+			return data, nil
+		} else if errors.Is(err, ErrUnauthorized) && !refreshed && authenticator.Refresh(ctx, token) {
+			logrus.Debugf("%s %s was unauthorized; retrying with a new token", method, url)
+			refreshed = true
+			retry--
+			continue
+		}
+		if !retryable || ctx.Err() != nil || retry >= r.Retries {
+			return nil, err
+		}
+		logrus.Warnf("%s %s failed: %v", method, url, err)
+	}
+}
+
+// doOnce performs a single request of url authorized with token, limited to RequestTimeout when set. Network errors
+// and 5xx responses are reported as retryable.
+func (r *LastSuccessfulMetaRequest) doOnce(ctx context.Context, method string, url string, body []byte, token string,
+	notFound error) ([]byte, bool, error) {
+	if r.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.RequestTimeout)
+		defer cancel()
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, false, err
+	}
+	request.Header.Add("Authorization", "Bearer "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := r.GetTransport().RoundTrip(request)
+	if err != nil {
+		return nil, true, fmt.Errorf("%w: %s %s: %w", ErrUnavailable, method, url, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	// Read the body before the request context is cancelled
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("%w: %s %s: %w", ErrUnavailable, method, url, err)
+	}
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		return nil, response.StatusCode >= http.StatusInternalServerError,
+			newAPIError(method, url, response, data, notFound)
+	}
+	return data, false, nil
+}
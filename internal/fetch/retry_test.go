@@ -0,0 +1,181 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetrySuite struct {
+	suite.Suite
+	MockHandler MockHandler
+	TestServer  *httptest.Server
+	Request     LastSuccessfulMetaRequest
+
+	// hangs is the number of requests for each path that hang, before the MockHandler
+	hangs     map[string]int
+	hangsLock sync.Mutex
+}
+
+func TestRetrySuite(t *testing.T) {
+	suite.Run(t, new(RetrySuite))
+}
+
+func (s *RetrySuite) SetupTest() {
+	s.MockHandler = MockHandler{}
+	s.hangs = map[string]int{}
+	s.TestServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Request = LastSuccessfulMetaRequest{
+		SdAPIURL:   s.TestServer.URL + "/v4/",
+		SdToken:    "test-token",
+		Transport:  s.TestServer.Client().Transport,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+	}
+}
+
+func (s *RetrySuite) TearDownTest() {
+	s.TestServer.Close()
+}
+
+// respond expects a request for path and responds with the status and body.
+func (s *RetrySuite) respond(path string, status int, body string) *mock.Call {
+	return s.MockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == path && req.Header.Get("Authorization") == "Bearer test-token"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			w := args.Get(0).(http.ResponseWriter)
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, body)
+		})
+}
+
+// hang expects a request for path and does not respond until the request is cancelled. Hanging requests do not go
+// through the MockHandler, which would otherwise read them in AssertExpectations while they are still being served.
+func (s *RetrySuite) hang(path string) {
+	s.hangsLock.Lock()
+	defer s.hangsLock.Unlock()
+	s.hangs[path]++
+}
+
+// assertExpectations asserts that the expected requests, including those that hang, were all made.
+func (s *RetrySuite) assertExpectations() {
+	s.hangsLock.Lock()
+	for path, count := range s.hangs {
+		s.Assert().Zero(count, "requests for %s did not hang", path)
+	}
+	s.hangsLock.Unlock()
+	s.MockHandler.AssertExpectations(s.T())
+}
+
+// serveHTTP hangs the request when expected by hang, or else passes it to the MockHandler.
+func (s *RetrySuite) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.hangsLock.Lock()
+	hangs := s.hangs[r.URL.Path] > 0
+	if hangs {
+		s.hangs[r.URL.Path]--
+	}
+	s.hangsLock.Unlock()
+	if hangs {
+		<-r.Context().Done()
+		return
+	}
+	s.MockHandler.ServeHTTP(w, r)
+}
+
+func (s *RetrySuite) TestGet_retries5xx() {
+	s.Request.Retries = 2
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusBadGateway, "bad gateway")
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusServiceUnavailable, "unavailable")
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusOK, `{"foo":"bar"}`)
+
+	got, err := s.Request.get(context.Background(), s.Request.LastSuccessfulMetaURL(1), ErrNoSuccessfulBuild)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+	s.assertExpectations()
+}
+
+func (s *RetrySuite) TestGet_givesUpAfterRetries() {
+	s.Request.Retries = 1
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusBadGateway, "bad gateway")
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusBadGateway, "bad gateway")
+
+	_, err := s.Request.get(context.Background(), s.Request.LastSuccessfulMetaURL(1), ErrNoSuccessfulBuild)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrUnavailable), "%v", err)
+	s.Assert().Contains(err.Error(), "502 Bad Gateway")
+	s.assertExpectations()
+}
+
+func (s *RetrySuite) TestGet_doesNotRetry4xx() {
+	s.Request.Retries = 3
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusNotFound, `{"message":"not found"}`)
+
+	_, err := s.Request.get(context.Background(), s.Request.LastSuccessfulMetaURL(1), ErrNoSuccessfulBuild)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrNoSuccessfulBuild), "%v", err)
+	s.assertExpectations()
+}
+
+func (s *RetrySuite) TestGet_retriesRequestTimeout() {
+	s.Request.Retries = 1
+	s.Request.RequestTimeout = 50 * time.Millisecond
+	s.hang("/v4/jobs/1/lastSuccessfulMeta")
+	s.respond("/v4/jobs/1/lastSuccessfulMeta", http.StatusOK, `{"foo":"bar"}`)
+
+	got, err := s.Request.get(context.Background(), s.Request.LastSuccessfulMetaURL(1), ErrNoSuccessfulBuild)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(got))
+	s.assertExpectations()
+}
+
+func (s *RetrySuite) TestFetchLastSuccessfulMeta_timeout() {
+	s.Request.Retries = 100
+	s.Request.Timeout = 50 * time.Millisecond
+	s.hang("/v4/pipelines/1016708/jobs")
+
+	start := time.Now()
+	_, err := s.Request.FetchLastSuccessfulMeta(&JobDescription{PipelineID: 1016708, JobName: "job1"})
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, ErrUnavailable), "%v", err)
+	s.Assert().Less(int64(time.Since(start)), int64(5*time.Second))
+	s.assertExpectations()
+}
+
+func (s *RetrySuite) TestBackoff() {
+	s.Request.MinBackoff = 100 * time.Millisecond
+	s.Request.MaxBackoff = time.Second
+	tests := []struct {
+		retry int
+		min   time.Duration
+		max   time.Duration
+	}{
+		{retry: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{retry: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{retry: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{retry: 10, min: 500 * time.Millisecond, max: time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 10; i++ {
+			got := s.Request.backoff(tt.retry)
+			s.Assert().GreaterOrEqual(int64(got), int64(tt.min), "retry %d", tt.retry)
+			s.Assert().LessOrEqual(int64(got), int64(tt.max), "retry %d", tt.retry)
+		}
+	}
+}
+
+func (s *RetrySuite) TestBackoff_defaults() {
+	var request LastSuccessfulMetaRequest
+	s.Assert().Equal(DefaultMinBackoff, request.GetMinBackoff())
+	s.Assert().Equal(DefaultMaxBackoff, request.GetMaxBackoff())
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// KeyPathSegmentType is the type of one segment of a KeyPath.
+type KeyPathSegmentType int
+
+const (
+	// KeyPathName is an object key, e.g. foo, 'v1.2' or ["docker.io/foo"]
+	KeyPathName KeyPathSegmentType = iota
+	// KeyPathIndex is an array index, which counts from the end when negative, e.g. [1] or [-1]
+	KeyPathIndex
+	// KeyPathSlice is a slice of an array, e.g. [1:3], [:2] or [-2:]
+	KeyPathSlice
+	// KeyPathAppend is the empty brackets, e.g. []. It gets the first element and sets a single element array.
+	KeyPathAppend
+	// KeyPathWildcard matches the object keys that match a glob pattern of * and ?, e.g. * or deploy-*
+	KeyPathWildcard
+	// KeyPathAnyIndex matches every element of an array, e.g. [*]
+	KeyPathAnyIndex
+)
+
+// KeyPathSegment is one segment of a KeyPath.
+type KeyPathSegment struct {
+	Type KeyPathSegmentType
+	// Name is the object key of a KeyPathName segment or the glob pattern of a KeyPathWildcard segment
+	Name string
+	// Index is the array index of a KeyPathIndex segment
+	Index int
+	// Start and End are the bounds of a KeyPathSlice segment; nil means the start or end of the array respectively
+	Start *int
+	End   *int
+}
+
+// KeyPath is a meta key parsed into its segments, which is used to get, set and delete values in meta.
+type KeyPath struct {
+	// Key is the key as it was parsed
+	Key      string
+	Segments []KeyPathSegment
+}
+
+// KeyPathMatch is a value matched by a query along with the path to it.
+type KeyPathMatch struct {
+	Path  *KeyPath
+	Value interface{}
+}
+
+// KeyPathError is a syntax error in a meta key at the byte offset Pos.
+type KeyPathError struct {
+	Key string
+	Pos int
+	Msg string
+}
+
+// Error formats the error with the key and position of the problem.
+func (e *KeyPathError) Error() string {
+	return fmt.Sprintf("invalid meta key %s: %s at position %d", e.Key, e.Msg, e.Pos)
+}
+
+// keyPathScanner tokenizes a meta key into segments.
+type keyPathScanner struct {
+	key string
+	pos int
+}
+
+// ParseKeyPath parses the key into a KeyPath. Keys start with a name followed by any number of .name or [index]
+// segments. Names are either bare (word characters with inner dashes or colons) or quoted with single or double
+// quotes, in which case they may contain any character, with backslash escaping the quote or backslash. Bare names
+// containing * or ? and the [*] index are wildcards, which make the key path a query.
+// e.g. foo.bar[1], images["docker.io/foo"].tag, images.'v1.2'.sha or sd.*.*.build.sha
+func ParseKeyPath(key string) (*KeyPath, error) {
+	scanner := &keyPathScanner{key: key}
+	path := &KeyPath{Key: key}
+
+	// The key starts with a name, which may be bracketed if quoted.
+	if scanner.peek() == '[' {
+		start := scanner.pos
+		segment, err := scanner.scanBrackets()
+		if err != nil {
+			return nil, err
+		}
+		if segment.Type != KeyPathName {
+			scanner.pos = start
+			return nil, scanner.errorf("key must start with a name")
+		}
+		path.Segments = append(path.Segments, segment)
+	} else {
+		segment, err := scanner.scanName()
+		if err != nil {
+			return nil, err
+		}
+		path.Segments = append(path.Segments, segment)
+	}
+
+	for !scanner.done() {
+		if path.Segments[len(path.Segments)-1].Type == KeyPathSlice {
+			return nil, scanner.errorf("a slice must be the last part of the key")
+		}
+		switch scanner.peek() {
+		case '.':
+			scanner.pos++
+			segment, err := scanner.scanName()
+			if err != nil {
+				return nil, err
+			}
+			path.Segments = append(path.Segments, segment)
+		case '[':
+			segment, err := scanner.scanBrackets()
+			if err != nil {
+				return nil, err
+			}
+			path.Segments = append(path.Segments, segment)
+		default:
+			return nil, scanner.errorf("expected . or [")
+		}
+	}
+	return path, nil
+}
+
+// MustParseKeyPath is like ParseKeyPath but panics if the key cannot be parsed.
+func MustParseKeyPath(key string) *KeyPath {
+	path, err := ParseKeyPath(key)
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
+
+// String formats the path canonically, only quoting names that cannot be bare. e.g. images."v1.2".sha[-1]
+func (p *KeyPath) String() string {
+	var builder strings.Builder
+	for i, segment := range p.Segments {
+		switch segment.Type {
+		case KeyPathName:
+			if i > 0 {
+				builder.WriteByte('.')
+			}
+			if isBareName(segment.Name) {
+				builder.WriteString(segment.Name)
+			} else {
+				builder.WriteString(quoteKeyPathName(segment.Name))
+			}
+		case KeyPathWildcard:
+			if i > 0 {
+				builder.WriteByte('.')
+			}
+			builder.WriteString(segment.Name)
+		case KeyPathAnyIndex:
+			builder.WriteString("[*]")
+		case KeyPathIndex:
+			fmt.Fprintf(&builder, "[%d]", segment.Index)
+		case KeyPathAppend:
+			builder.WriteString("[]")
+		case KeyPathSlice:
+			builder.WriteByte('[')
+			if segment.Start != nil {
+				builder.WriteString(strconv.Itoa(*segment.Start))
+			}
+			builder.WriteByte(':')
+			if segment.End != nil {
+				builder.WriteString(strconv.Itoa(*segment.End))
+			}
+			builder.WriteByte(']')
+		}
+	}
+	return builder.String()
+}
+
+// Get gets the value at the path in meta. Keys that do not exist, indexes that are out of range and segments that do
+// not match the type of the value (e.g. a name on an array) all get nil. An empty path gets the whole meta. Queries
+// get nil; use Query to get their matches.
+func (p *KeyPath) Get(meta interface{}) interface{} {
+	value, _ := p.Lookup(meta)
+	return value
+}
+
+// Lookup is like Get, but also reports whether the value exists, so that a value that does not exist can be told
+// apart from an explicit null.
+func (p *KeyPath) Lookup(meta interface{}) (interface{}, bool) {
+	for _, segment := range p.Segments {
+		switch segment.Type {
+		case KeyPathName:
+			// Value is object
+			metaObject := convertInterfaceToObject(meta)
+			if metaObject == nil {
+				return nil, false
+			}
+			var ok bool
+			if meta, ok = metaObject.Get(segment.Name); !ok {
+				return nil, false
+			}
+		case KeyPathIndex, KeyPathAppend:
+			// Value is array with index; empty brackets get the first element. e.g. foo[] is foo[0]
+			metaSlice := convertInterfaceToSlice(meta)
+			metaIndex, inRange := resolveKeyPathIndex(segment.Index, len(metaSlice))
+			if !inRange {
+				return nil, false
+			}
+			meta = metaSlice[metaIndex]
+		case KeyPathSlice:
+			// Value is a slice of the array. e.g. foo[1:3]
+			metaSlice := convertInterfaceToSlice(meta)
+			if metaSlice == nil {
+				return nil, false
+			}
+			start, end := resolveKeyPathSlice(segment, len(metaSlice))
+			meta = metaSlice[start:end]
+		default:
+			return nil, false
+		}
+	}
+	return meta, true
+}
+
+// IsQuery determines whether the path contains wildcards, so may match any number of values.
+func (p *KeyPath) IsQuery() bool {
+	for _, segment := range p.Segments {
+		if segment.Type == KeyPathWildcard || segment.Type == KeyPathAnyIndex {
+			return true
+		}
+	}
+	return false
+}
+
+// Query gets every value in meta that the path matches along with the path to each of them, which has no wildcards.
+// Object keys are matched in sorted order and array elements in index order. Unlike Get, values that do not exist
+// are not matched rather than being nil.
+func (p *KeyPath) Query(meta interface{}) []KeyPathMatch {
+	var matches []KeyPathMatch
+	queryKeyPathSegments(p.Segments, meta, nil, func(segments []KeyPathSegment, value interface{}) {
+		path := &KeyPath{Segments: append([]KeyPathSegment(nil), segments...)}
+		path.Key = path.String()
+		matches = append(matches, KeyPathMatch{Path: path, Value: value})
+	})
+	return matches
+}
+
+// queryKeyPathSegments calls match with the path and value of every value in meta matched by segments. The path is
+// built up in matched as the segments are traversed.
+func queryKeyPathSegments(segments []KeyPathSegment, meta interface{}, matched []KeyPathSegment,
+	match func(segments []KeyPathSegment, value interface{})) {
+	if len(segments) == 0 {
+		match(matched, meta)
+		return
+	}
+
+	segment, childSegments := segments[0], segments[1:]
+	switch segment.Type {
+	case KeyPathName:
+		// Value is object with the key
+		metaObject := convertInterfaceToObject(meta)
+		if metaObject == nil {
+			return
+		}
+		if childMeta, ok := metaObject.Get(segment.Name); ok {
+			queryKeyPathSegments(childSegments, childMeta, append(matched, segment), match)
+		}
+	case KeyPathWildcard:
+		// Value is object with keys matching the pattern
+		metaObject := convertInterfaceToObject(meta)
+		if metaObject == nil {
+			return
+		}
+		var keys []string
+		for _, key := range metaObject.Keys() {
+			if globMatch(segment.Name, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			childMeta, _ := metaObject.Get(key)
+			queryKeyPathSegments(childSegments, childMeta,
+				append(matched, KeyPathSegment{Type: KeyPathName, Name: key}), match)
+		}
+	case KeyPathIndex, KeyPathAppend:
+		// Value is array with index; empty brackets match the first element
+		metaSlice := convertInterfaceToSlice(meta)
+		if metaIndex, inRange := resolveKeyPathIndex(segment.Index, len(metaSlice)); inRange {
+			queryKeyPathSegments(childSegments, metaSlice[metaIndex],
+				append(matched, KeyPathSegment{Type: KeyPathIndex, Index: metaIndex}), match)
+		}
+	case KeyPathAnyIndex:
+		// Value is array; match every element
+		for i, element := range convertInterfaceToSlice(meta) {
+			queryKeyPathSegments(childSegments, element,
+				append(matched, KeyPathSegment{Type: KeyPathIndex, Index: i}), match)
+		}
+	case KeyPathSlice:
+		// Value is array; the slice is matched as a whole as it is always the last segment
+		if metaSlice := convertInterfaceToSlice(meta); metaSlice != nil {
+			start, end := resolveKeyPathSlice(segment, len(metaSlice))
+			match(append(matched, segment), metaSlice[start:end])
+		}
+	}
+}
+
+// globMatch determines whether name matches the pattern, in which * matches any run of characters and ? matches any
+// single character.
+func globMatch(pattern string, name string) bool {
+	// Backtrack to just after the last * when a match fails
+	patternIndex, nameIndex := 0, 0
+	starPatternIndex, starNameIndex := -1, 0
+	for nameIndex < len(name) {
+		switch {
+		case patternIndex < len(pattern) && (pattern[patternIndex] == '?' || pattern[patternIndex] == name[nameIndex]):
+			patternIndex++
+			nameIndex++
+		case patternIndex < len(pattern) && pattern[patternIndex] == '*':
+			starPatternIndex, starNameIndex = patternIndex, nameIndex
+			patternIndex++
+		case starPatternIndex >= 0:
+			starNameIndex++
+			patternIndex, nameIndex = starPatternIndex+1, starNameIndex
+		default:
+			return false
+		}
+	}
+	for patternIndex < len(pattern) && pattern[patternIndex] == '*' {
+		patternIndex++
+	}
+	return patternIndex == len(pattern)
+}
+
+// Set sets the value at the path in meta and returns the updated meta. Values along the path that do not match the
+// type of the segment are replaced, e.g. setting a.b where a is a string replaces a with an object. Empty brackets
+// replace the value with a single element array and indexes past the end grow the array with nulls, but negative
+// indexes must refer to existing elements and slices cannot be set.
+func (p *KeyPath) Set(meta interface{}, value interface{}) (interface{}, error) {
+	return setKeyPathSegments(p.Segments, meta, value)
+}
+
+// setKeyPathSegments updates previousMeta by setting the value addressed by segments and returns the result.
+func setKeyPathSegments(segments []KeyPathSegment, previousMeta interface{}, value interface{}) (interface{}, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+
+	segment, childSegments := segments[0], segments[1:]
+	switch segment.Type {
+	case KeyPathName:
+		// Value is object; copy previous object only if it is an object
+		obj := newOrderedObject()
+		if previousObject := convertInterfaceToObject(previousMeta); previousObject != nil {
+			obj = previousObject.Copy()
+		}
+		previousChild, _ := obj.Get(segment.Name)
+		childValue, err := setKeyPathSegments(childSegments, previousChild, value)
+		if err != nil {
+			return nil, err
+		}
+		obj.Set(segment.Name, childValue)
+		return obj, nil
+	case KeyPathAppend:
+		// Value is array with the single element
+		childValue, err := setKeyPathSegments(childSegments, nil, value)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{childValue}, nil
+	case KeyPathIndex:
+		// Value is array with index; copy the previous values when it is an array
+		previousMetaSlice := convertInterfaceToSlice(previousMeta)
+		metaIndex := segment.Index
+		// Negative indexes count from the end, so they may only refer to existing elements
+		if metaIndex < 0 {
+			resolvedIndex, inRange := resolveKeyPathIndex(metaIndex, len(previousMetaSlice))
+			if !inRange {
+				return nil, fmt.Errorf("index %d is out of range for array of length %d",
+					metaIndex, len(previousMetaSlice))
+			}
+			metaIndex = resolvedIndex
+		}
+		// Grow the array with null to fit metaIndex
+		metaValue := make([]interface{}, len(previousMetaSlice))
+		copy(metaValue, previousMetaSlice)
+		if metaIndex+1 > len(metaValue) {
+			metaValue = append(metaValue, make([]interface{}, metaIndex+1-len(metaValue))...)
+		}
+		childValue, err := setKeyPathSegments(childSegments, metaValue[metaIndex], value)
+		if err != nil {
+			return nil, err
+		}
+		metaValue[metaIndex] = childValue
+		return metaValue, nil
+	case KeyPathSlice:
+		return nil, errors.New("slices may only be used with get")
+	default:
+		return nil, errors.New("wildcards may only be used with get")
+	}
+}
+
+// Delete removes the value at the path from meta and returns the updated meta along with whether anything was
+// removed. Array elements are spliced out so that later elements shift down.
+func (p *KeyPath) Delete(meta interface{}) (interface{}, bool) {
+	return deleteKeyPathSegments(p.Segments, meta)
+}
+
+// deleteKeyPathSegments removes the value addressed by segments from meta.
+func deleteKeyPathSegments(segments []KeyPathSegment, meta interface{}) (interface{}, bool) {
+	segment, childSegments := segments[0], segments[1:]
+	switch segment.Type {
+	case KeyPathName:
+		// Value is object; copy it so that meta is not modified
+		metaObject := convertInterfaceToObject(meta)
+		if metaObject == nil {
+			return meta, false
+		}
+		childMeta, ok := metaObject.Get(segment.Name)
+		if !ok {
+			return meta, false
+		}
+		metaObject = metaObject.Copy()
+		if len(childSegments) == 0 {
+			metaObject.Delete(segment.Name)
+			return metaObject, true
+		}
+		childMeta, deleted := deleteKeyPathSegments(childSegments, childMeta)
+		if !deleted {
+			return meta, false
+		}
+		metaObject.Set(segment.Name, childMeta)
+		return metaObject, true
+	case KeyPathIndex:
+		// Value is array with index; negative indexes count from the end
+		metaSlice := convertInterfaceToSlice(meta)
+		metaIndex, inRange := resolveKeyPathIndex(segment.Index, len(metaSlice))
+		if !inRange {
+			return meta, false
+		}
+		if len(childSegments) == 0 {
+			return append(metaSlice[:metaIndex], metaSlice[metaIndex+1:]...), true
+		}
+		childMeta, deleted := deleteKeyPathSegments(childSegments, metaSlice[metaIndex])
+		if !deleted {
+			return meta, false
+		}
+		metaSlice[metaIndex] = childMeta
+		return metaSlice, true
+	default:
+		// Empty brackets, slices and wildcards do not refer to a single existing value
+		return meta, false
+	}
+}
+
+// CheckElement checks that the path refers to a single existing value, which is not the case when it contains empty
+// brackets, slices or wildcards.
+func (p *KeyPath) CheckElement() error {
+	for _, segment := range p.Segments {
+		switch segment.Type {
+		case KeyPathAppend:
+			return errors.New("[] does not refer to an existing element")
+		case KeyPathSlice:
+			return errors.New("slices may only be used with get")
+		case KeyPathWildcard, KeyPathAnyIndex:
+			return errors.New("wildcards may only be used with get")
+		}
+	}
+	return nil
+}
+
+// errorf returns a KeyPathError describing the problem with the key at the current position.
+func (s *keyPathScanner) errorf(format string, args ...interface{}) error {
+	return &KeyPathError{Key: s.key, Pos: s.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// done determines whether the whole key has been scanned.
+func (s *keyPathScanner) done() bool {
+	return s.pos >= len(s.key)
+}
+
+// peek returns the next byte of the key without consuming it, or 0 when done.
+func (s *keyPathScanner) peek() byte {
+	if s.done() {
+		return 0
+	}
+	return s.key[s.pos]
+}
+
+// scanName scans a bare or quoted name, which is a wildcard when bare and containing * or ?.
+func (s *keyPathScanner) scanName() (KeyPathSegment, error) {
+	if c := s.peek(); c == '"' || c == '\'' {
+		name, err := s.scanQuoted()
+		return KeyPathSegment{Type: KeyPathName, Name: name}, err
+	}
+	start := s.pos
+	for !s.done() && (isBareNameChar(s.peek()) || isGlobChar(s.peek())) {
+		s.pos++
+	}
+	name := s.key[start:s.pos]
+	if name == "" {
+		return KeyPathSegment{}, s.errorf("expected a name")
+	}
+	if strings.IndexFunc(name, func(r rune) bool { return r < 0x80 && isGlobChar(byte(r)) }) >= 0 {
+		if first, last := name[0], name[len(name)-1]; !(isWordChar(first) || isGlobChar(first)) ||
+			!(isWordChar(last) || isGlobChar(last)) {
+			s.pos = start
+			return KeyPathSegment{}, s.errorf("pattern %s must start and end with a letter, digit, underscore, * or ?",
+				name)
+		}
+		return KeyPathSegment{Type: KeyPathWildcard, Name: name}, nil
+	}
+	if !isBareName(name) {
+		s.pos = start
+		return KeyPathSegment{}, s.errorf("name %s must start and end with a letter, digit or underscore", name)
+	}
+	return KeyPathSegment{Type: KeyPathName, Name: name}, nil
+}
+
+// scanQuoted scans a name in single or double quotes.
+func (s *keyPathScanner) scanQuoted() (string, error) {
+	quote := s.peek()
+	start := s.pos
+	s.pos++
+	var name strings.Builder
+	for !s.done() {
+		c := s.key[s.pos]
+		s.pos++
+		switch c {
+		case quote:
+			return name.String(), nil
+		case '\\':
+			if s.done() {
+				continue
+			}
+			name.WriteByte(s.key[s.pos])
+			s.pos++
+		default:
+			name.WriteByte(c)
+		}
+	}
+	s.pos = start
+	return "", s.errorf("unterminated quoted name")
+}
+
+// scanBrackets scans brackets containing nothing, an index, a slice or a quoted name.
+func (s *keyPathScanner) scanBrackets() (KeyPathSegment, error) {
+	start := s.pos
+	s.pos++
+	if c := s.peek(); c == '"' || c == '\'' {
+		name, err := s.scanQuoted()
+		if err != nil {
+			return KeyPathSegment{}, err
+		}
+		if s.peek() != ']' {
+			return KeyPathSegment{}, s.errorf("expected ]")
+		}
+		s.pos++
+		return KeyPathSegment{Type: KeyPathName, Name: name}, nil
+	}
+
+	end := strings.IndexByte(s.key[s.pos:], ']')
+	if end < 0 {
+		s.pos = start
+		return KeyPathSegment{}, s.errorf("unterminated [")
+	}
+	contents := s.key[s.pos : s.pos+end]
+	switch contents {
+	case "":
+		s.pos++
+		return KeyPathSegment{Type: KeyPathAppend}, nil
+	case "*":
+		s.pos += end + 1
+		return KeyPathSegment{Type: KeyPathAnyIndex}, nil
+	}
+
+	// Index, e.g. [1] or [-1]
+	if !strings.Contains(contents, ":") {
+		index, ok := parseKeyPathIndex(contents)
+		if !ok {
+			return KeyPathSegment{}, s.errorf("invalid index %s", contents)
+		}
+		s.pos += end + 1
+		return KeyPathSegment{Type: KeyPathIndex, Index: index}, nil
+	}
+
+	// Slice, e.g. [1:3], [:2] or [-2:]
+	bounds := strings.Split(contents, ":")
+	if len(bounds) != 2 {
+		return KeyPathSegment{}, s.errorf("invalid slice %s", contents)
+	}
+	segment := KeyPathSegment{Type: KeyPathSlice}
+	for i, bound := range bounds {
+		if bound == "" {
+			continue
+		}
+		index, ok := parseKeyPathIndex(bound)
+		if !ok {
+			return KeyPathSegment{}, s.errorf("invalid slice %s", contents)
+		}
+		if i == 0 {
+			segment.Start = &index
+		} else {
+			segment.End = &index
+		}
+	}
+	s.pos += end + 1
+	return segment, nil
+}
+
+// parseKeyPathIndex parses an index without leading zeros, which may be negative. e.g. 0, 10 or -1
+func parseKeyPathIndex(contents string) (int, bool) {
+	digits := strings.TrimPrefix(contents, "-")
+	if digits == "" || (digits[0] == '0' && contents != "0") || strings.IndexFunc(digits, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) >= 0 {
+		return 0, false
+	}
+	index, err := strconv.Atoi(contents)
+	return index, err == nil
+}
+
+// quoteKeyPathName quotes the name with double quotes, escaping double quotes and backslashes.
+func quoteKeyPathName(name string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+}
+
+// isBareName determines whether the name may be written without quotes.
+func isBareName(name string) bool {
+	if name == "" || !isWordChar(name[0]) || !isWordChar(name[len(name)-1]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isBareNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordChar determines whether c is a letter, digit or underscore.
+func isWordChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isGlobChar determines whether c is a wildcard in a bare name.
+func isGlobChar(c byte) bool {
+	return c == '*' || c == '?'
+}
+
+// isBareNameChar determines whether c may appear in a bare (unquoted) name.
+func isBareNameChar(c byte) bool {
+	return isWordChar(c) || c == '-' || c == ':'
+}
+
+// resolveKeyPathIndex converts an index, which counts from the end when negative, into an index of an array of the
+// given length, reporting whether it is in range. e.g. the index is -1 and length is 3, return 2, true
+func resolveKeyPathIndex(index int, length int) (int, bool) {
+	if index < 0 {
+		index += length
+	}
+	return index, index >= 0 && index < length
+}
+
+// resolveKeyPathSlice gets the bounds of the slice segment for an array of the given length. Negative bounds count
+// from the end and bounds are clamped to the array. e.g. the slice is [1:-1], return 1, length-1
+func resolveKeyPathSlice(segment KeyPathSegment, length int) (int, int) {
+	clamp := func(bound *int, defaultValue int) int {
+		if bound == nil {
+			return defaultValue
+		}
+		index := *bound
+		if index < 0 {
+			index += length
+		}
+		if index < 0 {
+			return 0
+		}
+		if index > length {
+			return length
+		}
+		return index
+	}
+	start := clamp(segment.Start, 0)
+	end := clamp(segment.End, length)
+	if end < start {
+		end = start
+	}
+	return start, end
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyPathSuite struct {
+	suite.Suite
+}
+
+func TestKeyPathSuite(t *testing.T) {
+	suite.Run(t, new(KeyPathSuite))
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// decodeJSON decodes the json document for use as meta in tests.
+func (s *KeyPathSuite) decodeJSON(document string) interface{} {
+	meta, err := decodeOrderedJSON([]byte(document))
+	s.Require().NoError(err)
+	return meta
+}
+
+// encodeJSON encodes the meta for comparison in tests.
+func (s *KeyPathSuite) encodeJSON(meta interface{}) string {
+	data, err := json.Marshal(meta)
+	s.Require().NoError(err)
+	return string(data)
+}
+
+func (s *KeyPathSuite) TestParseKeyPath() {
+	tests := []struct {
+		key      string
+		expected []KeyPathSegment
+	}{
+		{
+			key:      `foo`,
+			expected: []KeyPathSegment{{Type: KeyPathName, Name: "foo"}},
+		},
+		{
+			key: `foo.b-a-r:baz`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathName, Name: "b-a-r:baz"},
+			},
+		},
+		{
+			key: `foo[10].bar[-1][]`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathIndex, Index: 10},
+				{Type: KeyPathName, Name: "bar"},
+				{Type: KeyPathIndex, Index: -1},
+				{Type: KeyPathAppend},
+			},
+		},
+		{
+			key: `foo[1:-1]`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathSlice, Start: intPtr(1), End: intPtr(-1)},
+			},
+		},
+		{
+			key: `foo[:2]`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathSlice, End: intPtr(2)},
+			},
+		},
+		{
+			key: `images["docker.io/foo"].tag`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "images"},
+				{Type: KeyPathName, Name: "docker.io/foo"},
+				{Type: KeyPathName, Name: "tag"},
+			},
+		},
+		{
+			key: `images.'v1.2'.sha`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "images"},
+				{Type: KeyPathName, Name: "v1.2"},
+				{Type: KeyPathName, Name: "sha"},
+			},
+		},
+		{
+			key: `"a.b"['c[0]']`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "a.b"},
+				{Type: KeyPathName, Name: "c[0]"},
+			},
+		},
+		{
+			key: `sd.*.deploy-?[*].sha`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "sd"},
+				{Type: KeyPathWildcard, Name: "*"},
+				{Type: KeyPathWildcard, Name: "deploy-?"},
+				{Type: KeyPathAnyIndex},
+				{Type: KeyPathName, Name: "sha"},
+			},
+		},
+		{
+			key: `foo."*"`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathName, Name: "*"},
+			},
+		},
+		{
+			key: `foo."say \"hi\"".'it\'s'."back\\slash"`,
+			expected: []KeyPathSegment{
+				{Type: KeyPathName, Name: "foo"},
+				{Type: KeyPathName, Name: `say "hi"`},
+				{Type: KeyPathName, Name: "it's"},
+				{Type: KeyPathName, Name: `back\slash`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			keyPath, err := ParseKeyPath(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.key, keyPath.Key)
+			s.Assert().Equal(tt.expected, keyPath.Segments)
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestParseKeyPath_errors() {
+	tests := []struct {
+		key         string
+		expectedPos int
+		expectedMsg string
+	}{
+		{key: ``, expectedPos: 0, expectedMsg: "expected a name"},
+		{key: `foo.`, expectedPos: 4, expectedMsg: "expected a name"},
+		{key: `foo.-bar`, expectedPos: 4, expectedMsg: "name -bar must start and end with a letter, digit or underscore"},
+		{key: `foo."bar`, expectedPos: 4, expectedMsg: "unterminated quoted name"},
+		{key: `foo["bar"x]`, expectedPos: 9, expectedMsg: "expected ]"},
+		{key: `foo[1`, expectedPos: 3, expectedMsg: "unterminated ["},
+		{key: `foo[01]`, expectedPos: 4, expectedMsg: "invalid index 01"},
+		{key: `foo[-0]`, expectedPos: 4, expectedMsg: "invalid index -0"},
+		{key: `foo[1:2:3]`, expectedPos: 4, expectedMsg: "invalid slice 1:2:3"},
+		{key: `foo[1:3].bar`, expectedPos: 8, expectedMsg: "a slice must be the last part of the key"},
+		{key: `foo]`, expectedPos: 3, expectedMsg: "expected . or ["},
+		{key: `[0]`, expectedPos: 0, expectedMsg: "key must start with a name"},
+		{key: `[*]`, expectedPos: 0, expectedMsg: "key must start with a name"},
+		{key: `foo.-*`, expectedPos: 4,
+			expectedMsg: "pattern -* must start and end with a letter, digit, underscore, * or ?"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			_, err := ParseKeyPath(tt.key)
+			var keyPathErr *KeyPathError
+			s.Require().True(errors.As(err, &keyPathErr), "expected a KeyPathError, got %v", err)
+			s.Assert().Equal(tt.key, keyPathErr.Key)
+			s.Assert().Equal(tt.expectedPos, keyPathErr.Pos)
+			s.Assert().Equal(tt.expectedMsg, keyPathErr.Msg)
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPathError_Error() {
+	_, err := ParseKeyPath("foo.")
+	s.Require().EqualError(err, "invalid meta key foo.: expected a name at position 4")
+}
+
+func (s *KeyPathSuite) TestMustParseKeyPath() {
+	s.Assert().Equal("foo", MustParseKeyPath("foo").Segments[0].Name)
+	s.Assert().Panics(func() { MustParseKeyPath("foo.") })
+}
+
+func (s *KeyPathSuite) TestKeyPath_String() {
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: `foo.bar[1]`, expected: `foo.bar[1]`},
+		{key: `foo[][-1]`, expected: `foo[][-1]`},
+		{key: `foo[1:]`, expected: `foo[1:]`},
+		{key: `foo[:-1]`, expected: `foo[:-1]`},
+		{key: `foo[:]`, expected: `foo[:]`},
+		{key: `['foo'].'bar'`, expected: `foo.bar`},
+		{key: `images["docker.io/foo"].tag`, expected: `images."docker.io/foo".tag`},
+		{key: `'v1.2'`, expected: `"v1.2"`},
+		{key: `foo.'say "hi"'.'back\\slash'`, expected: `foo."say \"hi\""."back\\slash"`},
+		{key: `foo.''`, expected: `foo.""`},
+		{key: `sd.*.build-?[*]`, expected: `sd.*.build-?[*]`},
+		{key: `foo.'*'`, expected: `foo."*"`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			keyPath := MustParseKeyPath(tt.key)
+			s.Assert().Equal(tt.expected, keyPath.String())
+			// The canonical form parses back to the same segments
+			s.Assert().Equal(keyPath.Segments, MustParseKeyPath(keyPath.String()).Segments)
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_Get() {
+	meta := `{"str":"val","obj":{"a.b":1,"c":[10,20,30]},"ary":[{"x":1},{"x":2}],"empty":[]}`
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: `str`, expected: `"val"`},
+		{key: `obj."a.b"`, expected: `1`},
+		{key: `obj.c[1]`, expected: `20`},
+		{key: `obj.c[-1]`, expected: `30`},
+		{key: `obj.c[3]`, expected: `null`},
+		{key: `obj.c[-4]`, expected: `null`},
+		{key: `obj.c[1:]`, expected: `[20,30]`},
+		{key: `obj.c[5:]`, expected: `[]`},
+		{key: `obj.c[]`, expected: `10`},
+		{key: `ary[].x`, expected: `1`},
+		{key: `ary[-1].x`, expected: `2`},
+		{key: `empty[]`, expected: `null`},
+		{key: `missing.x`, expected: `null`},
+		// Segments that do not match the type of the value get null
+		{key: `str.x`, expected: `null`},
+		{key: `str[0]`, expected: `null`},
+		{key: `obj[0]`, expected: `null`},
+		{key: `ary.x`, expected: `null`},
+		{key: `str[:]`, expected: `null`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			s.Assert().Equal(tt.expected, s.encodeJSON(MustParseKeyPath(tt.key).Get(s.decodeJSON(meta))))
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_Lookup() {
+	meta := `{"obj":{"a":null},"ary":[null],"str":"val"}`
+
+	tests := []struct {
+		key      string
+		expected bool
+	}{
+		{key: `obj`, expected: true},
+		{key: `obj.a`, expected: true},
+		{key: `ary[0]`, expected: true},
+		{key: `ary[-1]`, expected: true},
+		{key: `ary[]`, expected: true},
+		{key: `ary[5:]`, expected: true},
+		{key: `obj.b`, expected: false},
+		{key: `obj.a.b`, expected: false},
+		{key: `ary[1]`, expected: false},
+		{key: `ary[-2]`, expected: false},
+		{key: `str.x`, expected: false},
+		{key: `str[:]`, expected: false},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			value, found := MustParseKeyPath(tt.key).Lookup(s.decodeJSON(meta))
+			s.Assert().Equal(tt.expected, found)
+			if !found {
+				s.Assert().Nil(value)
+			}
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_Query() {
+	meta := `{"images":[{"repo":"a","tag":"1.0"},{"repo":"b"},{"repo":"c","tag":"2.0"}],` +
+		`"sd":{"123":{"main":{"build":{"sha":"aaa"}},"deploy":{"build":{"sha":"bbb"}}},"456":{"main":{}}},` +
+		`"str":"val","*":"star"}`
+
+	type match struct {
+		path  string
+		value string
+	}
+
+	tests := []struct {
+		key      string
+		expected []match
+	}{
+		{
+			key:      `images[*].tag`,
+			expected: []match{{`images[0].tag`, `"1.0"`}, {`images[2].tag`, `"2.0"`}},
+		},
+		{
+			key:      `sd.*.*.build.sha`,
+			expected: []match{{`sd.123.deploy.build.sha`, `"bbb"`}, {`sd.123.main.build.sha`, `"aaa"`}},
+		},
+		{
+			key:      `sd.1?3.m*`,
+			expected: []match{{`sd.123.main`, `{"build":{"sha":"aaa"}}`}},
+		},
+		{
+			key:      `images[-1].*`,
+			expected: []match{{`images[2].repo`, `"c"`}, {`images[2].tag`, `"2.0"`}},
+		},
+		{
+			key:      `images[*].repo`,
+			expected: []match{{`images[0].repo`, `"a"`}, {`images[1].repo`, `"b"`}, {`images[2].repo`, `"c"`}},
+		},
+		{
+			key:      `sd.*[*]`,
+			expected: nil,
+		},
+		{
+			key:      `str.*`,
+			expected: nil,
+		},
+		{
+			key:      `"*"`,
+			expected: []match{{`"*"`, `"star"`}},
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			var matches []match
+			for _, m := range MustParseKeyPath(tt.key).Query(s.decodeJSON(meta)) {
+				matches = append(matches, match{m.Path.Key, s.encodeJSON(m.Value)})
+			}
+			s.Assert().Equal(tt.expected, matches)
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestGlobMatch() {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*", "", true},
+		{"*", "anything.at/all", true},
+		{"deploy-*", "deploy-prod", true},
+		{"deploy-*", "predeploy-prod", false},
+		{"*-prod", "deploy-prod", true},
+		{"*-prod", "deploy-prod-2", false},
+		{"a*b*c", "aXXbYYbc", true},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXcYY", false},
+		{"v?", "v1", true},
+		{"v?", "v10", false},
+		{"v??", "v1", false},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.pattern+" "+tt.name, func() {
+			s.Assert().Equal(tt.expected, globMatch(tt.pattern, tt.name))
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_Set() {
+	tests := []struct {
+		name     string
+		meta     string
+		key      string
+		expected string
+		wantErr  string
+	}{
+		{name: "new key", meta: `{}`, key: `foo`, expected: `{"foo":"v"}`},
+		{name: "nested new keys", meta: `{}`, key: `a.b[1].c`, expected: `{"a":{"b":[null,{"c":"v"}]}}`},
+		{name: "keeps siblings", meta: `{"a":{"x":1}}`, key: `a.b`, expected: `{"a":{"x":1,"b":"v"}}`},
+		{name: "replaces string with object", meta: `{"a":"s","z":1}`, key: `a.b`, expected: `{"a":{"b":"v"},"z":1}`},
+		{name: "replaces object with array", meta: `{"a":{"x":1}}`, key: `a[0]`, expected: `{"a":["v"]}`},
+		{name: "replaces array with object", meta: `{"a":[1]}`, key: `a.b`, expected: `{"a":{"b":"v"}}`},
+		{name: "empty brackets", meta: `{"a":[1,2]}`, key: `a[]`, expected: `{"a":["v"]}`},
+		{name: "empty brackets with trailing", meta: `{"a":[{"x":1}]}`, key: `a[].b`, expected: `{"a":[{"b":"v"}]}`},
+		{name: "negative index", meta: `{"a":[1,{"x":1}]}`, key: `a[-1].y`, expected: `{"a":[1,{"x":1,"y":"v"}]}`},
+		{name: "quoted", meta: `{}`, key: `["a.b"].'c'`, expected: `{"a.b":{"c":"v"}}`},
+		{name: "negative index out of range", meta: `{"a":[1]}`, key: `a[-2]`,
+			wantErr: "index -2 is out of range for array of length 1"},
+		{name: "negative index of missing", meta: `{}`, key: `a[-1]`,
+			wantErr: "index -1 is out of range for array of length 0"},
+		{name: "slice", meta: `{"a":[1]}`, key: `a[0:1]`, wantErr: "slices may only be used with get"},
+		{name: "wildcard", meta: `{"a":{"b":1}}`, key: `a.*`, wantErr: "wildcards may only be used with get"},
+		{name: "any index", meta: `{"a":[1]}`, key: `a[*]`, wantErr: "wildcards may only be used with get"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			meta := s.decodeJSON(tt.meta)
+			updated, err := MustParseKeyPath(tt.key).Set(meta, "v")
+			if tt.wantErr != "" {
+				s.Require().EqualError(err, tt.wantErr)
+				return
+			}
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, s.encodeJSON(updated))
+			// The meta passed in is not modified
+			s.Assert().JSONEq(tt.meta, s.encodeJSON(meta))
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_SetThenGet() {
+	metas := []string{`{}`, `{"a":"s"}`, `{"a":{"b":[1,{"c":2}]}}`, `{"a":[[1,2],[3]]}`}
+	keys := []string{`a`, `a.b`, `a[0]`, `a[]`, `a[].c`, `a.b[1].c`, `a[2][1]`, `a."x.y"[0]`, `a[0][]`}
+
+	for _, meta := range metas {
+		for _, key := range keys {
+			s.Run(meta+" "+key, func() {
+				keyPath := MustParseKeyPath(key)
+				updated, err := keyPath.Set(s.decodeJSON(meta), "v")
+				s.Require().NoError(err)
+				s.Assert().Equal("v", keyPath.Get(updated))
+			})
+		}
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_Delete() {
+	tests := []struct {
+		name        string
+		meta        string
+		key         string
+		expected    string
+		wantDeleted bool
+	}{
+		{name: "key", meta: `{"a":1,"b":2}`, key: `a`, expected: `{"b":2}`, wantDeleted: true},
+		{name: "element", meta: `{"a":[1,2,3]}`, key: `a[1]`, expected: `{"a":[1,3]}`, wantDeleted: true},
+		{name: "negative", meta: `{"a":[1,2,3]}`, key: `a[-1]`, expected: `{"a":[1,2]}`, wantDeleted: true},
+		{name: "nested", meta: `{"a":[{"b":1,"c":2}]}`, key: `a[0].b`, expected: `{"a":[{"c":2}]}`, wantDeleted: true},
+		{name: "quoted", meta: `{"a.b":1}`, key: `"a.b"`, expected: `{}`, wantDeleted: true},
+		{name: "missing", meta: `{"a":1}`, key: `b.c`, expected: `{"a":1}`},
+		{name: "out of range", meta: `{"a":[1]}`, key: `a[1]`, expected: `{"a":[1]}`},
+		{name: "through string", meta: `{"a":"s"}`, key: `a.b`, expected: `{"a":"s"}`},
+		{name: "empty brackets", meta: `{"a":[1]}`, key: `a[]`, expected: `{"a":[1]}`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			updated, deleted := MustParseKeyPath(tt.key).Delete(s.decodeJSON(tt.meta))
+			s.Assert().Equal(tt.wantDeleted, deleted)
+			s.Assert().Equal(tt.expected, s.encodeJSON(updated))
+		})
+	}
+}
+
+func (s *KeyPathSuite) TestKeyPath_CheckElement() {
+	s.Assert().NoError(MustParseKeyPath("a[0].b[-1]").CheckElement())
+	s.Assert().EqualError(MustParseKeyPath("a[].b").CheckElement(), "[] does not refer to an existing element")
+	s.Assert().EqualError(MustParseKeyPath("a[1:]").CheckElement(), "slices may only be used with get")
+	s.Assert().EqualError(MustParseKeyPath("a.*").CheckElement(), "wildcards may only be used with get")
+}
+
+func (s *KeyPathSuite) TestResolveKeyPathSlice() {
+	tests := []struct {
+		name          string
+		segment       KeyPathSegment
+		length        int
+		expectedStart int
+		expectedEnd   int
+	}{
+		{name: "whole", segment: KeyPathSegment{}, length: 4, expectedStart: 0, expectedEnd: 4},
+		{name: "negative", segment: KeyPathSegment{Start: intPtr(-2)}, length: 4, expectedStart: 2, expectedEnd: 4},
+		{name: "clamped", segment: KeyPathSegment{Start: intPtr(-10), End: intPtr(10)}, length: 4,
+			expectedStart: 0, expectedEnd: 4},
+		{name: "empty", segment: KeyPathSegment{Start: intPtr(3), End: intPtr(1)}, length: 4,
+			expectedStart: 3, expectedEnd: 3},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			start, end := resolveKeyPathSlice(tt.segment, tt.length)
+			s.Assert().Equal(tt.expectedStart, start)
+			s.Assert().Equal(tt.expectedEnd, end)
+		})
+	}
+}
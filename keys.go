@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Types of meta values listed by List
+const (
+	metaTypeObject = "object"
+	metaTypeArray  = "array"
+	metaTypeString = "string"
+	metaTypeNumber = "number"
+	metaTypeBool   = "bool"
+	metaTypeNull   = "null"
+)
+
+// MetaEntry is a path in the meta along with the type of its value, as listed by List.
+type MetaEntry struct {
+	// Path is the canonical key of the value, which may be passed to get
+	Path string `json:"path"`
+	// Type is the type of the value: object, array, string, number, bool or null
+	Type string `json:"type"`
+}
+
+// Keys gets the immediate child keys of the object at key in the meta, in order, or the indexes of the array at key.
+// An empty key lists the top level keys. Values that have no children have no keys, and keys that do not exist are an
+// error (ErrKeyNotFound).
+func (m *MetaSpec) Keys(key string) ([]string, error) {
+	_, value, err := m.listValue("keys", key)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	if valueObject := convertInterfaceToObject(value); valueObject != nil {
+		ret = append(ret, valueObject.Keys()...)
+	} else if valueSlice := convertInterfaceToSlice(value); valueSlice != nil {
+		for i := range valueSlice {
+			ret = append(ret, strconv.Itoa(i))
+		}
+	}
+	return ret, nil
+}
+
+// List gets the paths and types of the immediate children of the value at key in the meta, or, when recursive, of
+// every leaf below it (including empty objects and arrays). An empty key lists the whole meta, and keys that do not
+// exist are an error (ErrKeyNotFound).
+func (m *MetaSpec) List(key string, recursive bool) ([]MetaEntry, error) {
+	keyPath, value, err := m.listValue("ls", key)
+	if err != nil {
+		return nil, err
+	}
+	ret := []MetaEntry{}
+	walkMetaChildren(keyPath.Segments, value, recursive, func(segments []KeyPathSegment, value interface{}) {
+		path := &KeyPath{Segments: segments}
+		ret = append(ret, MetaEntry{Path: path.String(), Type: metaValueType(value)})
+	})
+	return ret, nil
+}
+
+// listValue gets the parsed key (which must refer to a single value) and its value in the meta for the operation. The
+// key is looked up as in Lookup, e.g. parameters are cleaned.
+func (m *MetaSpec) listValue(operation string, key string) (*KeyPath, interface{}, error) {
+	keyPath := &KeyPath{}
+	if key != "" {
+		var err error
+		if keyPath, err = ParseKeyPath(key); err != nil {
+			return nil, nil, err
+		}
+		if err = keyPath.CheckElement(); err != nil {
+			return nil, nil, fmt.Errorf("cannot %s %s; %v", operation, key, err)
+		}
+	}
+	meta, err := m.lookupMeta(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, found := keyPath.Lookup(meta); !found {
+		return nil, nil, fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	// Resolve negative indexes so that the listed paths are canonical
+	segments := make([]KeyPathSegment, 0, len(keyPath.Segments))
+	var value interface{} = meta
+	for _, segment := range keyPath.Segments {
+		if segment.Type == KeyPathIndex {
+			if index, inRange := resolveKeyPathIndex(segment.Index, len(convertInterfaceToSlice(value))); inRange {
+				segment.Index = index
+			}
+		}
+		segments = append(segments, segment)
+		value = (&KeyPath{Segments: []KeyPathSegment{segment}}).Get(value)
+	}
+	return &KeyPath{Key: key, Segments: segments}, value, nil
+}
+
+// walkMetaChildren calls visit with the path and value of each child of meta, whose path is segments, in order. When
+// recursive, it descends into children with children of their own and only visits the leaves.
+func walkMetaChildren(segments []KeyPathSegment, meta interface{}, recursive bool,
+	visit func(segments []KeyPathSegment, value interface{})) {
+	visitChild := func(segment KeyPathSegment, value interface{}) {
+		childSegments := append(append([]KeyPathSegment(nil), segments...), segment)
+		if recursive && hasMetaChildren(value) {
+			walkMetaChildren(childSegments, value, recursive, visit)
+			return
+		}
+		visit(childSegments, value)
+	}
+	if metaObject := convertInterfaceToObject(meta); metaObject != nil {
+		for _, key := range metaObject.Keys() {
+			value, _ := metaObject.Get(key)
+			visitChild(KeyPathSegment{Type: KeyPathName, Name: key}, value)
+		}
+	} else if metaSlice := convertInterfaceToSlice(meta); metaSlice != nil {
+		for i, value := range metaSlice {
+			visitChild(KeyPathSegment{Type: KeyPathIndex, Index: i}, value)
+		}
+	}
+}
+
+// hasMetaChildren determines whether the value is an object or array that is not empty.
+func hasMetaChildren(value interface{}) bool {
+	if valueObject := convertInterfaceToObject(value); valueObject != nil {
+		return len(valueObject.Keys()) != 0
+	}
+	return len(convertInterfaceToSlice(value)) != 0
+}
+
+// metaValueType gets the type of a decoded meta value.
+func metaValueType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return metaTypeNull
+	case string:
+		return metaTypeString
+	case bool:
+		return metaTypeBool
+	}
+	if convertInterfaceToObject(value) != nil {
+		return metaTypeObject
+	}
+	if convertInterfaceToSlice(value) != nil {
+		return metaTypeArray
+	}
+	return metaTypeNumber
+}
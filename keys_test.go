@@ -0,0 +1,113 @@
+package main
+
+func (s *MetaSuite) TestMetaSpec_Keys() {
+	s.MetaSpec.JSONValue = true
+	s.Require().NoError(s.MetaSpec.Set("foo", `{"bar":[1,{"x":null}],"e":{},"s":"t"}`))
+	s.Require().NoError(s.MetaSpec.Set(`a."b.c"`, "true"))
+
+	tests := []struct {
+		key  string
+		want []string
+	}{
+		{key: "", want: []string{"foo", "a"}},
+		{key: "foo", want: []string{"bar", "e", "s"}},
+		{key: "foo.bar", want: []string{"0", "1"}},
+		{key: "foo.bar[-1]", want: []string{"x"}},
+		{key: "foo.e", want: []string{}},
+		{key: "foo.s", want: []string{}},
+	}
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			got, err := s.MetaSpec.Keys(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.want, got)
+		})
+	}
+}
+
+func (s *MetaSuite) TestMetaSpec_List() {
+	s.MetaSpec.JSONValue = true
+	s.Require().NoError(s.MetaSpec.Set("foo", `{"bar":[1.5,{"x":null}],"e":{},"s":"t"}`))
+	s.Require().NoError(s.MetaSpec.Set(`a."b.c"`, "true"))
+
+	got, err := s.MetaSpec.List("", false)
+	s.Require().NoError(err)
+	s.Assert().Equal([]MetaEntry{{Path: "foo", Type: "object"}, {Path: "a", Type: "object"}}, got)
+
+	got, err = s.MetaSpec.List("", true)
+	s.Require().NoError(err)
+	s.Assert().Equal([]MetaEntry{
+		{Path: "foo.bar[0]", Type: "number"},
+		{Path: "foo.bar[1].x", Type: "null"},
+		{Path: "foo.e", Type: "object"},
+		{Path: "foo.s", Type: "string"},
+		{Path: `a."b.c"`, Type: "bool"},
+	}, got)
+
+	_, err = s.MetaSpec.List("foo.bar[-2:]", false)
+	s.Assert().EqualError(err, "cannot ls foo.bar[-2:]; slices may only be used with get")
+
+	// Paths are canonical, so negative indexes are resolved
+	got, err = s.MetaSpec.List("foo.bar[-1]", true)
+	s.Require().NoError(err)
+	s.Assert().Equal([]MetaEntry{{Path: "foo.bar[1].x", Type: "null"}}, got)
+
+	got, err = s.MetaSpec.List("foo.s", true)
+	s.Require().NoError(err)
+	s.Assert().Empty(got)
+
+	_, err = s.MetaSpec.Keys("foo[*]")
+	s.Assert().EqualError(err, "cannot keys foo[*]; wildcards may only be used with get")
+}
+
+func (s *MetaSuite) TestMetaSpec_Keys_missing() {
+	s.Require().NoError(s.MetaSpec.Set("foo.bar", "1"))
+
+	for _, key := range []string{"missing", "foo.baz", "foo.bar.x", "foo[0]"} {
+		s.Run(key, func() {
+			_, err := s.MetaSpec.Keys(key)
+			s.Assert().ErrorIs(err, ErrKeyNotFound)
+			s.Assert().EqualError(err, "key not found: "+key)
+
+			_, err = s.MetaSpec.List(key, true)
+			s.Assert().ErrorIs(err, ErrKeyNotFound)
+		})
+	}
+}
+
+func (s *MetaSuite) TestMetaSpec_Keys_parameters() {
+	s.MetaSpec.MetaFile = jobParamsPublishFile
+	s.Require().NoError(s.CopyMockFile(jobParamsPublishFile))
+
+	// Parameters are cleaned as in get, so the job keys are not listed and the job overrides are
+	got, err := s.MetaSpec.Keys("parameters")
+	s.Require().NoError(err)
+	s.Assert().ElementsMatch([]string{"car", "color"}, got)
+
+	entries, err := s.MetaSpec.List("parameters", true)
+	s.Require().NoError(err)
+	s.Assert().ElementsMatch([]MetaEntry{
+		{Path: "parameters.car.value", Type: "string"},
+		{Path: "parameters.color.value", Type: "string"},
+	}, entries)
+
+	got, err = s.MetaSpec.Keys("parameters.color")
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"value"}, got)
+	value, err := s.MetaSpec.Get("parameters.color.value")
+	s.Require().NoError(err)
+	s.Assert().Equal("white", value)
+}
+
+func (s *MetaSuite) TestMetaSpec_Keys_external() {
+	s.Require().NoError(s.CopyMockFile(externalFile))
+	s.MetaSpec.MetaFile = externalFile
+
+	got, err := s.MetaSpec.Keys("")
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"obj", "str"}, got)
+
+	entries, err := s.MetaSpec.List("obj", false)
+	s.Require().NoError(err)
+	s.Assert().Equal([]MetaEntry{{Path: "obj.abc", Type: "string"}}, entries)
+}
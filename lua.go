@@ -2,7 +2,7 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"time"
 
 	libs "github.com/vadv/gopher-lua-libs"
 	"github.com/vadv/gopher-lua-libs/json"
@@ -79,6 +79,175 @@ func metaSpecSet(L *lua.LState) int {
 	return 0
 }
 
+// metaSpecDelete(key) performs meta.Delete(key)
+func metaSpecDelete(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() != 2 {
+		L.RaiseError("Require 1 arg, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	err := meta.Delete(L.CheckString(2))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	return 0
+}
+
+// metaSpecPatch(patch) performs meta.Patch(json.encode(patch)); a string patch is passed through as is
+func metaSpecPatch(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() != 2 {
+		L.RaiseError("Require 1 arg, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	patch := L.CheckAny(2)
+	if s, ok := patch.(lua.LString); ok {
+		if err := meta.Patch(string(s)); err != nil {
+			L.RaiseError("%s", err.Error())
+		}
+		return 0
+	}
+	data, err := json.ValueEncode(patch)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	err = meta.Patch(string(data))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	return 0
+}
+
+// metaSpecInsertFunction returns a function that inserts json.encode(value) into the array at key using insert
+func metaSpecInsertFunction(insert func(meta *MetaSpec, key string, value string) error) lua.LGFunction {
+	return func(L *lua.LState) int {
+		meta := checkMetaSpec(L, 1)
+		if L.GetTop() != 3 {
+			L.RaiseError("Require 2 args, but %d were passed", L.GetTop()-1)
+			return 0
+		}
+		value := L.CheckAny(3)
+		data, err := json.ValueEncode(value)
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		err = insert(meta, L.CheckString(2), string(data))
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		return 0
+	}
+}
+
+// metaSpecRemoveFunction returns a function that removes from the array at key using remove and returns the
+// json.decode of the removed value
+func metaSpecRemoveFunction(remove func(meta *MetaSpec, key string) (string, error)) lua.LGFunction {
+	return func(L *lua.LState) int {
+		meta := checkMetaSpec(L, 1)
+		if L.GetTop() != 2 {
+			L.RaiseError("Require 1 arg, but %d were passed", L.GetTop()-1)
+			return 0
+		}
+		removed, err := remove(meta, L.CheckString(2))
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		jsonResponse, err := json.ValueDecode(L, []byte(removed))
+		if err != nil {
+			L.RaiseError("%s", err.Error())
+			return 0
+		}
+		L.Push(jsonResponse)
+		return 1
+	}
+}
+
+// metaSpecQuery(query[, key]) returns json.decode(meta.Query(key, query))
+func metaSpecQuery(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() != 2 && L.GetTop() != 3 {
+		L.RaiseError("Require 1 or 2 args, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	got, err := meta.Query(L.OptString(3, ""), L.CheckString(2))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	jsonResponse, err := json.ValueDecode(L, []byte(got))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	L.Push(jsonResponse)
+	return 1
+}
+
+// metaSpecExists(key) returns meta.Exists(key)
+func metaSpecExists(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() != 2 {
+		L.RaiseError("Require 1 arg, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	found, err := meta.Exists(L.CheckString(2))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	L.Push(lua.LBool(found))
+	return 1
+}
+
+// metaSpecKeys([key]) returns the list of meta.Keys(key)
+func metaSpecKeys(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() > 2 {
+		L.RaiseError("Require 0 or 1 args, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	keys, err := meta.Keys(L.OptString(2, ""))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	ret := L.NewTable()
+	for _, key := range keys {
+		ret.Append(lua.LString(key))
+	}
+	L.Push(ret)
+	return 1
+}
+
+// metaSpecLs([key[, recursive]]) returns the list of meta.List(key, recursive) as tables with path and type fields
+func metaSpecLs(L *lua.LState) int {
+	meta := checkMetaSpec(L, 1)
+	if L.GetTop() > 3 {
+		L.RaiseError("Require 0 to 2 args, but %d were passed", L.GetTop()-1)
+		return 0
+	}
+	entries, err := meta.List(L.OptString(2, ""), L.OptBool(3, false))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	ret := L.NewTable()
+	for _, entry := range entries {
+		luaEntry := L.NewTable()
+		luaEntry.RawSetString("path", lua.LString(entry.Path))
+		luaEntry.RawSetString("type", lua.LString(entry.Type))
+		ret.Append(luaEntry)
+	}
+	L.Push(ret)
+	return 1
+}
+
 // metaSpecDump returns json.decode(meta.Dump())
 func metaSpecDump(L *lua.LState) int {
 	meta := checkMetaSpec(L, 1)
@@ -121,12 +290,21 @@ func metaSpecUndump(L *lua.LState) int {
 		return 0
 	}
 
+	if err := meta.checkNamespace(); err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
 	data, err := json.ValueEncode(decoded)
 	if err != nil {
 		L.RaiseError("%s", err.Error())
 		return 0
 	}
-	err = ioutil.WriteFile(meta.MetaFilePath(), data, 0666)
+	data, err = orderMetaJSONLikeFile(data, meta.MetaFilePath())
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
+	err = writeMetaFile(meta.MetaFilePath(), data)
 	if err != nil {
 		L.RaiseError("%s", err.Error())
 		return 0
@@ -166,10 +344,22 @@ func registerLastSuccessfulMetaRequest(L *lua.LState) *lua.LTable {
 		switch k {
 		case "SdToken":
 			L.Push(lua.LString(lastSuccessfulMetaRequest.SdToken))
+		case "SdTokenFile":
+			L.Push(lua.LString(lastSuccessfulMetaRequest.SdTokenFile))
+		case "SdAPIKey":
+			L.Push(lua.LString(lastSuccessfulMetaRequest.SdAPIKey))
 		case "SdAPIURL":
 			L.Push(lua.LString(lastSuccessfulMetaRequest.SdAPIURL))
 		case "DefaultSdPipelineID":
 			L.Push(lua.LNumber(lastSuccessfulMetaRequest.DefaultSdPipelineID))
+		case "DefaultPullRequest":
+			L.Push(lua.LString(lastSuccessfulMetaRequest.DefaultPullRequest))
+		case "Retries":
+			L.Push(lua.LNumber(lastSuccessfulMetaRequest.Retries))
+		case "RequestTimeout":
+			L.Push(lua.LNumber(lastSuccessfulMetaRequest.RequestTimeout.Seconds()))
+		case "Timeout":
+			L.Push(lua.LNumber(lastSuccessfulMetaRequest.Timeout.Seconds()))
 		default:
 			// If unknown field, delegate to the function map.
 			L.Push(L.GetField(funcs, k))
@@ -182,12 +372,30 @@ func registerLastSuccessfulMetaRequest(L *lua.LState) *lua.LTable {
 		lastSuccessfulMetaRequest := checkLastSuccessfulMetaRequest(L, 1)
 		k := L.CheckString(2)
 		switch k {
+		// Changing the credentials or url makes a new authenticator, rather than keep using a token exchanged for the
+		// old ones
 		case "SdToken":
 			lastSuccessfulMetaRequest.SdToken = L.CheckString(3)
+			lastSuccessfulMetaRequest.Authenticator = nil
+		case "SdTokenFile":
+			lastSuccessfulMetaRequest.SdTokenFile = L.CheckString(3)
+			lastSuccessfulMetaRequest.Authenticator = nil
+		case "SdAPIKey":
+			lastSuccessfulMetaRequest.SdAPIKey = L.CheckString(3)
+			lastSuccessfulMetaRequest.Authenticator = nil
 		case "SdAPIURL":
 			lastSuccessfulMetaRequest.SdAPIURL = L.CheckString(3)
+			lastSuccessfulMetaRequest.Authenticator = nil
 		case "DefaultSdPipelineID":
 			lastSuccessfulMetaRequest.DefaultSdPipelineID = L.CheckInt64(3)
+		case "DefaultPullRequest":
+			lastSuccessfulMetaRequest.DefaultPullRequest = L.CheckString(3)
+		case "Retries":
+			lastSuccessfulMetaRequest.Retries = L.CheckInt(3)
+		case "RequestTimeout":
+			lastSuccessfulMetaRequest.RequestTimeout = luaSecondsToDuration(L.CheckNumber(3))
+		case "Timeout":
+			lastSuccessfulMetaRequest.Timeout = luaSecondsToDuration(L.CheckNumber(3))
 		default:
 			return 0
 		}
@@ -207,6 +415,16 @@ func registerMetaSpecType(L *lua.LState) *lua.LTable {
 	funcs := L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
 		"get":          metaSpecGet,
 		"set":          metaSpecSet,
+		"delete":       metaSpecDelete,
+		"patch":        metaSpecPatch,
+		"push":         metaSpecInsertFunction((*MetaSpec).Push),
+		"unshift":      metaSpecInsertFunction((*MetaSpec).Unshift),
+		"pop":          metaSpecRemoveFunction((*MetaSpec).Pop),
+		"shift":        metaSpecRemoveFunction((*MetaSpec).Shift),
+		"query":        metaSpecQuery,
+		"exists":       metaSpecExists,
+		"keys":         metaSpecKeys,
+		"ls":           metaSpecLs,
 		"dump":         metaSpecDump,
 		"undump":       metaSpecUndump,
 		"clone":        metaSpecClone,
@@ -224,6 +442,8 @@ func registerMetaSpecType(L *lua.LState) *lua.LTable {
 			L.Push(lua.LBool(metaSpec.SkipFetchNonexistentExternal))
 		case "MetaFile":
 			L.Push(lua.LString(metaSpec.MetaFile))
+		case "Namespace":
+			L.Push(lua.LString(metaSpec.Namespace))
 		case "JSONValue":
 			L.Push(lua.LBool(metaSpec.JSONValue))
 		case "SkipStoreExternal":
@@ -250,6 +470,8 @@ func registerMetaSpecType(L *lua.LState) *lua.LTable {
 			metaSpec.SkipFetchNonexistentExternal = L.CheckBool(3)
 		case "MetaFile":
 			metaSpec.MetaFile = L.CheckString(3)
+		case "Namespace":
+			metaSpec.Namespace = L.CheckString(3)
 		case "JSONValue":
 			L.ArgError(3, "JSONValue cannot be set")
 			return 0
@@ -297,6 +519,11 @@ func lastSuccessfulMetaRequestClone(L *lua.LState) int {
 	return 1
 }
 
+// luaSecondsToDuration converts a lua number of seconds to a time.Duration
+func luaSecondsToDuration(seconds lua.LNumber) time.Duration {
+	return time.Duration(float64(seconds) * float64(time.Second))
+}
+
 // checkMetaSpec like lua.LState.Check methods, this ensures the args is UserData and casts to *MetaSpec then returns it.
 func checkMetaSpec(L *lua.LState, n int) *MetaSpec {
 	ud := L.CheckUserData(n)
@@ -360,6 +587,16 @@ func (l *LuaSpec) initState(L *lua.LState) error {
 	meta := L.RegisterModule("meta", map[string]lua.LGFunction{
 		"get":          callMethodLGFunction(ud, "get", 1),
 		"set":          callMethodLGFunction(ud, "set", 0),
+		"delete":       callMethodLGFunction(ud, "delete", 0),
+		"patch":        callMethodLGFunction(ud, "patch", 0),
+		"push":         callMethodLGFunction(ud, "push", 0),
+		"unshift":      callMethodLGFunction(ud, "unshift", 0),
+		"pop":          callMethodLGFunction(ud, "pop", 1),
+		"shift":        callMethodLGFunction(ud, "shift", 1),
+		"query":        callMethodLGFunction(ud, "query", 1),
+		"exists":       callMethodLGFunction(ud, "exists", 1),
+		"keys":         callMethodLGFunction(ud, "keys", 1),
+		"ls":           callMethodLGFunction(ud, "ls", 1),
 		"dump":         callMethodLGFunction(ud, "dump", 1),
 		"undump":       callMethodLGFunction(ud, "undump", 0),
 		"clone":        callMethodLGFunction(ud, "clone", 1),
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"os/exec"
 	"strings"
 	"testing"
 
+	"github.com/screwdriver-cd/meta-cli/internal/fetch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -77,6 +79,20 @@ func (s *LuaSuite) TestSetEmptyObjectIsObject() {
 	s.Equal("{}", foo)
 }
 
+func (s *LuaSuite) TestSetCredentialResetsAuthenticator() {
+	for _, field := range []string{"SdToken", "SdTokenFile", "SdAPIKey", "SdAPIURL"} {
+		s.Run(field, func() {
+			request := &s.MetaSpec.LastSuccessfulMetaRequest
+			request.SdAPIKey = "old-key"
+			s.Require().IsType(&fetch.APIKeyExchange{}, request.GetAuthenticator())
+
+			s.LuaSpec.EvaluateString = fmt.Sprintf(`meta.spec.LastSuccessfulMetaRequest.%s = "new"`, field)
+			s.Require().NoError(s.LuaSpec.Do())
+			s.Assert().Nil(request.Authenticator)
+		})
+	}
+}
+
 func (s *LuaSuite) TestCLI() {
 	type testCase struct {
 		name      string
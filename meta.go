@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -14,6 +15,7 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/gofrs/flock"
@@ -26,8 +28,27 @@ import (
 const (
 	defaultMetaFile  = "meta"
 	defaultMetaSpace = "/sd/meta"
+	// namespaceDir is the directory in the meta space of the files of local namespaces
+	namespaceDir = "local"
 )
 
+// Exit codes for errors fetching external meta and for missing keys, so that scripts can branch on them. Other errors
+// exit with 1, or with exitCodeError from commands that exit with 1 for a key that does not exist (e.g. exists).
+const (
+	exitCodeError             = 2
+	exitCodeUnauthorized      = 3
+	exitCodeForbidden         = 4
+	exitCodeJobNotFound       = 5
+	exitCodeNoSuccessfulBuild = 6
+	exitCodeUnavailable       = 7
+	exitCodeBuildNotFound     = 8
+	exitCodeConflict          = 9
+	exitCodeKeyNotFound       = 10
+)
+
+// ErrKeyNotFound is the error when a key that must exist (e.g. with get --fail-missing) does not
+var ErrKeyNotFound = errors.New("key not found")
+
 // These variables get set by the build script via the LDFLAGS
 // Detail about these variables are here: https://goreleaser.com/#builds
 var (
@@ -36,11 +57,10 @@ var (
 	date    = "unknown"
 )
 
-var metaKeyValidator = regexp.MustCompile(`^(\w+([-:]*\w+)*)+(((\[\]|\[(0|[1-9]\d*)\]))?(\.(\w+([-:]*\w+)*)+)*)*$`)
-var rightBracketRegExp = regexp.MustCompile(`\[(.*?)\]`)
+var buildJobNameKeyPath = MustParseKeyPath("build.jobName")
 var isNumberRegExp = regexp.MustCompile(`^[+-]?(?:[0-9]*[.])?[0-9]+$`)
-var metaKeyIsParameterRegExp = regexp.MustCompile(`^parameters(:?\.(.+))?`)
 var parentJobNameRegExp = regexp.MustCompile(`^(PR-\d+:)?(.+)`)
+var namespaceRegExp = regexp.MustCompile(`^[\w-]+$`)
 
 // MetaSpec encapsulates the parameters usually from CLI so they are more readable and shareable than positional params.
 type MetaSpec struct {
@@ -50,6 +70,9 @@ type MetaSpec struct {
 	SkipFetchNonexistentExternal bool
 	// The base name of the meta file (without .json extension)
 	MetaFile string
+	// The name of a local namespace to use instead of the build meta, e.g. scratch for <MetaSpace>/local/scratch.json,
+	// which is never uploaded (the build meta when empty or "meta")
+	Namespace string
 	// When true, treat values (for get and set) as json objects, otherwise set is string, get is value-dependent
 	JSONValue bool
 	// When true, don't save external metadata in the sd key of the local meta.
@@ -58,10 +81,19 @@ type MetaSpec struct {
 	LastSuccessfulMetaRequest fetch.LastSuccessfulMetaRequest
 	// When true, cache external data locally.
 	CacheLocal bool
+	// When true, get with wildcards returns path/value pairs rather than just the values
+	WithPaths bool
+	// The type of values to set (e.g. int), which overrides inferring the type from the value when not empty
+	ValueType string
+	// When true, never infer the type of values to set, so they are strings unless ValueType or JSONValue is set
+	StrictTypes bool
 }
 
 // MetaFilePath returns the absolute path to the meta file.
 func (m *MetaSpec) MetaFilePath() string {
+	if m.IsNamespace() && !m.IsExternal() {
+		return filepath.Join(m.MetaSpace, namespaceDir, m.Namespace+".json")
+	}
 	return filepath.Join(m.MetaSpace, m.MetaFile+".json")
 }
 
@@ -70,17 +102,37 @@ func (m *MetaSpec) IsExternal() bool {
 	return m.MetaFile != defaultMetaFile
 }
 
+// IsNamespace determines whether the meta is that of a local namespace rather than the build meta.
+func (m *MetaSpec) IsNamespace() bool {
+	return m.Namespace != "" && m.Namespace != defaultMetaFile
+}
+
+// checkNamespace returns an error when the local namespace is not a valid name or is used with external meta.
+func (m *MetaSpec) checkNamespace() error {
+	if !m.IsNamespace() {
+		return nil
+	}
+	if m.IsExternal() {
+		return fmt.Errorf("cannot use local meta file %s with external meta %s", m.Namespace, m.MetaFile)
+	}
+	if !namespaceRegExp.MatchString(m.Namespace) {
+		return fmt.Errorf("invalid local meta file name %q; it may only have letters, digits, _ and -", m.Namespace)
+	}
+	return nil
+}
+
 // CloneDefaultMeta returns a copy of |m| with the default meta.
 func (m *MetaSpec) CloneDefaultMeta() *MetaSpec {
 	ret := *m
 	ret.MetaFile = defaultMetaFile
+	ret.Namespace = ""
 	return &ret
 }
 
 // GetExternalData gets external data from meta key, external file, or fetching from lastSuccessfulMeta
 func (m *MetaSpec) GetExternalData() ([]byte, error) {
 	// Get the job description of the external job for looking up or fetching
-	jobDescription, err := fetch.ParseJobDescription(m.LastSuccessfulMetaRequest.DefaultSdPipelineID, m.MetaFile)
+	jobDescription, err := m.LastSuccessfulMetaRequest.ParseJobDescription(m.MetaFile)
 	if err != nil {
 		return nil, err
 	}
@@ -108,18 +160,18 @@ func (m *MetaSpec) GetExternalData() ([]byte, error) {
 			return []byte("{}"), nil
 		}
 		logrus.Debugf("%s doesn't exist; fetching metadata from %s", metaFilePath, jobDescription.External())
-		if metaData, err = m.LastSuccessfulMetaRequest.FetchLastSuccessfulMeta(jobDescription); err != nil {
+		if metaData, err = m.LastSuccessfulMetaRequest.FetchMeta(jobDescription); err != nil {
 			return nil, err
 		}
 	}
 
 	// Delete the sd from the external meta
 	logrus.Tracef("Deleting sd key from incoming metadata %s", string(metaData))
-	var unmarshaledMetaData map[string]json.RawMessage
-	if err = json.Unmarshal(metaData, &unmarshaledMetaData); err != nil {
+	unmarshaledMetaData, err := decodeMetaObject(metaData)
+	if err != nil {
 		return nil, err
 	}
-	delete(unmarshaledMetaData, "sd")
+	unmarshaledMetaData.Delete("sd")
 	if metaData, err = json.Marshal(unmarshaledMetaData); err != nil {
 		return nil, err
 	}
@@ -136,14 +188,14 @@ func (m *MetaSpec) GetExternalData() ([]byte, error) {
 	return metaData, nil
 }
 
-// SetupDir creates the metaspace directory and writes a file with empty object.
+// SetupDir creates the metaspace directory (of the meta file) and writes a file with empty object.
 func (m *MetaSpec) SetupDir() ([]byte, error) {
-	err := os.MkdirAll(m.MetaSpace, 0777)
+	err := os.MkdirAll(filepath.Dir(m.MetaFilePath()), 0777)
 	if err != nil {
 		return nil, err
 	}
 	data := []byte("{}")
-	err = ioutil.WriteFile(m.MetaFilePath(), data, 0666)
+	err = writeMetaFile(m.MetaFilePath(), data)
 	if err != nil {
 		return nil, err
 	}
@@ -152,9 +204,12 @@ func (m *MetaSpec) SetupDir() ([]byte, error) {
 
 // GetFileData gets the data from file, setting up file with empty json object if empty.
 func (m *MetaSpec) GetFileData() ([]byte, error) {
+	if err := m.checkNamespace(); err != nil {
+		return nil, err
+	}
 	metaFilePath := m.MetaFilePath()
 	logrus.Tracef("Reading file %v", metaFilePath)
-	data, err := ioutil.ReadFile(metaFilePath)
+	data, err := readMetaFile(metaFilePath)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return nil, err
@@ -166,6 +221,9 @@ func (m *MetaSpec) GetFileData() ([]byte, error) {
 
 // GetData gets either external or default meta data
 func (m *MetaSpec) GetData() ([]byte, error) {
+	if err := m.checkNamespace(); err != nil {
+		return nil, err
+	}
 	if m.IsExternal() {
 		return m.GetExternalData()
 	}
@@ -174,48 +232,59 @@ func (m *MetaSpec) GetData() ([]byte, error) {
 
 // CachedGet tries local first, then external and store external result locally.
 func (m *MetaSpec) CachedGet(key string) (string, error) {
+	s, _, err := m.cachedLookup(key)
+	return s, err
+}
+
+// cachedLookup is like CachedGet, but also reports whether the key exists, as in Lookup.
+func (m *MetaSpec) cachedLookup(key string) (string, bool, error) {
 	// First try the local meta without caching
 	logrus.Debugf("Checking local meta for key %s", key)
 	localClone := m.CloneDefaultMeta()
 	localClone.CacheLocal = false
 	s, err := localClone.Get(key)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	if s != "null" {
 		logrus.Debugf("Found local meta for key %s: %s", key, s)
-		return s, nil
+		return s, true, nil
 	}
 
 	// If not in local meta, then fetch normally, also without caching, re-enabling cache after invocation.
 	logrus.Debugf("Reading external meta for key %s", key)
 	m.CacheLocal = false
 	defer func() { m.CacheLocal = true }()
-	if s, err = m.Get(key); err != nil {
-		return "", err
+	s, found, err := m.Lookup(key)
+	if err != nil {
+		return "", false, err
 	}
 
 	// Now store the meta locally to cache it and return result.
 	logrus.Debugf("Storing local meta for key %s: %s", key, s)
 	if err = localClone.Set(key, s); err != nil {
-		return "", err
+		return "", false, err
 	}
-	return s, nil
+	return s, found, nil
 }
 
 // copyParamValuesIntoMap Copies only param values from src into dst (values with "value" field of type string)
-func copyParamValuesIntoMap(dst map[string]interface{}, src interface{}) {
+func copyParamValuesIntoMap(dst *orderedObject, src interface{}) {
 	// nil is empty map, just bail with log
 	if src == nil {
 		logrus.Debugf("src is nil; no work to do")
 		return
 	}
-	// convert the interface to a map type to walk its keys/values
-	if srcMap := convertInterfaceToMap(src); srcMap != nil {
-		for k, v := range srcMap {
-			_, value := fetchMetaValue("value", v)
+	// convert the interface to an object to walk its keys/values
+	if srcObject := convertInterfaceToObject(src); srcObject != nil {
+		for _, k := range srcObject.Keys() {
+			v, _ := srcObject.Get(k)
+			var value interface{}
+			if valueObject := convertInterfaceToObject(v); valueObject != nil {
+				value, _ = valueObject.Get("value")
+			}
 			if _, ok := value.(string); ok {
-				dst[k] = v
+				dst.Set(k, v)
 			} else {
 				logrus.Tracef("value for key %s is of type %T; skipping", k, value)
 			}
@@ -227,23 +296,28 @@ func copyParamValuesIntoMap(dst map[string]interface{}, src interface{}) {
 }
 
 // cleanParameters copies keys with values (not job keys) are copied and overrides the current job's params, if any.
-func cleanParameters(metaInterface map[string]interface{}) (map[string]interface{}, error) {
+func cleanParameters(metaInterface *orderedObject) (*orderedObject, error) {
 	// Ensure paramters exist; otherwise warn and return without error
-	_, parameters := fetchMetaValue("parameters", metaInterface)
+	parameters, _ := metaInterface.Get("parameters")
 	if parameters == nil {
 		logrus.Warnf("No parameters")
 		return nil, nil
 	}
 	// Copy values that have a value of type string (filter out the job-specific values)
-	ret := make(map[string]interface{})
+	ret := newOrderedObject()
 	copyParamValuesIntoMap(ret, parameters)
 
 	// Override the values with job-specific ones for this jobName
-	_, buildJobName := fetchMetaValue("build.jobName", metaInterface)
+	buildJobName := buildJobNameKeyPath.Get(metaInterface)
 	if jobName, ok := buildJobName.(string); ok {
 		if jobRE := parentJobNameRegExp.FindStringSubmatch(jobName); jobRE != nil {
 			jobName = jobRE[2]
-			if _, jobParameters := fetchMetaValue(jobName, parameters); jobParameters != nil {
+			// Job names may contain dots, so look them up directly rather than as a key path
+			var jobParameters interface{}
+			if parametersObject := convertInterfaceToObject(parameters); parametersObject != nil {
+				jobParameters, _ = parametersObject.Get(jobName)
+			}
+			if jobParameters != nil {
 				copyParamValuesIntoMap(ret, jobParameters)
 			} else {
 				logrus.Tracef("No jobParameters for jobName: %s", jobName)
@@ -253,41 +327,94 @@ func cleanParameters(metaInterface map[string]interface{}) (map[string]interface
 	return ret, nil
 }
 
-// Get gets metadata for the given key
+// Get gets metadata for the given key. Keys with wildcards get a json array of the matches.
 func (m *MetaSpec) Get(key string) (string, error) {
-	if m.CacheLocal && m.IsExternal() {
-		return m.CachedGet(key)
+	s, _, err := m.Lookup(key)
+	return s, err
+}
+
+// Lookup is like Get, but also reports whether the key exists, so that a key that does not exist can be told apart
+// from one that is null. Keys with wildcards exist when they match any keys.
+func (m *MetaSpec) Lookup(key string) (string, bool, error) {
+	keyPath, err := ParseKeyPath(key)
+	if err != nil {
+		return "", false, err
+	}
+	// Queries may match many keys, so they are not cached locally
+	if m.CacheLocal && m.IsExternal() && !keyPath.IsQuery() {
+		return m.cachedLookup(key)
+	}
+
+	metaInterface, err := m.lookupMeta(keyPath)
+	if err != nil {
+		return "", false, err
 	}
 
+	// fetch the key from the resulting interface and return the string result corresponding to the json flag
+	var result interface{}
+	var found bool
+	if keyPath.IsQuery() {
+		matches := keyPath.Query(metaInterface)
+		result, found = m.queryResult(matches), len(matches) != 0
+	} else {
+		result, found = keyPath.Lookup(metaInterface)
+	}
+	s, err := formatMetaValueForGet(result, m.JSONValue)
+	return s, found, err
+}
+
+// lookupMeta gets the decoded meta to look up the key path in, which has the cleaned parameters in place of the
+// parameters when the key path is under them.
+func (m *MetaSpec) lookupMeta(keyPath *KeyPath) (*orderedObject, error) {
 	metaJSON, err := m.GetData()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var metaInterface map[string]interface{}
-	// for Unmarshal integer as integer, not float64
-	decoder := json.NewDecoder(bytes.NewReader(metaJSON))
-	decoder.UseNumber()
-	err = decoder.Decode(&metaInterface)
+	// Decode integers as integers, not float64, and keep the order of keys
+	metaInterface, err := decodeMetaObject(metaJSON)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Adjust the metaInterface and key to the cleaned parameters and subkey and fall through to normal return
-	if metaKeyIsParameterRegExp.MatchString(key) {
-		// Fetch and clean the parameters from the metaInterface
-		metaInterface, err = cleanParameters(metaInterface)
-		if err != nil {
-			return "", err
+	// Adjust the metaInterface to the cleaned parameters
+	if len(keyPath.Segments) != 0 {
+		if firstSegment := keyPath.Segments[0]; firstSegment.Type == KeyPathName && firstSegment.Name == "parameters" {
+			// Fetch and clean the parameters from the metaInterface
+			parameters, err := cleanParameters(metaInterface)
+			if err != nil {
+				return nil, err
+			}
+			metaInterface = newOrderedObject()
+			if parameters != nil {
+				metaInterface.Set("parameters", parameters)
+			}
 		}
-		// Adjust the key to be relative to parameters
-		paramRE := metaKeyIsParameterRegExp.FindStringSubmatch(key)
-		key = paramRE[1]
 	}
+	return metaInterface, nil
+}
 
-	// fetch the key from the resulting interface and return the string result corresponding to the json flag
-	_, result := fetchMetaValue(key, metaInterface)
-	return formatMetaValueForGet(result, m.JSONValue)
+// Exists determines whether the key exists in the meta, even when its value is null. Keys with wildcards exist when
+// they match any keys.
+func (m *MetaSpec) Exists(key string) (bool, error) {
+	_, found, err := m.Lookup(key)
+	return found, err
+}
+
+// queryResult converts the matches of a query to the values, or the path/value pairs when WithPaths is set.
+func (m *MetaSpec) queryResult(matches []KeyPathMatch) []interface{} {
+	result := make([]interface{}, 0, len(matches))
+	for _, match := range matches {
+		if m.WithPaths {
+			pathValue := newOrderedObject()
+			pathValue.Set("path", match.Path.Key)
+			pathValue.Set("value", match.Value)
+			result = append(result, pathValue)
+		} else {
+			result = append(result, match.Value)
+		}
+	}
+	return result
 }
 
 // Set sets metadata for the given key to the given value
@@ -295,140 +422,209 @@ func (m *MetaSpec) Set(key string, value string) error {
 	if m.IsExternal() {
 		return errors.New("can only meta set current build meta")
 	}
-	metaFilePath := m.MetaFilePath()
-	var previousMeta map[string]interface{}
+	keyPath, err := ParseKeyPath(key)
+	if err != nil {
+		return err
+	}
+	parsedValue, err := m.parseValue(value)
+	if err != nil {
+		return fmt.Errorf("cannot set %s; %v", key, err)
+	}
+	previousMeta, err := m.readMetaForUpdate()
+	if err != nil {
+		return err
+	}
 
-	metaJSON, err := ioutil.ReadFile(metaFilePath)
-	// Not exist directory
+	updatedMeta, err := keyPath.Set(previousMeta, parsedValue)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-		_, err := m.SetupDir()
-		if err != nil {
-			return err
-		}
-		// Initialize interface if first setting meta
-		previousMeta = make(map[string]interface{})
-	} else {
-		// Exist meta.json
-		if len(metaJSON) != 0 {
-			err = json.Unmarshal(metaJSON, &previousMeta)
-			if err != nil {
-				return err
-			}
-		} else {
-			// Exist meta.json but it is empty
-			previousMeta = make(map[string]interface{})
-		}
+		return fmt.Errorf("cannot set %s; %v", key, err)
 	}
 
-	key, parsedValue := setMetaValueRecursive(key, value, previousMeta, m.JSONValue)
-	previousMeta[key] = parsedValue
+	// Key paths always start with a name, so the updated meta is an object
+	return m.writeMeta(updatedMeta.(*orderedObject))
+}
 
-	resultJSON, err := json.Marshal(previousMeta)
+// Delete removes the given key from the metadata; array elements are spliced out rather than set to null.
+func (m *MetaSpec) Delete(key string) error {
+	if m.IsExternal() {
+		return errors.New("can only meta delete current build meta")
+	}
+	keyPath, err := ParseKeyPath(key)
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(metaFilePath, resultJSON, 0666)
+	if err = keyPath.CheckElement(); err != nil {
+		return fmt.Errorf("cannot delete %s; %v", key, err)
+	}
+	previousMeta, err := m.readMetaForUpdate()
 	if err != nil {
 		return err
 	}
-	return nil
+
+	updatedMeta, deleted := keyPath.Delete(previousMeta)
+	if !deleted {
+		logrus.Debugf("Key %s does not exist; nothing to delete", key)
+		return nil
+	}
+
+	return m.writeMeta(updatedMeta.(*orderedObject))
+}
+
+// Push appends the value to the array at key, creating the array if the key does not exist.
+func (m *MetaSpec) Push(key string, value string) error {
+	return m.insertMetaArrayValue("push", key, value, true)
+}
+
+// Unshift prepends the value to the array at key, creating the array if the key does not exist.
+func (m *MetaSpec) Unshift(key string, value string) error {
+	return m.insertMetaArrayValue("unshift", key, value, false)
+}
+
+// Pop removes the last element of the array at key and returns it formatted as in Get ("null" when empty).
+func (m *MetaSpec) Pop(key string) (string, error) {
+	return m.removeMetaArrayValue("pop", key, true)
 }
 
-// indexOfFirstRightBracket gets index of right bracket("]"). e.g. the key is foo[10].bar[4], return 6
-func indexOfFirstRightBracket(key string) int {
-	return (rightBracketRegExp.FindStringIndex(key)[1] - 1)
+// Shift removes the first element of the array at key and returns it formatted as in Get ("null" when empty).
+func (m *MetaSpec) Shift(key string) (string, error) {
+	return m.removeMetaArrayValue("shift", key, false)
 }
 
-// metaIndexFromKey gets number in brackets. e.g. the key is foo[10].bar[4], return 10
-func metaIndexFromKey(key string) int {
-	indexString := rightBracketRegExp.FindStringSubmatch(key)[1]
-	index, err := strconv.Atoi(indexString)
+// insertMetaArrayValue parses the value and inserts it at the end (or start) of the array at key.
+func (m *MetaSpec) insertMetaArrayValue(operation string, key string, value string, atEnd bool) error {
+	parsedValue, err := m.parseValue(value)
 	if err != nil {
-		return 0
+		return fmt.Errorf("cannot %s %s; %v", operation, key, err)
 	}
-	return index
+	return m.updateMetaArray(operation, key, func(metaSlice []interface{}) ([]interface{}, bool) {
+		if atEnd {
+			return append(metaSlice, parsedValue), true
+		}
+		return append([]interface{}{parsedValue}, metaSlice...), true
+	})
 }
 
-// convertInterfaceToMap converts interface{} to map[string]interface{} via Value
-func convertInterfaceToMap(metaInterface interface{}) map[string]interface{} {
-	metaValue := reflect.ValueOf(metaInterface)
-	if metaValue.Kind() != reflect.Map {
-		return nil
-	}
-	metaMap := make(map[string]interface{})
-	for _, keyValue := range metaValue.MapKeys() {
-		keyString, _ := keyValue.Interface().(string)
-		metaMap[keyString] = metaValue.MapIndex(keyValue).Interface()
+// removeMetaArrayValue removes the value at the end (or start) of the array at key and returns it formatted for get.
+func (m *MetaSpec) removeMetaArrayValue(operation string, key string, atEnd bool) (string, error) {
+	var removed interface{}
+	err := m.updateMetaArray(operation, key, func(metaSlice []interface{}) ([]interface{}, bool) {
+		if len(metaSlice) == 0 {
+			return metaSlice, false
+		}
+		if atEnd {
+			removed = metaSlice[len(metaSlice)-1]
+			return metaSlice[:len(metaSlice)-1], true
+		}
+		removed = metaSlice[0]
+		return metaSlice[1:], true
+	})
+	if err != nil {
+		return "", err
 	}
-	return metaMap
+	return formatMetaValueForGet(removed, m.JSONValue)
 }
 
-// convertInterfaceToSlice converts interface{} to []interface{} via Value
-func convertInterfaceToSlice(metaInterface interface{}) []interface{} {
-	metaValue := reflect.ValueOf(metaInterface)
-	metaSlice := make([]interface{}, metaValue.Len())
-	if metaValue.Kind() == reflect.Slice {
-		for i := 0; i < metaValue.Len(); i++ {
-			metaSlice[i] = metaValue.Index(i).Interface()
+// updateMetaArray reads the local meta, passes the array at key (nil when it does not exist) to update and writes
+// the returned array back when update reports a change. It is an error for the existing value to be a non-array.
+func (m *MetaSpec) updateMetaArray(operation string, key string,
+	update func(metaSlice []interface{}) ([]interface{}, bool)) error {
+	if m.IsExternal() {
+		return fmt.Errorf("can only meta %s current build meta", operation)
+	}
+	keyPath, err := ParseKeyPath(key)
+	if err != nil {
+		return err
+	}
+	if err = keyPath.CheckElement(); err != nil {
+		return fmt.Errorf("cannot %s %s; %v", operation, key, err)
+	}
+	previousMeta, err := m.readMetaForUpdate()
+	if err != nil {
+		return err
+	}
+
+	var metaSlice []interface{}
+	if current := keyPath.Get(previousMeta); current != nil {
+		if metaSlice = convertInterfaceToSlice(current); metaSlice == nil {
+			return fmt.Errorf("cannot %s %s; value is %T, not an array", operation, key, current)
 		}
-	} else {
+	}
+	metaSlice, changed := update(metaSlice)
+	if !changed {
 		return nil
 	}
-	return metaSlice
-}
 
-// fetchMetaValue fetches value from meta by using key
-func fetchMetaValue(key string, meta interface{}) (string, interface{}) {
-	var result interface{}
-	for current, char := range key {
-		if string([]rune{char}) == "[" {
-			// Value is array with index
-			rightBracket := indexOfFirstRightBracket(key)
-			metaIndex := metaIndexFromKey(key) // e.g. if key is foo[10], get "10"
-			shortenKey := key[rightBracket+1:] // e.g. foo[10].bar -> .bar
-			metaMap := convertInterfaceToMap(meta)
-			if metaMap == nil {
-				return "", nil
-			}
+	updatedMeta, err := keyPath.Set(previousMeta, metaSlice)
+	if err != nil {
+		return fmt.Errorf("cannot %s %s; %v", operation, key, err)
+	}
 
-			childMeta := metaMap[key[0:current]]
-			childMetaSlice := convertInterfaceToSlice(childMeta)
-			if childMetaSlice == nil {
-				return "", nil
-			}
-			return fetchMetaValue(shortenKey, childMetaSlice[metaIndex])
-		} else if string([]rune{char}) == "." {
-			// Value is object
-			childKey := strings.Split(key, ".")[0]                       // e.g. foo.bar.baz -> foo
-			shortenKey := strings.Join(strings.Split(key, ".")[1:], ".") // e.g. foo.bar.baz -> bar.baz
-			metaMap := convertInterfaceToMap(meta)
-			if metaMap == nil {
-				return "", nil
-			}
-			if len(childKey) != 0 {
-				return fetchMetaValue(shortenKey, metaMap[childKey])
-			}
-			return fetchMetaValue(shortenKey, metaMap)
+	return m.writeMeta(updatedMeta.(*orderedObject))
+}
+
+// readMetaForUpdate reads the local meta file for modification, setting up the directory if it does not exist.
+func (m *MetaSpec) readMetaForUpdate() (*orderedObject, error) {
+	if err := m.checkNamespace(); err != nil {
+		return nil, err
+	}
+	metaJSON, err := readMetaFile(m.MetaFilePath())
+	// Not exist directory
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
 		}
+		if _, err := m.SetupDir(); err != nil {
+			return nil, err
+		}
+		return newOrderedObject(), nil
 	}
-	if len(key) != 0 {
-		// convert type interface -> Value -> map[string]interface{}
-		var metaMap map[string]interface{} = convertInterfaceToMap(meta)
-		result = metaMap[key]
-	} else {
-		result = meta
+
+	// Decode numbers as json.Number and keep the order of keys so that they are written back exactly
+	return decodeMetaObject(metaJSON)
+}
+
+// decodeMetaObject decodes the meta json object, keeping numbers and the order of keys. json null is an empty object.
+func decodeMetaObject(metaJSON []byte) (*orderedObject, error) {
+	meta, err := decodeOrderedJSON(metaJSON)
+	if err != nil {
+		return nil, err
 	}
+	if meta == nil {
+		return newOrderedObject(), nil
+	}
+	metaObject, ok := meta.(*orderedObject)
+	if !ok {
+		return nil, fmt.Errorf("meta is %T, not a json object", meta)
+	}
+	return metaObject, nil
+}
 
-	return key, result
+// writeMeta writes the meta as json to the local meta file.
+func (m *MetaSpec) writeMeta(meta *orderedObject) error {
+	resultJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeMetaFile(m.MetaFilePath(), resultJSON)
+}
+
+// convertInterfaceToSlice converts interface{} to []interface{} via Value
+func convertInterfaceToSlice(metaInterface interface{}) []interface{} {
+	metaValue := reflect.ValueOf(metaInterface)
+	if metaValue.Kind() != reflect.Slice {
+		return nil
+	}
+	metaSlice := make([]interface{}, metaValue.Len())
+	for i := 0; i < metaValue.Len(); i++ {
+		metaSlice[i] = metaValue.Index(i).Interface()
+	}
+	return metaSlice
 }
 
 // format meta value based on the type
 func formatMetaValueForGet(result interface{}, jsonValue bool) (string, error) {
 	switch result.(type) {
-	case map[string]interface{}, []interface{}:
+	case *orderedObject, map[string]interface{}, []interface{}:
 		resultJSON, _ := json.Marshal(result)
 		return fmt.Sprintf("%v", string(resultJSON)), nil
 	case nil:
@@ -442,79 +638,12 @@ func formatMetaValueForGet(result interface{}, jsonValue bool) (string, error) {
 	}
 }
 
-// setMetaValueRecursive updates meta
-func setMetaValueRecursive(key string, value string, previousMeta interface{}, jsonValue bool) (string, interface{}) {
-	for current, char := range key {
-		if string([]rune{char}) == "[" {
-			nextChar := key[current+1]
-			if nextChar == []byte("]")[0] {
-				// Value is array
-				var metaValue [1]interface{}
-				key = key[0:current] + key[current+2:] // Remove bracket[] from key
-				key, metaValue[0] = setMetaValueRecursive(key, value, previousMeta, jsonValue)
-				return key, metaValue
-			}
-
-			// Value is array with index
-			rightBracket := indexOfFirstRightBracket(key)
-			metaIndex := metaIndexFromKey(key)   // e.g. if key is foo[10], get "10"
-			keyHead := key[0:current]            // e.g. foo[10].bar -> foo
-			key = keyHead + key[rightBracket+1:] // Remove bracket and number from key. e.g. foo[10].bar -> foo.bar
-
-			previousMetaMap := convertInterfaceToMap(previousMeta)
-			previousMetaValue := reflect.ValueOf(previousMetaMap[keyHead])
-			var metaValue []interface{}
-
-			// previousMetaMap[keyHead] is empty or string, create array with null except value of argument
-			if previousMetaMap[keyHead] == nil || reflect.ValueOf(previousMetaMap[keyHead]).Kind() == reflect.String {
-				metaValue = make([]interface{}, metaIndex+1)
-				key, metaValue[metaIndex] = setMetaValueRecursive(key, value, previousMetaMap[keyHead], jsonValue)
-			} else {
-				if metaIndex+1 > previousMetaValue.Len() {
-					metaValue = make([]interface{}, metaIndex+1)
-					key, metaValue[metaIndex] = setMetaValueRecursive(key, value, nil, jsonValue)
-				} else {
-					metaValue = make([]interface{}, previousMetaValue.Len())
-					key, metaValue[metaIndex] = setMetaValueRecursive(key, value, previousMetaValue.Index(metaIndex).Interface(), jsonValue)
-				}
-			}
-			// Insert previous values to metaValue[] when previousMetaValue type is slice except new value
-			if previousMetaValue.Kind() == reflect.Slice {
-				for i := 0; i < previousMetaValue.Len(); i++ {
-					if i != metaIndex {
-						metaValue[i] = previousMetaValue.Index(i).Interface()
-					}
-				}
-			}
-			return key, metaValue
-		} else if string([]rune{char}) == "." {
-			// Value is object
-			keyHead := key[0:current]   // e.g. aaa.bbb -> aaa
-			childKey := key[current+1:] // e.g. aaa.bbb -> bbb
-			obj := make(map[string]interface{})
-			var tmpValue interface{}
-			previousMetaMap := convertInterfaceToMap(previousMeta)
-			if previousMetaMap[keyHead] == nil {
-				childKey, tmpValue = setMetaValueRecursive(childKey, value, previousMetaMap, jsonValue)
-			} else {
-				// copy previous object only if it is map
-				previousObj := convertInterfaceToMap(previousMetaMap[keyHead])
-				if len(previousObj) != 0 {
-					obj = previousObj
-				}
-				childKey, tmpValue = setMetaValueRecursive(childKey, value, previousMetaMap[keyHead], jsonValue)
-			}
-			obj[childKey] = tmpValue
-			return keyHead, obj
-		}
-	}
+// parseMetaValue converts the value from the CLI to the value stored in meta. When jsonValue is true, the value is
+// parsed as json; otherwise numbers and bools are inferred and anything else is a string. Numbers that do not fit an
+// int are kept exactly as written when they are valid json numbers.
+func parseMetaValue(value string, jsonValue bool) (interface{}, error) {
 	if jsonValue {
-		var objectValue interface{}
-		err := json.Unmarshal([]byte(value), &objectValue)
-		if err != nil {
-			logrus.Panic(err)
-		}
-		return key, objectValue
+		return decodeOrderedJSON([]byte(value))
 	}
 
 	// Value is number
@@ -523,28 +652,34 @@ func setMetaValueRecursive(key string, value string, previousMeta interface{}, j
 		// Value is int
 		i, err := strconv.Atoi(value)
 		if err == nil {
-			return key, i
+			return i, nil
+		}
+
+		// Value is a big int or decimal that json can represent exactly, e.g. 12345678901234567890 or 1.10
+		if isJSONNumber(value) {
+			return json.Number(value), nil
 		}
 
 		// Value is float
 		f, err := strconv.ParseFloat(value, 64)
 		if err == nil {
-			return key, f
+			return f, nil
 		}
 	}
 
 	// Value is bool
 	b, err := strconv.ParseBool(value)
 	if err == nil {
-		return key, b
+		return b, nil
 	}
 	// Value is string
-	return key, value
+	return value, nil
 }
 
 // validateMetaKey validates the key of argument
-func validateMetaKey(key string) bool {
-	return metaKeyValidator.MatchString(key)
+func validateMetaKey(key string) error {
+	_, err := ParseKeyPath(key)
+	return err
 }
 
 // successExit exits process with 0
@@ -552,12 +687,77 @@ func successExit() {
 	os.Exit(0)
 }
 
-// failureExit exits process with 1
+// failureExit exits process with the exit code for err
 func failureExit(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 	}
-	os.Exit(1)
+	os.Exit(exitCode(err))
+}
+
+// lookupFailureExit exits process like failureExit, but with the exit code for err from lookupExitCode
+func lookupFailureExit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+	os.Exit(lookupExitCode(err))
+}
+
+// lookupExitCode returns the exit code for err as in exitCode, but with exitCodeError rather than 1, so that errors
+// can be told apart from keys that do not exist.
+func lookupExitCode(err error) int {
+	if code := exitCode(err); code != 1 {
+		return code
+	}
+	return exitCodeError
+}
+
+// exitCode returns the exit code for err, which is 1 unless it is one of the fetch errors with its own exit code.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, fetch.ErrUnauthorized):
+		return exitCodeUnauthorized
+	case errors.Is(err, fetch.ErrForbidden):
+		return exitCodeForbidden
+	case errors.Is(err, fetch.ErrJobNotFound):
+		return exitCodeJobNotFound
+	case errors.Is(err, fetch.ErrNoSuccessfulBuild):
+		return exitCodeNoSuccessfulBuild
+	case errors.Is(err, fetch.ErrUnavailable):
+		return exitCodeUnavailable
+	case errors.Is(err, fetch.ErrBuildNotFound):
+		return exitCodeBuildNotFound
+	case errors.Is(err, fetch.ErrConflict):
+		return exitCodeConflict
+	case errors.Is(err, ErrKeyNotFound):
+		return exitCodeKeyNotFound
+	default:
+		return 1
+	}
+}
+
+// writeCacheEntries writes the cache entries as a table to w.
+func writeCacheEntries(w io.Writer, entries []fetch.CacheEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "EXTERNAL\tSIZE\tAGE\tSTATUS")
+	for _, entry := range entries {
+		status := "fresh"
+		if entry.Expired {
+			status = "expired"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%v\t%s\n", entry.External, entry.Size,
+			time.Since(entry.ModTime).Round(time.Second), status)
+	}
+	return tw.Flush()
+}
+
+// writeMetaEntries writes the meta entries as a table to w.
+func writeMetaEntries(w io.Writer, entries []MetaEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, entry := range entries {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\n", entry.Path, entry.Type)
+	}
+	return tw.Flush()
 }
 
 // finalRecover makes one last attempt to recover from a panic.
@@ -580,11 +780,28 @@ func main() {
 		SkipFetchNonexistentExternal: false,
 		MetaFile:                     defaultMetaFile,
 		JSONValue:                    false,
+		LastSuccessfulMetaRequest: fetch.LastSuccessfulMetaRequest{
+			Cache: &fetch.Cache{},
+		},
 	}
 	luaSpec := LuaSpec{
 		MetaSpec: &metaSpec,
 	}
 	loglevel := logrus.GetLevel().String()
+	var query string
+	var buildID int64
+	var force, dryRun bool
+	var fixtures, recordFixtures string
+	mockServer := fetch.MockServer{}
+	var listen string
+	var recursive, jsonOutput bool
+	var failMissing bool
+	valueTypeFlags := map[string]*bool{
+		valueTypeString: new(bool),
+		valueTypeInt:    new(bool),
+		valueTypeFloat:  new(bool),
+		valueTypeBool:   new(bool),
+	}
 
 	app := cli.NewApp()
 	app.Name = "meta-cli"
@@ -612,6 +829,11 @@ func main() {
 		Value:       defaultMetaFile,
 		Destination: &metaSpec.MetaFile,
 	}
+	namespaceFlag := cli.StringFlag{
+		Name:        "file, f",
+		Usage:       "Use the local meta file (namespace) with this name rather than the build meta; it is never uploaded",
+		Destination: &metaSpec.Namespace,
+	}
 	skipFetchNonexistentExternalFlag := cli.BoolFlag{
 		Name:        "skip-fetch, F",
 		Usage:       `Used with --external to skip fetching from lastSuccessfulMeta when not triggered by external job`,
@@ -639,6 +861,18 @@ func main() {
 		EnvVar:      "SD_TOKEN",
 		Destination: &metaSpec.LastSuccessfulMetaRequest.SdToken,
 	}
+	sdTokenFileFlag := cli.StringFlag{
+		Name:        "sd-token-file",
+		Usage:       "Set a file to read the token from for each SD API call, so that it may be rotated",
+		EnvVar:      "SD_TOKEN_FILE",
+		Destination: &metaSpec.LastSuccessfulMetaRequest.SdTokenFile,
+	}
+	sdAPIKeyFlag := cli.StringFlag{
+		Name:        "sd-api-key",
+		Usage:       "Set a user API key to exchange for a token, which is refreshed when it expires or is rejected",
+		EnvVar:      "SD_API_KEY",
+		Destination: &metaSpec.LastSuccessfulMetaRequest.SdAPIKey,
+	}
 	sdAPIURLFlag := cli.StringFlag{
 		Name:        "sd-api-url, u",
 		Usage:       "Set the SD_API_URL to use in SD API calls",
@@ -652,12 +886,157 @@ func main() {
 		EnvVar:      "SD_PIPELINE_ID",
 		Destination: &metaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID,
 	}
+	sdPullRequestFlag := cli.StringFlag{
+		Name:        "sd-pull-request",
+		Usage:       "Set the SD_PULL_REQUEST of a PR build, whose externals without sd@pipelineId: are its PR jobs",
+		EnvVar:      "SD_PULL_REQUEST",
+		Destination: &metaSpec.LastSuccessfulMetaRequest.DefaultPullRequest,
+	}
+	sdBuildIDFlag := cli.Int64Flag{
+		Name:        "sd-build-id",
+		Usage:       "Set the SD_BUILD_ID of the build to write the meta to",
+		EnvVar:      "SD_BUILD_ID",
+		Destination: &buildID,
+	}
+	forceFlag := cli.BoolFlag{
+		Name:        "force",
+		Usage:       "Write the meta even when the meta of the build was changed since it was last synced",
+		Destination: &force,
+	}
+	dryRunFlag := cli.BoolFlag{
+		Name:        "dry-run",
+		Usage:       "Check for conflicts and print the meta that would be written without writing it",
+		Destination: &dryRun,
+	}
+	fetchRetriesFlag := cli.IntFlag{
+		Name:        "fetch-retries",
+		Usage:       "Set the number of times to retry SD API calls after network errors or 5xx responses",
+		EnvVar:      "SD_META_FETCH_RETRIES",
+		Value:       3,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Retries,
+	}
+	fetchTimeoutFlag := cli.DurationFlag{
+		Name:        "fetch-timeout",
+		Usage:       "Set the timeout of each SD API call (0 for none)",
+		EnvVar:      "SD_META_FETCH_TIMEOUT",
+		Value:       30 * time.Second,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.RequestTimeout,
+	}
+	fetchDeadlineFlag := cli.DurationFlag{
+		Name:        "fetch-deadline",
+		Usage:       "Set the deadline for fetching external meta, including all retries (0 for none)",
+		EnvVar:      "SD_META_FETCH_DEADLINE",
+		Value:       2 * time.Minute,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Timeout,
+	}
+	fetchParallelismFlag := cli.IntFlag{
+		Name:        "parallel",
+		Usage:       "Set the number of external metas to fetch at once",
+		EnvVar:      "SD_META_FETCH_PARALLELISM",
+		Value:       fetch.DefaultParallelism,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Parallelism,
+	}
+	cacheDirFlag := cli.StringFlag{
+		Name:        "cache-dir",
+		Usage:       "Set the directory to cache external meta in, which may be shared by builds (caching is off when empty)",
+		EnvVar:      "SD_META_CACHE_DIR",
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Cache.Dir,
+	}
+	cacheTTLFlag := cli.DurationFlag{
+		Name:        "cache-ttl",
+		Usage:       "Set how long cached external meta is used after it is fetched (0 for forever)",
+		EnvVar:      "SD_META_CACHE_TTL",
+		Value:       time.Hour,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Cache.TTL,
+	}
+	cacheMaxSizeFlag := cli.Int64Flag{
+		Name:        "cache-max-size",
+		Usage:       "Set the size in bytes to prune the cache to, removing the oldest entries first (0 for no limit)",
+		EnvVar:      "SD_META_CACHE_MAX_SIZE",
+		Value:       100 << 20,
+		Destination: &metaSpec.LastSuccessfulMetaRequest.Cache.MaxSize,
+	}
+	fixturesFlag := cli.StringFlag{
+		Name:        "fixtures",
+		Usage:       "Replay SD API responses from a directory of fixtures or a HAR file instead of calling the SD API",
+		EnvVar:      "SD_META_FIXTURES",
+		Destination: &fixtures,
+	}
+	recordFixturesFlag := cli.StringFlag{
+		Name:        "record-fixtures",
+		Usage:       "Record the SD API responses in a directory of fixtures for --fixtures",
+		EnvVar:      "SD_META_RECORD_FIXTURES",
+		Destination: &recordFixtures,
+	}
+	listenFlag := cli.StringFlag{
+		Name:        "listen",
+		Usage:       "Set the address for the mock server to listen on",
+		Value:       "localhost:8080",
+		Destination: &listen,
+	}
+	mockTokenFlag := cli.StringFlag{
+		Name:        "token",
+		Usage:       "Set the token that requests to the mock server must have (any token is accepted when empty)",
+		Destination: &mockServer.Token,
+	}
+	failMissingFlag := cli.BoolFlag{
+		Name:        "fail-missing",
+		Usage:       "Exit with 10 when the key does not exist (or the query matches nothing), and 2 on errors",
+		Destination: &failMissing,
+	}
+	recursiveFlag := cli.BoolFlag{
+		Name:        "recursive, R",
+		Usage:       "List every leaf path below the key rather than its immediate children",
+		Destination: &recursive,
+	}
+	jsonOutputFlag := cli.BoolFlag{
+		Name:        "json",
+		Usage:       "Print the list as a json array",
+		Destination: &jsonOutput,
+	}
 	sdLoglevelFlag := cli.StringFlag{
 		Name:        "loglevel, l",
 		Usage:       "Set the loglevel",
 		Value:       logrus.GetLevel().String(),
 		Destination: &loglevel,
 	}
+	withPathsFlag := cli.BoolFlag{
+		Name:        "with-paths",
+		Usage:       "Used with wildcard keys to get an array of path and value pairs rather than just the values",
+		Destination: &metaSpec.WithPaths,
+	}
+	queryFlag := cli.StringFlag{
+		Name: "query, q",
+		Usage: "Evaluate a gjson query (e.g. 'images.#(repo==\"bar\").tag') over the meta, or over the value of " +
+			"the key when one is given",
+		Destination: &query,
+	}
+	stringValueFlag := cli.BoolFlag{
+		Name:        valueTypeString,
+		Usage:       "Set the value as a string without inferring its type, e.g. to keep 007 or 1.10 as written",
+		Destination: valueTypeFlags[valueTypeString],
+	}
+	intValueFlag := cli.BoolFlag{
+		Name:        valueTypeInt,
+		Usage:       "Set the value as an integer of any size, failing when it is not one",
+		Destination: valueTypeFlags[valueTypeInt],
+	}
+	floatValueFlag := cli.BoolFlag{
+		Name:        valueTypeFloat,
+		Usage:       "Set the value as a number, failing when it is not one",
+		Destination: valueTypeFlags[valueTypeFloat],
+	}
+	boolValueFlag := cli.BoolFlag{
+		Name:        valueTypeBool,
+		Usage:       "Set the value as a bool, failing when it is not one",
+		Destination: valueTypeFlags[valueTypeBool],
+	}
+	strictTypesFlag := cli.BoolFlag{
+		Name:        "strict",
+		Usage:       "Never infer the type of values, which are strings unless a type flag or --json-value is used",
+		EnvVar:      "SD_META_STRICT",
+		Destination: &metaSpec.StrictTypes,
+	}
 	cacheLocalFlag := cli.BoolFlag{
 		Name:        "cache-local",
 		Usage:       "Used with external, this flag saves a copy of the key/value pair in the local meta",
@@ -674,31 +1053,116 @@ func main() {
 		return nil
 	}
 
-	app.Commands = []cli.Command{
-		{
-			Name:  "get",
-			Usage: "Get a metadata with key",
+	// setValueType sets the value type of metaSpec from the type flags
+	setValueType := func() {
+		valueType, err := metaValueTypeFromFlags(metaSpec.JSONValue, valueTypeFlags)
+		if err != nil {
+			failureExit(err)
+		}
+		metaSpec.ValueType = valueType
+	}
+
+	// useFixtures sets the transport of metaSpec to replay or record fixtures with --fixtures and --record-fixtures
+	useFixtures := func(*cli.Context) error {
+		request := &metaSpec.LastSuccessfulMetaRequest
+		if fixtures != "" {
+			transport, err := fetch.NewFixtureTransport(fixtures)
+			if err != nil {
+				failureExit(err)
+			}
+			request.Transport = transport
+		}
+		if recordFixtures != "" {
+			request.Transport = &fetch.RecordingTransport{Dir: recordFixtures, Transport: request.GetTransport()}
+		}
+		return nil
+	}
+
+	// cacheCommand creates a cache subcommand that runs action with the cache
+	cacheCommand := func(name string, usage string, action func(cache *fetch.Cache) error) cli.Command {
+		return cli.Command{
+			Name:  name,
+			Usage: usage,
 			Action: func(c *cli.Context) error {
-				// Ensure that the CLI is concurrency safe. Get may write if fetching lastSuccessful; lock exclusively.
+				if c.NArg() != 0 {
+					logrus.Errorf("meta cache %s expects no arguments", name)
+					cli.ShowCommandHelp(c, name)
+					failureExit(nil)
+				}
+				cache := metaSpec.LastSuccessfulMetaRequest.Cache
+				if !cache.Enabled() {
+					failureExit(errors.New("meta cache requires --cache-dir or SD_META_CACHE_DIR"))
+				}
+				if err := action(cache); err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag},
+		}
+	}
+
+	// arrayInsertCommand creates a command for inserting a value into an array with insert (e.g. metaSpec.Push)
+	arrayInsertCommand := func(name string, usage string, insert func(key string, value string) error) cli.Command {
+		return cli.Command{
+			Name:  name,
+			Usage: usage,
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe.
 				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
 				if err := flocker.Lock(); err != nil {
 					failureExit(err)
 				}
 				defer func() { _ = flocker.Unlock() }()
 
-				if c.NArg() != 1 {
-					logrus.Error("meta get expects exactly one argument (key)")
-					cli.ShowCommandHelp(c, "get")
+				if c.NArg() != 2 {
+					logrus.Errorf("meta %s expects exactly two arguments (key, value)", name)
+					cli.ShowCommandHelp(c, name)
 					failureExit(nil)
 				}
 				key := c.Args().Get(0)
-				if valid := validateMetaKey(key); !valid {
-					failureExit(errors.New("meta key validation error"))
+				val := c.Args().Get(1)
+				if err := validateMetaKey(key); err != nil {
+					failureExit(err)
+				}
+				setValueType()
+				if err := insert(key, val); err != nil {
+					failureExit(err)
 				}
-				if _, err := fetch.ParseJobDescription(metaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID, metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				namespaceFlag, jsonValueFlag, stringValueFlag, intValueFlag, floatValueFlag, boolValueFlag,
+				strictTypesFlag,
+			},
+		}
+	}
+
+	// arrayRemoveCommand creates a command for removing and printing a value of an array with remove (e.g. metaSpec.Pop)
+	arrayRemoveCommand := func(name string, usage string, remove func(key string) (string, error)) cli.Command {
+		return cli.Command{
+			Name:  name,
+			Usage: usage,
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
 					failureExit(err)
 				}
-				value, err := metaSpec.Get(key)
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() != 1 {
+					logrus.Errorf("meta %s expects exactly one argument (key)", name)
+					cli.ShowCommandHelp(c, name)
+					failureExit(nil)
+				}
+				key := c.Args().Get(0)
+				if err := validateMetaKey(key); err != nil {
+					failureExit(err)
+				}
+				value, err := remove(key)
 				if err != nil {
 					failureExit(err)
 				}
@@ -709,9 +1173,68 @@ func main() {
 				successExit()
 				return nil
 			},
+			Flags: []cli.Flag{namespaceFlag, jsonValueFlag},
+		}
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:   "get",
+			Usage:  "Get a metadata with key",
+			Before: useFixtures,
+			Action: func(c *cli.Context) error {
+				// With --fail-missing, errors exit with exitCodeError so that they aren't mistaken for a missing key
+				fail := failureExit
+				if failMissing {
+					fail = lookupFailureExit
+				}
+				// Ensure that the CLI is concurrency safe. Get may write if fetching lastSuccessful; lock exclusively.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					fail(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() != 1 && (query == "" || c.NArg() != 0) {
+					logrus.Error("meta get expects exactly one argument (key), which is optional with --query")
+					cli.ShowCommandHelp(c, "get")
+					fail(nil)
+				}
+				key := c.Args().Get(0)
+				if c.NArg() != 0 {
+					if err := validateMetaKey(key); err != nil {
+						fail(err)
+					}
+				}
+				if _, err := metaSpec.LastSuccessfulMetaRequest.ParseJobDescription(metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+					fail(err)
+				}
+				var value string
+				var found bool
+				var err error
+				if query != "" {
+					value, found, err = metaSpec.LookupQuery(key, query)
+				} else {
+					value, found, err = metaSpec.Lookup(key)
+				}
+				if err != nil {
+					fail(err)
+				}
+				if failMissing && !found {
+					fail(fmt.Errorf("%w: %s", ErrKeyNotFound, strings.TrimSpace(key+" "+query)))
+				}
+				_, err = io.WriteString(os.Stdout, value)
+				if err != nil {
+					fail(err)
+				}
+				successExit()
+				return nil
+			},
 			Flags: []cli.Flag{
-				externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag, sdAPIURLFlag,
-				sdPipelineIDFlag, skipStoreExternalFlag, cacheLocalFlag,
+				namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag,
+				sdTokenFileFlag, sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag,
+				cacheLocalFlag, withPathsFlag, queryFlag, failMissingFlag, fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag,
+				cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag, fixturesFlag, recordFixturesFlag,
 			},
 		},
 		{
@@ -732,9 +1255,10 @@ func main() {
 				}
 				key := c.Args().Get(0)
 				val := c.Args().Get(1)
-				if valid := validateMetaKey(key); !valid {
-					failureExit(errors.New("meta key validation error"))
+				if err := validateMetaKey(key); err != nil {
+					failureExit(err)
 				}
+				setValueType()
 				err := metaSpec.Set(key, val)
 				if err != nil {
 					failureExit(err)
@@ -742,11 +1266,136 @@ func main() {
 				successExit()
 				return nil
 			},
-			Flags: []cli.Flag{jsonValueFlag},
+			Flags: []cli.Flag{
+				namespaceFlag, jsonValueFlag, stringValueFlag, intValueFlag, floatValueFlag, boolValueFlag,
+				strictTypesFlag,
+			},
+		},
+		{
+			Name:    "delete",
+			Aliases: []string{"unset"},
+			Usage:   "Delete a metadata with key",
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					failureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() != 1 {
+					logrus.Error("meta delete expects exactly one argument (key)")
+					cli.ShowCommandHelp(c, "delete")
+					failureExit(nil)
+				}
+				key := c.Args().Get(0)
+				if err := validateMetaKey(key); err != nil {
+					failureExit(err)
+				}
+				err := metaSpec.Delete(key)
+				if err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{namespaceFlag},
+		},
+		{
+			Name:      "patch",
+			Usage:     "Apply a json merge patch (object) or json patch (array of operations) to the metadata",
+			ArgsUsage: "[patch|-]",
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					failureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() > 1 {
+					logrus.Error("meta patch expects at most one argument (patch); when omitted or -, stdin is read")
+					cli.ShowCommandHelp(c, "patch")
+					failureExit(nil)
+				}
+				patch := c.Args().Get(0)
+				if patch == "" || patch == "-" {
+					data, err := ioutil.ReadAll(os.Stdin)
+					if err != nil {
+						failureExit(err)
+					}
+					patch = string(data)
+				}
+				err := metaSpec.Patch(patch)
+				if err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{namespaceFlag},
+		},
+		{
+			Name:      "fetch",
+			Usage:     "Fetch the meta of external jobs concurrently and store it in the local meta",
+			ArgsUsage: "external...",
+			Before:    useFixtures,
+			Action: func(c *cli.Context) error {
+				if c.NArg() == 0 {
+					logrus.Error("meta fetch expects at least one argument (external, e.g. sd@123:publish)")
+					cli.ShowCommandHelp(c, "fetch")
+					failureExit(nil)
+				}
+				// Ensure that the CLI is concurrency safe; the lock is not held while fetching.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := metaSpec.FetchExternals(c.Args(), flocker); err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				skipFetchNonexistentExternalFlag, sdTokenFlag, sdTokenFileFlag, sdAPIKeyFlag, sdAPIURLFlag,
+				sdPipelineIDFlag, sdPullRequestFlag, fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag,
+				fetchParallelismFlag, cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag, fixturesFlag, recordFixturesFlag,
+			},
 		},
 		{
-			Name:  "dump",
-			Usage: "Dump the entire metadata store in json format",
+			Name:    "sync",
+			Aliases: []string{"push-remote"},
+			Usage:   "Write the meta back to the build with the SD API",
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					failureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() != 0 {
+					logrus.Error("meta sync expects no arguments")
+					cli.ShowCommandHelp(c, "sync")
+					failureExit(nil)
+				}
+				if err := metaSpec.Sync(buildID, force, dryRun, os.Stdout); err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				sdTokenFlag, sdTokenFileFlag, sdAPIKeyFlag, sdAPIURLFlag, sdBuildIDFlag, forceFlag, dryRunFlag,
+				fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag,
+			},
+		},
+		arrayInsertCommand("push", "Append a value to the array with key", metaSpec.Push),
+		arrayInsertCommand("unshift", "Prepend a value to the array with key", metaSpec.Unshift),
+		arrayRemoveCommand("pop", "Remove and print the last value of the array with key", metaSpec.Pop),
+		arrayRemoveCommand("shift", "Remove and print the first value of the array with key", metaSpec.Shift),
+		{
+			Name:   "dump",
+			Usage:  "Dump the entire metadata store in json format",
+			Before: useFixtures,
 			Action: func(c *cli.Context) error {
 				// Ensure that the CLI is concurrency safe. Get may write if fetching lastSuccessful; lock exclusively.
 				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
@@ -761,10 +1410,21 @@ func main() {
 					failureExit(nil)
 				}
 
-				if _, err := fetch.ParseJobDescription(metaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID, metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+				if _, err := metaSpec.LastSuccessfulMetaRequest.ParseJobDescription(metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
 					failureExit(err)
 				}
 
+				if query != "" {
+					value, err := metaSpec.Query("", query)
+					if err != nil {
+						failureExit(err)
+					}
+					if _, err = io.WriteString(os.Stdout, value); err != nil {
+						failureExit(err)
+					}
+					successExit()
+				}
+
 				metaJSON, err := metaSpec.GetData()
 				if err != nil {
 					failureExit(err)
@@ -778,13 +1438,148 @@ func main() {
 				return nil
 			},
 			Flags: []cli.Flag{
-				externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag, sdAPIURLFlag,
-				sdPipelineIDFlag, skipStoreExternalFlag, cacheLocalFlag,
+				namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag,
+				sdTokenFileFlag, sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag,
+				cacheLocalFlag, queryFlag, fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag, cacheDirFlag, cacheTTLFlag,
+				cacheMaxSizeFlag, fixturesFlag, recordFixturesFlag,
 			},
 		},
 		{
-			Name:  "lua",
-			Usage: "Run a lua script",
+			Name:      "exists",
+			Usage:     "Exit with 0 when the key exists (even when it is null), 1 when it does not and 2 on errors",
+			ArgsUsage: "key",
+			Before:    useFixtures,
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe. Exists may write if fetching lastSuccessful; lock exclusively.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					lookupFailureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() != 1 {
+					logrus.Error("meta exists expects exactly one argument (key)")
+					cli.ShowCommandHelp(c, "exists")
+					lookupFailureExit(nil)
+				}
+				key := c.Args().Get(0)
+				if err := validateMetaKey(key); err != nil {
+					lookupFailureExit(err)
+				}
+				if _, err := metaSpec.LastSuccessfulMetaRequest.ParseJobDescription(metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+					lookupFailureExit(err)
+				}
+				found, err := metaSpec.Exists(key)
+				if err != nil {
+					lookupFailureExit(err)
+				}
+				if !found {
+					failureExit(nil)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, sdTokenFlag, sdTokenFileFlag,
+				sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag, cacheLocalFlag,
+				fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag, cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag,
+				fixturesFlag, recordFixturesFlag,
+			},
+		},
+		{
+			Name:      "keys",
+			Usage:     "List the keys of the object (or indexes of the array) with key, or the top level keys",
+			ArgsUsage: "[key]",
+			Before:    useFixtures,
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe. Keys may write if fetching lastSuccessful; lock exclusively.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					failureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() > 1 {
+					logrus.Error("meta keys expects at most one argument (key)")
+					cli.ShowCommandHelp(c, "keys")
+					failureExit(nil)
+				}
+				if _, err := metaSpec.LastSuccessfulMetaRequest.ParseJobDescription(metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+					failureExit(err)
+				}
+				keys, err := metaSpec.Keys(c.Args().Get(0))
+				if err != nil {
+					failureExit(err)
+				}
+				if jsonOutput {
+					err = json.NewEncoder(os.Stdout).Encode(keys)
+				} else {
+					for _, key := range keys {
+						if _, err = fmt.Println(key); err != nil {
+							break
+						}
+					}
+				}
+				if err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, sdTokenFlag, sdTokenFileFlag,
+				sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag,
+				fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag, cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag,
+				fixturesFlag, recordFixturesFlag, jsonOutputFlag,
+			},
+		},
+		{
+			Name:      "ls",
+			Usage:     "List the paths and types of the values under key, or of the whole meta",
+			ArgsUsage: "[key]",
+			Before:    useFixtures,
+			Action: func(c *cli.Context) error {
+				// Ensure that the CLI is concurrency safe. Ls may write if fetching lastSuccessful; lock exclusively.
+				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
+				if err := flocker.Lock(); err != nil {
+					failureExit(err)
+				}
+				defer func() { _ = flocker.Unlock() }()
+
+				if c.NArg() > 1 {
+					logrus.Error("meta ls expects at most one argument (key)")
+					cli.ShowCommandHelp(c, "ls")
+					failureExit(nil)
+				}
+				if _, err := metaSpec.LastSuccessfulMetaRequest.ParseJobDescription(metaSpec.MetaFile); metaSpec.IsExternal() && err != nil {
+					failureExit(err)
+				}
+				entries, err := metaSpec.List(c.Args().Get(0), recursive)
+				if err != nil {
+					failureExit(err)
+				}
+				if jsonOutput {
+					err = json.NewEncoder(os.Stdout).Encode(entries)
+				} else {
+					err = writeMetaEntries(os.Stdout, entries)
+				}
+				if err != nil {
+					failureExit(err)
+				}
+				successExit()
+				return nil
+			},
+			Flags: []cli.Flag{
+				namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, sdTokenFlag, sdTokenFileFlag,
+				sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag,
+				fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag, cacheDirFlag, cacheTTLFlag, cacheMaxSizeFlag,
+				fixturesFlag, recordFixturesFlag, recursiveFlag, jsonOutputFlag,
+			},
+		},
+		{
+			Name:   "lua",
+			Usage:  "Run a lua script",
+			Before: useFixtures,
 			Action: func(c *cli.Context) error {
 				// Ensure that the CLI is concurrency safe.
 				flocker := flock.New(filepath.Join(metaSpec.MetaSpace, "meta.lock"))
@@ -798,8 +1593,54 @@ func main() {
 				return luaSpec.Do(c.Args()...)
 			},
 			Flags: []cli.Flag{
-				evaluateFileFlag, externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag,
-				sdAPIURLFlag, sdPipelineIDFlag, skipStoreExternalFlag, cacheLocalFlag},
+				evaluateFileFlag, namespaceFlag, externalFlag, skipFetchNonexistentExternalFlag, jsonValueFlag, sdTokenFlag,
+				sdTokenFileFlag, sdAPIKeyFlag, sdAPIURLFlag, sdPipelineIDFlag, sdPullRequestFlag, skipStoreExternalFlag,
+				cacheLocalFlag, fetchRetriesFlag, fetchTimeoutFlag, fetchDeadlineFlag, cacheDirFlag, cacheTTLFlag,
+				cacheMaxSizeFlag, fixturesFlag, recordFixturesFlag},
+		},
+		{
+			Name:  "cache",
+			Usage: "List, clear or prune the cache of external meta",
+			Subcommands: []cli.Command{
+				cacheCommand("ls", "List the cached external meta", func(cache *fetch.Cache) error {
+					entries, err := cache.Entries()
+					if err != nil {
+						return err
+					}
+					return writeCacheEntries(os.Stdout, entries)
+				}),
+				cacheCommand("clear", "Remove all the cached external meta", func(cache *fetch.Cache) error {
+					return cache.Clear()
+				}),
+				cacheCommand("prune", "Remove expired cached external meta and the oldest beyond --cache-max-size",
+					func(cache *fetch.Cache) error {
+						removed, err := cache.Prune()
+						logrus.Infof("Pruned %d cached external meta", removed)
+						return err
+					}),
+			},
+		},
+		{
+			Name:      "mock-server",
+			Usage:     "Serve a mock of the SD API from a directory of JSON files, for local pipeline testing",
+			ArgsUsage: "dir",
+			Action: func(c *cli.Context) error {
+				if c.NArg() != 1 {
+					logrus.Error("meta mock-server expects exactly one argument (dir)")
+					cli.ShowCommandHelp(c, "mock-server")
+					failureExit(nil)
+				}
+				mockServer.Dir = c.Args().Get(0)
+				listener, err := net.Listen("tcp", listen)
+				if err != nil {
+					failureExit(err)
+				}
+				logrus.Infof("Serving a mock of the SD API with %s at SD_API_URL=http://%s%s", mockServer.Dir,
+					listener.Addr(), fetch.MockServerPrefix)
+				failureExit(http.Serve(listener, &mockServer))
+				return nil
+			},
+			Flags: []cli.Flag{listenFlag, mockTokenFlag},
 		},
 	}
 
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -9,10 +12,10 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/screwdriver-cd/meta-cli/internal/fetch"
 	"github.com/stretchr/testify/mock"
-	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/termie/go-shutil"
 )
@@ -243,6 +246,59 @@ func (s *MetaSuite) TestGetMeta() {
 			desc:     `The key does not exist in meta.json`,
 			expected: `null`,
 		},
+		{
+			key:      `ary[3]`,
+			desc:     `The index is out of range`,
+			expected: `null`,
+		},
+		{
+			key:      `ary[-1]`,
+			expected: `{"ccc":{"ddd":[1234567,2,3]}}`,
+		},
+		{
+			key:      `ary[-3]`,
+			expected: `aaa`,
+		},
+		{
+			key:      `ary[-4]`,
+			desc:     `The negative index is out of range`,
+			expected: `null`,
+		},
+		{
+			key:      `ary[-1].ccc.ddd[-2]`,
+			expected: `2`,
+		},
+		{
+			key:      `ary[0:2]`,
+			expected: `["aaa","bbb"]`,
+		},
+		{
+			key:      `ary[:1]`,
+			expected: `["aaa"]`,
+		},
+		{
+			key:      `ary[-2:]`,
+			expected: `["bbb",{"ccc":{"ddd":[1234567,2,3]}}]`,
+		},
+		{
+			key:      `ary[-1].ccc.ddd[1:-1]`,
+			expected: `[2]`,
+		},
+		{
+			key:      `ary[1:10]`,
+			desc:     `The slice is clamped to the array`,
+			expected: `["bbb",{"ccc":{"ddd":[1234567,2,3]}}]`,
+		},
+		{
+			key:      `ary[2:1]`,
+			desc:     `The slice is empty`,
+			expected: `[]`,
+		},
+		{
+			key:      `obj[0:1]`,
+			desc:     `The value is not an array`,
+			expected: `null`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -495,7 +551,7 @@ func (s *MetaSuite) TestSetMeta() {
 				{"float", "15.5"},
 				{"string", "50876e6"},
 			},
-			expected: `{"float":15.5,"int":10,"string":"50876e6"}`,
+			expected: `{"int":10,"float":15.5,"string":"50876e6"}`,
 		},
 		{
 			name:     "string",
@@ -520,6 +576,14 @@ func (s *MetaSuite) TestSetMeta() {
 			},
 			expected: `{"array":"str"}`,
 		},
+		{
+			name: "array_element_keeps_siblings",
+			sets: []set{
+				{"foo[0].bar", "baz"},
+				{"foo[0].qux", "quux"},
+			},
+			expected: `{"foo":[{"bar":"baz","qux":"quux"}]}`,
+		},
 		{
 			name: "object_to_string",
 			sets: []set{
@@ -528,6 +592,15 @@ func (s *MetaSuite) TestSetMeta() {
 			},
 			expected: `{"foo":"baz"}`,
 		},
+		{
+			name: "quoted_keys",
+			sets: []set{
+				{`images["docker.io/foo"].tag`, "latest"},
+				{`images.'v1.2'.sha`, "abc"},
+				{`"a.b"[0]`, "c"},
+			},
+			expected: `{"images":{"docker.io/foo":{"tag":"latest"},"v1.2":{"sha":"abc"}},"a.b":["c"]}`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -543,6 +616,155 @@ func (s *MetaSuite) TestSetMeta() {
 		})
 	}
 }
+func (s *MetaSuite) TestGetMeta_quotedKeys() {
+	Require := s.Require()
+	Require.NoError(ioutil.WriteFile(testFilePath,
+		[]byte(`{"images":{"docker.io/foo":{"tag":"latest"},"v1.2":["abc"]},"it's":"yes"}`), 0666))
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{key: `images["docker.io/foo"].tag`, expected: "latest"},
+		{key: `images.'docker.io/foo'.tag`, expected: "latest"},
+		{key: `images."v1.2"[-1]`, expected: "abc"},
+		{key: `'it\'s'`, expected: "yes"},
+		{key: `images.docker.io`, expected: "null"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			got, err := s.MetaSpec.Get(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *MetaSuite) TestGetMeta_wildcards() {
+	Require := s.Require()
+	Require.NoError(ioutil.WriteFile(testFilePath, []byte(`{"images":[{"tag":"1.0"},{"repo":"b"},{"tag":2}],`+
+		`"sd":{"123":{"main":{"build":{"sha":"aaa"}}},"456":{"deploy":{"build":{"sha":"bbb"}}}}}`), 0666))
+
+	tests := []struct {
+		key       string
+		withPaths bool
+		expected  string
+	}{
+		{key: `images[*].tag`, expected: `["1.0",2]`},
+		{key: `sd.*.*.build.sha`, expected: `["aaa","bbb"]`},
+		{key: `sd.*.*.build.sha`, withPaths: true,
+			expected: `[{"path":"sd.123.main.build.sha","value":"aaa"},{"path":"sd.456.deploy.build.sha","value":"bbb"}]`},
+		{key: `images[*].missing`, expected: `[]`},
+		{key: `nothing.*`, withPaths: true, expected: `[]`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			s.MetaSpec.WithPaths = tt.withPaths
+			got, err := s.MetaSpec.Get(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *MetaSuite) TestMetaSpec_Exists() {
+	Require := s.Require()
+	Require.NoError(ioutil.WriteFile(testFilePath, []byte(`{"str":"val","null":null,"obj":{"a":null},"ary":[null],`+
+		`"sd":{"123":{"main":{"build":{"sha":"aaa"}}}}}`), 0666))
+
+	tests := []struct {
+		key      string
+		expected bool
+	}{
+		{key: `str`, expected: true},
+		{key: `null`, expected: true},
+		{key: `obj.a`, expected: true},
+		{key: `ary[0]`, expected: true},
+		{key: `ary[-1]`, expected: true},
+		{key: `ary[1:]`, expected: true},
+		{key: `sd.*.*.build.sha`, expected: true},
+		{key: `missing`, expected: false},
+		{key: `obj.b`, expected: false},
+		{key: `null.a`, expected: false},
+		{key: `ary[1]`, expected: false},
+		{key: `str[0]`, expected: false},
+		{key: `sd.*.deploy`, expected: false},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.key, func() {
+			got, err := s.MetaSpec.Exists(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+
+			// Get cannot tell a missing key apart from null, but Lookup can
+			value, found, err := s.MetaSpec.Lookup(tt.key)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, found)
+			if !tt.expected && !MustParseKeyPath(tt.key).IsQuery() {
+				s.Assert().Equal("null", value)
+			}
+		})
+	}
+
+	_, err := s.MetaSpec.Exists("foo.")
+	s.Assert().Error(err)
+}
+
+func (s *MetaSuite) TestSetMeta_wildcardFails() {
+	s.Require().EqualError(s.MetaSpec.Set("images[*].tag", "foo"),
+		"cannot set images[*].tag; wildcards may only be used with get")
+	s.Require().EqualError(s.MetaSpec.Delete("images.*"),
+		"cannot delete images.*; wildcards may only be used with get")
+}
+
+func (s *MetaSuite) TestSetMeta_valueTypes() {
+	Require := s.Require()
+	s.MetaSpec.ValueType = valueTypeString
+	Require.NoError(s.MetaSpec.Set("version", "1.10"))
+	s.MetaSpec.ValueType = valueTypeInt
+	Require.NoError(s.MetaSpec.Set("id", "12345678901234567890"))
+	s.MetaSpec.ValueType = valueTypeFloat
+	Require.NoError(s.MetaSpec.Set("ratio", "1.10"))
+	s.MetaSpec.ValueType = valueTypeBool
+	Require.EqualError(s.MetaSpec.Set("flag", "yes"), "cannot set flag; yes is not a bool")
+	Require.EqualError(s.MetaSpec.Push("flags", "yes"), "cannot push flags; yes is not a bool")
+	s.MetaSpec.ValueType = ""
+	s.MetaSpec.StrictTypes = true
+	Require.NoError(s.MetaSpec.Set("build", "007"))
+
+	// Later writes keep the numbers exactly
+	s.MetaSpec.StrictTypes = false
+	Require.NoError(s.MetaSpec.Set("other", "12345678901234567891"))
+	out, err := ioutil.ReadFile(testFilePath)
+	Require.NoError(err)
+	s.Assert().Equal(`{"version":"1.10","id":12345678901234567890,"ratio":1.10,"build":"007",`+
+		`"other":12345678901234567891}`, string(out))
+
+	got, err := s.MetaSpec.Get("id")
+	Require.NoError(err)
+	s.Assert().Equal("12345678901234567890", got)
+}
+
+func (s *MetaSuite) TestSetMeta_roundTrip() {
+	Require := s.Require()
+	original := `{"zeta":{"b":1.50,"a":12345678901234567890},"alpha":[1e3,{"y":true,"x":null}],"mid":"x"}`
+	Require.NoError(ioutil.WriteFile(testFilePath, []byte(original), 0666))
+
+	// Writers only change what they touch; everything else is written back exactly
+	Require.NoError(s.MetaSpec.Set("mid", "y"))
+	Require.NoError(s.MetaSpec.Set("zeta.c", "3"))
+	Require.NoError(s.MetaSpec.Push("alpha", "2"))
+	Require.NoError(s.MetaSpec.Delete("alpha[1].y"))
+	Require.NoError(s.MetaSpec.Patch(`{"zeta":{"b":1.5},"new":1.0}`))
+	out, err := ioutil.ReadFile(testFilePath)
+	Require.NoError(err)
+	s.Assert().Equal(`{"zeta":{"b":1.5,"a":12345678901234567890,"c":3},"alpha":[1e3,{"x":null},2],"mid":"y",`+
+		`"new":1.0}`, string(out))
+}
+
 func (s *MetaSuite) TestSetMeta_sequential() {
 	type set struct {
 		key      string
@@ -590,7 +812,7 @@ func (s *MetaSuite) TestSetMeta_sequential() {
 				{
 					key:      "foo.bar-baz",
 					value:    "dashed-key",
-					expected: `{"foo":{"bar":{"baz":"piyo"},"bar-baz":"dashed-key","barbar":"bazbaz"}}`,
+					expected: `{"foo":{"bar":{"baz":"piyo"},"barbar":"bazbaz","bar-baz":"dashed-key"}}`,
 				},
 			},
 		},
@@ -644,6 +866,31 @@ func (s *MetaSuite) TestSetMeta_sequential() {
 				},
 			},
 		},
+		{
+			name: "negative_index",
+			sets: []set{
+				{
+					key:      "foo[2]",
+					value:    "bar",
+					expected: `{"foo":[null,null,"bar"]}`,
+				},
+				{
+					key:      "foo[-1]",
+					value:    "baz",
+					expected: `{"foo":[null,null,"baz"]}`,
+				},
+				{
+					key:      "foo[-3].bar",
+					value:    "baz",
+					expected: `{"foo":[{"bar":"baz"},null,"baz"]}`,
+				},
+				{
+					key:      "foo[-3].bar",
+					value:    "qux",
+					expected: `{"foo":[{"bar":"qux"},null,"baz"]}`,
+				},
+			},
+		},
 		{
 			name: "object_with_array",
 			sets: []set{
@@ -720,15 +967,158 @@ func (s *MetaSuite) TestSetMeta_json_object() {
 
 	for _, tt := range tests {
 		s.Run(tt.name, func() {
-			defer func() {
-				r := recover()
-				require.Equal(s.T(), tt.wantErr, r != nil, "wantErr %v; err %v", tt.wantErr, r)
-			}()
 			_, err := s.MetaSpec.SetupDir()
 			Require := s.Require()
 			Require.NoError(err)
 			Require.NoError(os.Remove(testFilePath))
-			Require.NoError(s.MetaSpec.Set(tt.key, tt.value))
+			err = s.MetaSpec.Set(tt.key, tt.value)
+			if tt.wantErr {
+				// Invalid json is an error, not a panic, and the meta is not written
+				Require.Error(err)
+				s.Assert().Contains(err.Error(), "cannot set "+tt.key+"; ")
+				s.Assert().NoFileExists(testFilePath)
+				return
+			}
+			Require.NoError(err)
+			out, err := ioutil.ReadFile(testFilePath)
+			Require.NoError(err)
+			s.Assert().Equal(tt.expected, string(out))
+		})
+	}
+}
+
+func (s *MetaSuite) TestSetMeta_indexErrors() {
+	tests := []struct {
+		name    string
+		initial string
+		key     string
+	}{
+		{
+			name:    "negative index out of range",
+			initial: `{"foo":[1,2]}`,
+			key:     "foo[-3]",
+		},
+		{
+			name:    "negative index of missing array",
+			initial: `{}`,
+			key:     "foo.bar[-1]",
+		},
+		{
+			name:    "nested negative index out of range",
+			initial: `{"foo":[{"bar":[]}]}`,
+			key:     "foo[0].bar[-1]",
+		},
+		{
+			name:    "slice",
+			initial: `{"foo":[1,2]}`,
+			key:     "foo[0:1]",
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			Require := s.Require()
+			Require.NoError(ioutil.WriteFile(testFilePath, []byte(tt.initial), 0666))
+			Require.Error(s.MetaSpec.Set(tt.key, "value"))
+			out, err := ioutil.ReadFile(testFilePath)
+			Require.NoError(err)
+			s.Assert().Equal(tt.initial, string(out))
+		})
+	}
+}
+
+func (s *MetaSuite) TestDeleteMeta() {
+	tests := []struct {
+		name     string
+		initial  string
+		key      string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "top-level key",
+			initial:  `{"foo":"bar","baz":1}`,
+			key:      "foo",
+			expected: `{"baz":1}`,
+		},
+		{
+			name:     "nested key",
+			initial:  `{"foo":{"bar":"baz","qux":"quux"}}`,
+			key:      "foo.bar",
+			expected: `{"foo":{"qux":"quux"}}`,
+		},
+		{
+			name:     "array element is spliced",
+			initial:  `{"foo":["a","b","c","d"]}`,
+			key:      "foo[2]",
+			expected: `{"foo":["a","b","d"]}`,
+		},
+		{
+			name:     "key inside array element",
+			initial:  `{"foo":[{"bar":1},{"bar":2,"baz":3}]}`,
+			key:      "foo[1].bar",
+			expected: `{"foo":[{"bar":1},{"baz":3}]}`,
+		},
+		{
+			name:     "nested array element",
+			initial:  `{"foo":{"bar":[[1,2],[3,4]]}}`,
+			key:      "foo.bar[1][0]",
+			expected: `{"foo":{"bar":[[1,2],[4]]}}`,
+		},
+		{
+			name:     "negative index",
+			initial:  `{"foo":["a","b","c"]}`,
+			key:      "foo[-2]",
+			expected: `{"foo":["a","c"]}`,
+		},
+		{
+			name:     "negative index out of range is a no-op",
+			initial:  `{"foo":["a","b","c"]}`,
+			key:      "foo[-4]",
+			expected: `{"foo":["a","b","c"]}`,
+		},
+		{
+			name:    "slices are rejected",
+			initial: `{"foo":["a","b","c"]}`,
+			key:     "foo[0:2]",
+			wantErr: true,
+		},
+		{
+			name:     "missing key is a no-op",
+			initial:  `{"foo":"bar"}`,
+			key:      "baz.qux",
+			expected: `{"foo":"bar"}`,
+		},
+		{
+			name:     "index out of range is a no-op",
+			initial:  `{"foo":["a"]}`,
+			key:      "foo[3]",
+			expected: `{"foo":["a"]}`,
+		},
+		{
+			name:     "index of non-array is a no-op",
+			initial:  `{"foo":"bar"}`,
+			key:      "foo[0]",
+			expected: `{"foo":"bar"}`,
+		},
+		{
+			name:    "empty brackets are rejected",
+			initial: `{"foo":["a"]}`,
+			key:     "foo[]",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			Require := s.Require()
+			Require.NoError(ioutil.WriteFile(testFilePath, []byte(tt.initial), 0666))
+			err := s.MetaSpec.Delete(tt.key)
+			if tt.wantErr {
+				Require.Error(err)
+				return
+			}
+			Require.NoError(err)
 			out, err := ioutil.ReadFile(testFilePath)
 			Require.NoError(err)
 			s.Assert().Equal(tt.expected, string(out))
@@ -736,6 +1126,161 @@ func (s *MetaSuite) TestSetMeta_json_object() {
 	}
 }
 
+func (s *MetaSuite) TestDeleteExternalMetaFails() {
+	s.MetaSpec.MetaFile = externalFile
+	s.Require().Error(s.MetaSpec.Delete("str"))
+}
+
+func (s *MetaSuite) TestArrayOperations() {
+	type operation struct {
+		name  string
+		key   string
+		value string
+		json  bool
+	}
+
+	tests := []struct {
+		name         string
+		initial      string
+		operations   []operation
+		expected     string
+		wantRemoved  []string
+		wantErr      bool
+		wantErrMatch string
+	}{
+		{
+			name:    "push creates array",
+			initial: `{}`,
+			operations: []operation{
+				{name: "push", key: "foo", value: "bar"},
+				{name: "push", key: "foo", value: "10"},
+			},
+			expected: `{"foo":["bar",10]}`,
+		},
+		{
+			name:    "unshift creates array",
+			initial: `{}`,
+			operations: []operation{
+				{name: "unshift", key: "foo", value: "bar"},
+				{name: "unshift", key: "foo", value: "baz"},
+			},
+			expected: `{"foo":["baz","bar"]}`,
+		},
+		{
+			name:    "push json to nested path",
+			initial: `{"images":[{"repo":"foo","tags":["1.0"]}]}`,
+			operations: []operation{
+				{name: "push", key: "images[0].tags", value: `"latest"`, json: true},
+				{name: "push", key: "images", value: `{"repo":"bar"}`, json: true},
+			},
+			expected: `{"images":[{"repo":"foo","tags":["1.0","latest"]},{"repo":"bar"}]}`,
+		},
+		{
+			name:    "pop and shift",
+			initial: `{"foo":{"bar":[1,2,3,4]}}`,
+			operations: []operation{
+				{name: "pop", key: "foo.bar"},
+				{name: "shift", key: "foo.bar"},
+			},
+			expected:    `{"foo":{"bar":[2,3]}}`,
+			wantRemoved: []string{"4", "1"},
+		},
+		{
+			name:    "pop until empty",
+			initial: `{"foo":["bar"]}`,
+			operations: []operation{
+				{name: "pop", key: "foo", json: true},
+				{name: "pop", key: "foo", json: true},
+			},
+			expected:    `{"foo":[]}`,
+			wantRemoved: []string{`"bar"`, "null"},
+		},
+		{
+			name:    "pop missing key does not create it",
+			initial: `{"foo":"bar"}`,
+			operations: []operation{
+				{name: "shift", key: "baz"},
+			},
+			expected:    `{"foo":"bar"}`,
+			wantRemoved: []string{"null"},
+		},
+		{
+			name:    "push to non-array fails",
+			initial: `{"foo":"bar"}`,
+			operations: []operation{
+				{name: "push", key: "foo", value: "baz"},
+			},
+			wantErr:      true,
+			wantErrMatch: "not an array",
+		},
+		{
+			name:    "pop from object fails",
+			initial: `{"foo":{"bar":"baz"}}`,
+			operations: []operation{
+				{name: "pop", key: "foo"},
+			},
+			wantErr:      true,
+			wantErrMatch: "not an array",
+		},
+		{
+			name:    "push with empty brackets fails",
+			initial: `{}`,
+			operations: []operation{
+				{name: "push", key: "foo[]", value: "bar"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "push bogus json fails",
+			initial: `{}`,
+			operations: []operation{
+				{name: "push", key: "foo", value: `{"bar":`, json: true},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			Require := s.Require()
+			Require.NoError(ioutil.WriteFile(testFilePath, []byte(tt.initial), 0666))
+			var removed []string
+			var err error
+			for _, op := range tt.operations {
+				s.MetaSpec.JSONValue = op.json
+				var got string
+				switch op.name {
+				case "push":
+					err = s.MetaSpec.Push(op.key, op.value)
+				case "unshift":
+					err = s.MetaSpec.Unshift(op.key, op.value)
+				case "pop":
+					got, err = s.MetaSpec.Pop(op.key)
+					removed = append(removed, got)
+				case "shift":
+					got, err = s.MetaSpec.Shift(op.key)
+					removed = append(removed, got)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if tt.wantErr {
+				Require.Error(err)
+				if tt.wantErrMatch != "" {
+					s.Assert().Contains(err.Error(), tt.wantErrMatch)
+				}
+				return
+			}
+			Require.NoError(err)
+			out, err := ioutil.ReadFile(testFilePath)
+			Require.NoError(err)
+			s.Assert().Equal(tt.expected, string(out))
+			s.Assert().Equal(tt.wantRemoved, removed)
+		})
+	}
+}
+
 func (s *MetaSuite) TestValidateMetaKeyWithAccept() {
 	tests := []struct {
 		key string
@@ -764,12 +1309,32 @@ func (s *MetaSuite) TestValidateMetaKeyWithAccept() {
 		{`f-o-o[1].bar--baz[2]`},
 		{`1.2.3`},
 		{`foo.b-a-r:baz:1-2-3[]`},
+		{`foo[-1]`},
+		{`foo[-10].bar`},
+		{`foo.bar[-1].baz[2]`},
+		{`foo[1:3]`},
+		{`foo[:2]`},
+		{`foo[-2:]`},
+		{`foo[:]`},
+		{`foo[0].bar[1:-1]`},
+		{`images["docker.io/foo"].tag`},
+		{`images['docker.io/foo'].tag`},
+		{`images.'v1.2'.sha`},
+		{`images."v1.2"[0]`},
+		{`"v1.2".sha`},
+		{`["v1.2"].sha`},
+		{`foo."has \"quotes\""`},
+		{`foo.''`},
+		{`images[*].tag`},
+		{`sd.*.*.build.sha`},
+		{`sd.123.deploy-*`},
+		{`foo.?`},
 	}
 
 	for _, tt := range tests {
 		s.Run(tt.key, func() {
 			Require := s.Require()
-			Require.True(validateMetaKey(tt.key), "'%v' is should be accepted", tt.key)
+			Require.NoError(validateMetaKey(tt.key), "'%v' is should be accepted", tt.key)
 		})
 	}
 }
@@ -789,64 +1354,26 @@ func (s *MetaSuite) TestValidateMetaKeyWithReject() {
 		{`foo-[]`},
 		{`foo.-bar`},
 		{`foo.bar-[]`},
+		{`foo[-0]`},
+		{`foo[--1]`},
+		{`foo[-01]`},
+		{`foo[1:3].bar`},
+		{`foo[1:3][0]`},
+		{`foo[1:2:3]`},
+		{`foo[-]`},
+		{`foo."bar`},
+		{`foo["bar"`},
+		{`foo["bar"x]`},
+		{`foo.'bar'baz`},
+		{`[0].foo`},
+		{`foo[bar]`},
+		{``},
 	}
 
 	for _, tt := range tests {
 		s.Run(tt.key, func() {
 			Require := s.Require()
-			Require.False(validateMetaKey(tt.key), "'%v' is should be rejected", tt.key)
-		})
-	}
-}
-
-func (s *MetaSuite) TestIndexOfFirstRightBracket() {
-	tests := []struct {
-		key      string
-		expected int
-	}{
-		{
-			key:      "foo[1]",
-			expected: 5,
-		},
-		{
-			key:      "foo[10]",
-			expected: 6,
-		},
-	}
-
-	for _, tt := range tests {
-		s.Run(tt.key, func() {
-			s.Assert().Equal(tt.expected, indexOfFirstRightBracket(tt.key))
-		})
-	}
-}
-
-func (s *MetaSuite) TestMetaIndexFromKey() {
-	tests := []struct {
-		key      string
-		expected int
-	}{
-		{
-			key:      "foo[1]",
-			expected: 1,
-		},
-		{
-			key:      "foo[10]",
-			expected: 10,
-		},
-		{
-			key:      "foo[10].bar[4].baz",
-			expected: 10,
-		},
-		{
-			key:      "foo[]",
-			expected: 0,
-		},
-	}
-
-	for _, tt := range tests {
-		s.Run(tt.key, func() {
-			s.Assert().Equal(tt.expected, metaIndexFromKey(tt.key))
+			Require.Error(validateMetaKey(tt.key), "'%v' is should be rejected", tt.key)
 		})
 	}
 }
@@ -1031,6 +1558,166 @@ func (s *MetaSuite) TestMetaSpec_GetExternalData() {
 	}
 }
 
+func (s *MetaSuite) TestMetaSpec_GetExternalData_errorsAreNotCached() {
+	var mockHandler MockHandler
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/pipelines/1016708/jobs"
+	})).
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), s.JobsJSON)
+		})
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/jobs/392525/lastSuccessfulMeta"
+	})).
+		Run(func(args mock.Arguments) {
+			w := args.Get(0).(http.ResponseWriter)
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = io.WriteString(w, `{"statusCode":404,"error":"Not Found","message":"There is no successful build"}`)
+		})
+	testServer := httptest.NewServer(&mockHandler)
+	defer testServer.Close()
+
+	s.MetaSpec.MetaFile = "sd@1016708:job1"
+	s.MetaSpec.LastSuccessfulMetaRequest.SdAPIURL = testServer.URL + "/v4/"
+	s.MetaSpec.LastSuccessfulMetaRequest.Transport = testServer.Client().Transport
+
+	_, err := s.MetaSpec.GetExternalData()
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, fetch.ErrNoSuccessfulBuild), "%v", err)
+	s.Assert().Equal(exitCodeNoSuccessfulBuild, exitCode(err))
+
+	s.MetaSpec.CacheLocal = true
+	_, err = s.MetaSpec.Get("foo")
+	s.Require().Error(err)
+
+	// Neither the external meta nor the key are cached
+	got, err := s.MetaSpec.CloneDefaultMeta().Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal("null", got)
+	got, err = s.MetaSpec.CloneDefaultMeta().Get("foo")
+	s.Require().NoError(err)
+	s.Assert().Equal("null", got)
+}
+
+func (s *MetaSuite) TestMetaSpec_GetExternalData_build() {
+	var mockHandler MockHandler
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/pipelines/1016708/jobs"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), s.JobsJSON)
+		})
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/builds/456"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter),
+				`{"id":456,"jobId":392525,"status":"SUCCESS","meta":{"version":"1.2.3","sd":{"foo":"bar"}}}`)
+		})
+	testServer := httptest.NewServer(&mockHandler)
+	defer testServer.Close()
+
+	s.MetaSpec.MetaFile = "sd@1016708:job1#build=456"
+	s.MetaSpec.LastSuccessfulMetaRequest.SdAPIURL = testServer.URL + "/v4/"
+	s.MetaSpec.LastSuccessfulMetaRequest.Transport = testServer.Client().Transport
+
+	got, err := s.MetaSpec.Get("version")
+	s.Require().NoError(err)
+	s.Assert().Equal("1.2.3", got)
+
+	// The meta of the build is cached apart from the last successful meta, so the API is not called again
+	got, err = s.MetaSpec.CloneDefaultMeta().Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"1016708":{"job1#build=456":{"version":"1.2.3"}}}`, got)
+	got, err = s.MetaSpec.Get("version")
+	s.Require().NoError(err)
+	s.Assert().Equal("1.2.3", got)
+	mockHandler.AssertExpectations(s.T())
+}
+
+func (s *MetaSuite) TestMetaSpec_GetExternalData_pullRequest() {
+	var mockHandler MockHandler
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/pipelines/1016708/jobs"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter),
+				`[{"id":392525,"name":"job1"},{"id":392526,"name":"PR-45:job1"}]`)
+		})
+	mockHandler.On("ServeHTTP", mock.Anything, mock.MatchedBy(func(req *http.Request) bool {
+		return req.URL.Path == "/v4/jobs/392526/lastSuccessfulMeta"
+	})).
+		Once().
+		Run(func(args mock.Arguments) {
+			_, _ = io.WriteString(args.Get(0).(http.ResponseWriter), `{"branch":"pr"}`)
+		})
+	testServer := httptest.NewServer(&mockHandler)
+	defer testServer.Close()
+
+	s.MetaSpec.MetaFile = "job1"
+	s.MetaSpec.LastSuccessfulMetaRequest.SdAPIURL = testServer.URL + "/v4/"
+	s.MetaSpec.LastSuccessfulMetaRequest.Transport = testServer.Client().Transport
+	s.MetaSpec.LastSuccessfulMetaRequest.DefaultSdPipelineID = 1016708
+	s.MetaSpec.LastSuccessfulMetaRequest.DefaultPullRequest = "45"
+
+	// A PR build reads the meta of its sibling PR job rather than that of the main branch job
+	got, err := s.MetaSpec.Get("branch")
+	s.Require().NoError(err)
+	s.Assert().Equal("pr", got)
+	got, err = s.MetaSpec.CloneDefaultMeta().Get("sd")
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"1016708":{"PR-45:job1":{"branch":"pr"}}}`, got)
+	mockHandler.AssertExpectations(s.T())
+}
+
+func (s *MetaSuite) TestWriteCacheEntries() {
+	var buf bytes.Buffer
+	s.Require().NoError(writeCacheEntries(&buf, []fetch.CacheEntry{
+		{External: "sd@123:publish", Size: 10, ModTime: time.Now().Add(-time.Minute)},
+		{External: "sd@123:publish#build=456", Size: 2000, ModTime: time.Now().Add(-2 * time.Hour), Expired: true},
+	}))
+	s.Assert().Equal(`EXTERNAL                  SIZE  AGE     STATUS
+sd@123:publish            10    1m0s    fresh
+sd@123:publish#build=456  2000  2h0m0s  expired
+`, buf.String())
+}
+
+func (s *MetaSuite) TestExitCode() {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "nil", err: nil, expected: 1},
+		{name: "other", err: errors.New("other"), expected: 1},
+		{name: "unauthorized", err: &fetch.APIError{Err: fetch.ErrUnauthorized}, expected: exitCodeUnauthorized},
+		{name: "forbidden", err: &fetch.APIError{Err: fetch.ErrForbidden}, expected: exitCodeForbidden},
+		{name: "job not found", err: fmt.Errorf("wrapped: %w", fetch.ErrJobNotFound), expected: exitCodeJobNotFound},
+		{name: "no successful build", err: &fetch.APIError{Err: fetch.ErrNoSuccessfulBuild},
+			expected: exitCodeNoSuccessfulBuild},
+		{name: "unavailable", err: &fetch.APIError{Err: fetch.ErrUnavailable}, expected: exitCodeUnavailable},
+		{name: "build not found", err: &fetch.APIError{Err: fetch.ErrBuildNotFound}, expected: exitCodeBuildNotFound},
+		{name: "conflict", err: fmt.Errorf("%w: meta of build 1", fetch.ErrConflict), expected: exitCodeConflict},
+		{name: "key not found", err: fmt.Errorf("%w: foo", ErrKeyNotFound), expected: exitCodeKeyNotFound},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.Assert().Equal(tt.expected, exitCode(tt.err))
+		})
+	}
+}
+
+func (s *MetaSuite) TestLookupExitCode() {
+	s.Assert().Equal(exitCodeError, lookupExitCode(nil))
+	s.Assert().Equal(exitCodeError, lookupExitCode(errors.New("other")))
+	s.Assert().Equal(exitCodeKeyNotFound, lookupExitCode(fmt.Errorf("%w: foo", ErrKeyNotFound)))
+	s.Assert().Equal(exitCodeUnavailable, lookupExitCode(&fetch.APIError{Err: fetch.ErrUnavailable}))
+}
+
 func (s *MetaSuite) TestMetaSpec_SkipFetchDoesntSave() {
 	metaSpec := MetaSpec{
 		MetaFile:                     "sd@1016708:job1",
@@ -1126,3 +1813,49 @@ func (s *MetaSuite) TestMetaSpec_CachedGet() {
 		})
 	}
 }
+
+func (s *MetaSuite) TestMetaSpec_Namespace() {
+	s.Require().NoError(s.MetaSpec.Set("foo", "build"))
+	scratch := s.MetaSpec
+	scratch.Namespace = "scratch"
+	s.Assert().True(scratch.IsNamespace())
+	s.Assert().False(scratch.IsExternal())
+	s.Assert().Equal(filepath.Join(testDir, "local", "scratch.json"), scratch.MetaFilePath())
+	_ = os.RemoveAll(filepath.Join(testDir, "local"))
+
+	// The namespace has its own meta, created when it is first written
+	got, err := scratch.Get("foo")
+	s.Require().NoError(err)
+	s.Assert().Equal("null", got)
+	s.Require().NoError(scratch.Set("foo", "scratch"))
+	s.Require().NoError(scratch.Push("list", "1"))
+	data, err := scratch.GetData()
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"foo":"scratch","list":[1]}`, string(data))
+	got, err = s.MetaSpec.Get("foo")
+	s.Require().NoError(err)
+	s.Assert().Equal("build", got)
+
+	// The default meta is the build meta
+	s.Assert().Equal(s.MetaSpec.MetaFilePath(), scratch.CloneDefaultMeta().MetaFilePath())
+	scratch.Namespace = "meta"
+	s.Assert().False(scratch.IsNamespace())
+	s.Assert().Equal(s.MetaSpec.MetaFilePath(), scratch.MetaFilePath())
+}
+
+func (s *MetaSuite) TestMetaSpec_Namespace_errors() {
+	for _, namespace := range []string{"../meta", "a/b", "a.b", " "} {
+		metaSpec := s.MetaSpec
+		metaSpec.Namespace = namespace
+		s.Assert().EqualError(metaSpec.Set("foo", "bar"), fmt.Sprintf(
+			"invalid local meta file name %q; it may only have letters, digits, _ and -", namespace))
+		_, err := metaSpec.Get("foo")
+		s.Assert().Error(err, namespace)
+	}
+
+	metaSpec := s.MetaSpec
+	metaSpec.Namespace = "scratch"
+	metaSpec.MetaFile = externalFile
+	_, err := metaSpec.Get("foo")
+	s.Assert().EqualError(err, "cannot use local meta file scratch with external meta sd@123:component")
+}
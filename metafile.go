@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/screwdriver-cd/meta-cli/internal/atomicfile"
+	"github.com/sirupsen/logrus"
+)
+
+const backupSuffix = ".bak"
+
+// backupFilePath returns the path of the last known good copy of the file at path.
+func backupFilePath(path string) string {
+	return path + backupSuffix
+}
+
+// writeMetaFile is the single writer for local meta files. It keeps the current contents, when they are valid json,
+// as the backup file and atomically replaces the file with data.
+func writeMetaFile(path string, data []byte) error {
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(previous) != 0 && json.Valid(previous) {
+		if err = atomicfile.WriteFile(backupFilePath(path), previous); err != nil {
+			return err
+		}
+	}
+	return atomicfile.WriteFile(path, data)
+}
+
+// readMetaFile reads the local meta file at path. When the file is empty or is not valid json, it is restored from
+// the backup written by writeMetaFile if possible; an empty file without a backup is treated as an empty object.
+func readMetaFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 0 && json.Valid(data) {
+		return data, nil
+	}
+
+	backupPath := backupFilePath(path)
+	backup, backupErr := ioutil.ReadFile(backupPath)
+	if backupErr == nil && len(backup) != 0 && json.Valid(backup) {
+		logrus.Warnf("%s is empty or corrupted; restoring from %s", path, backupPath)
+		if err = atomicfile.WriteFile(path, backup); err != nil {
+			return nil, err
+		}
+		return backup, nil
+	}
+
+	if len(data) == 0 {
+		return []byte("{}"), nil
+	}
+	return nil, fmt.Errorf("%s is corrupted and no valid backup exists at %s; "+
+		"fix or remove the file to continue", path, backupPath)
+}
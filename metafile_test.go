@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type MetaFileSuite struct {
+	suite.Suite
+	Dir  string
+	Path string
+}
+
+func (s *MetaFileSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "metafile")
+	s.Require().NoError(err)
+	s.Dir = dir
+	s.Path = filepath.Join(dir, "meta.json")
+}
+
+func (s *MetaFileSuite) TearDownTest() {
+	_ = os.RemoveAll(s.Dir)
+}
+
+func TestMetaFileSuite(t *testing.T) {
+	suite.Run(t, new(MetaFileSuite))
+}
+
+func (s *MetaFileSuite) TestWriteMetaFile_leavesNoTemporaryFiles() {
+	Require := s.Require()
+	Require.NoError(writeMetaFile(s.Path, []byte(`{"foo":"bar"}`)))
+	Require.NoError(writeMetaFile(s.Path, []byte(`{"foo":"baz"}`)))
+
+	files, err := ioutil.ReadDir(s.Dir)
+	Require.NoError(err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	s.Assert().ElementsMatch([]string{"meta.json", "meta.json.bak"}, names)
+}
+
+func (s *MetaFileSuite) TestWriteMetaFile_keepsLastGoodCopy() {
+	Require := s.Require()
+	Require.NoError(writeMetaFile(s.Path, []byte(`{"foo":"bar"}`)))
+	_, err := os.Stat(backupFilePath(s.Path))
+	s.Assert().True(os.IsNotExist(err), "backup should not exist before the second write")
+
+	Require.NoError(writeMetaFile(s.Path, []byte(`{"foo":"baz"}`)))
+	backup, err := ioutil.ReadFile(backupFilePath(s.Path))
+	Require.NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(backup))
+
+	// A corrupted file is never rotated into the backup.
+	Require.NoError(ioutil.WriteFile(s.Path, []byte(`{"foo":`), 0666))
+	Require.NoError(writeMetaFile(s.Path, []byte(`{"foo":"qux"}`)))
+	backup, err = ioutil.ReadFile(backupFilePath(s.Path))
+	Require.NoError(err)
+	s.Assert().Equal(`{"foo":"bar"}`, string(backup))
+}
+
+func (s *MetaFileSuite) TestReadMetaFile() {
+	tests := []struct {
+		name     string
+		data     string
+		backup   string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "valid",
+			data:     `{"foo":"bar"}`,
+			backup:   `{"foo":"old"}`,
+			expected: `{"foo":"bar"}`,
+		},
+		{
+			name:     "empty without backup",
+			data:     ``,
+			expected: `{}`,
+		},
+		{
+			name:     "empty with backup",
+			data:     ``,
+			backup:   `{"foo":"old"}`,
+			expected: `{"foo":"old"}`,
+		},
+		{
+			name:     "truncated with backup",
+			data:     `{"foo":"ba`,
+			backup:   `{"foo":"old"}`,
+			expected: `{"foo":"old"}`,
+		},
+		{
+			name:    "truncated without backup",
+			data:    `{"foo":"ba`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated with corrupted backup",
+			data:    `{"foo":"ba`,
+			backup:  `{"foo":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.SetupTest()
+			defer s.TearDownTest()
+
+			Require := s.Require()
+			Require.NoError(ioutil.WriteFile(s.Path, []byte(tt.data), 0666))
+			if tt.backup != "" {
+				Require.NoError(ioutil.WriteFile(backupFilePath(s.Path), []byte(tt.backup), 0666))
+			}
+			got, err := readMetaFile(s.Path)
+			if tt.wantErr {
+				Require.Error(err)
+				return
+			}
+			Require.NoError(err)
+			s.Assert().Equal(tt.expected, string(got))
+		})
+	}
+}
+
+func (s *MetaFileSuite) TestReadMetaFile_restoresFromBackup() {
+	Require := s.Require()
+	Require.NoError(ioutil.WriteFile(s.Path, []byte(`{"foo":"ba`), 0666))
+	Require.NoError(ioutil.WriteFile(backupFilePath(s.Path), []byte(`{"foo":"old"}`), 0666))
+
+	_, err := readMetaFile(s.Path)
+	Require.NoError(err)
+	restored, err := ioutil.ReadFile(s.Path)
+	Require.NoError(err)
+	s.Assert().Equal(`{"foo":"old"}`, string(restored))
+}
+
+func (s *MetaFileSuite) TestMetaSpec_recoversFromTruncatedMeta() {
+	metaSpec := MetaSpec{
+		MetaSpace: s.Dir,
+		MetaFile:  defaultMetaFile,
+	}
+	Require := s.Require()
+	Require.NoError(metaSpec.Set("foo", "bar"))
+	Require.NoError(metaSpec.Set("baz", "qux"))
+	Require.NoError(ioutil.WriteFile(s.Path, []byte(`{"foo":"bar","b`), 0666))
+
+	got, err := metaSpec.Get("foo")
+	Require.NoError(err)
+	s.Assert().Equal("bar", got)
+}
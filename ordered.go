@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// orderedObject is a json object that keeps the order of its keys, so that meta round-trips without reordering.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// newOrderedObject creates an empty orderedObject.
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: make(map[string]interface{})}
+}
+
+// Get gets the value of key and whether it exists.
+func (o *orderedObject) Get(key string) (interface{}, bool) {
+	value, ok := o.values[key]
+	return value, ok
+}
+
+// Set sets the value of key, which is added after the existing keys if it is new.
+func (o *orderedObject) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+// Delete removes key, keeping the order of the other keys.
+func (o *orderedObject) Delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+	delete(o.values, key)
+	for i, k := range o.keys {
+		if k == key {
+			o.keys = append(o.keys[:i:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// Keys returns the keys in order.
+func (o *orderedObject) Keys() []string {
+	return o.keys
+}
+
+// Len returns the number of keys.
+func (o *orderedObject) Len() int {
+	return len(o.keys)
+}
+
+// Copy makes a shallow copy, which may be modified without modifying o.
+func (o *orderedObject) Copy() *orderedObject {
+	ret := &orderedObject{
+		keys:   append([]string(nil), o.keys...),
+		values: make(map[string]interface{}, len(o.values)),
+	}
+	for key, value := range o.values {
+		ret.values[key] = value
+	}
+	return ret
+}
+
+// MarshalJSON encodes the object with its keys in order.
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(keyJSON)
+		buf.WriteByte(':')
+		valueJSON, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(valueJSON)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// convertInterfaceToObject converts interface{} to *orderedObject, or nil if it is not an object. Maps are converted
+// with their keys sorted.
+func convertInterfaceToObject(metaInterface interface{}) *orderedObject {
+	switch value := metaInterface.(type) {
+	case *orderedObject:
+		return value
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		ret := newOrderedObject()
+		for _, key := range keys {
+			ret.Set(key, value[key])
+		}
+		return ret
+	default:
+		return nil
+	}
+}
+
+// decodeOrderedJSON decodes the json document like json.Unmarshal into interface{}, except that objects are
+// *orderedObject and numbers are json.Number so that both round-trip exactly.
+func decodeOrderedJSON(data []byte) (interface{}, error) {
+	// Check with Unmarshal, which rejects trailing data and reports errors with offsets, before decoding
+	if err := json.Unmarshal(data, new(interface{})); err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decodeOrderedValue(decoder)
+}
+
+// decodeOrderedValue decodes the next value from decoder.
+func decodeOrderedValue(decoder *json.Decoder) (interface{}, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := token.(json.Delim)
+	if !ok {
+		// string, json.Number, bool or nil
+		return token, nil
+	}
+
+	switch delim {
+	case '{':
+		obj := newOrderedObject()
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := keyToken.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected an object key, but got %v", keyToken)
+			}
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(key, value)
+		}
+		if _, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case '[':
+		ret := []interface{}{}
+		for decoder.More() {
+			value, err := decodeOrderedValue(decoder)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, value)
+		}
+		if _, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("unexpected %v", delim)
+	}
+}
+
+// orderLike orders the keys of the objects in value like those of the corresponding objects in template, which is
+// used when the order of value was lost (e.g. it came from a lua table). Keys not in template keep their order after
+// those that are. Array elements correspond by index. Numbers that are equal to the corresponding number in template
+// are written as in template, so that e.g. 1.50 does not become 1.5.
+func orderLike(value interface{}, template interface{}) interface{} {
+	switch value := value.(type) {
+	case *orderedObject:
+		templateObject := convertInterfaceToObject(template)
+		if templateObject == nil {
+			return value
+		}
+		ret := newOrderedObject()
+		for _, key := range templateObject.Keys() {
+			if childValue, ok := value.Get(key); ok {
+				childTemplate, _ := templateObject.Get(key)
+				ret.Set(key, orderLike(childValue, childTemplate))
+			}
+		}
+		for _, key := range value.Keys() {
+			if _, ok := ret.Get(key); !ok {
+				childValue, _ := value.Get(key)
+				ret.Set(key, childValue)
+			}
+		}
+		return ret
+	case []interface{}:
+		templateSlice, ok := template.([]interface{})
+		if !ok {
+			return value
+		}
+		ret := make([]interface{}, len(value))
+		for i, element := range value {
+			if i < len(templateSlice) {
+				ret[i] = orderLike(element, templateSlice[i])
+			} else {
+				ret[i] = element
+			}
+		}
+		return ret
+	case json.Number:
+		templateNumber, ok := template.(json.Number)
+		if !ok {
+			return value
+		}
+		f, err := value.Float64()
+		templateFloat, templateErr := templateNumber.Float64()
+		if err != nil || templateErr != nil || f != templateFloat {
+			return value
+		}
+		return templateNumber
+	default:
+		return value
+	}
+}
+
+// orderMetaJSONLikeFile orders the meta json like the json in the file at path (see orderLike). When the file does not
+// exist or is not valid json, metaJSON is returned as is.
+func orderMetaJSONLikeFile(metaJSON []byte, path string) ([]byte, error) {
+	previousJSON, err := readMetaFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return metaJSON, nil
+		}
+		return nil, err
+	}
+	template, err := decodeOrderedJSON(previousJSON)
+	if err != nil {
+		return metaJSON, nil
+	}
+	meta, err := decodeOrderedJSON(metaJSON)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(orderLike(meta, template))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OrderedSuite struct {
+	suite.Suite
+}
+
+func TestOrderedSuite(t *testing.T) {
+	suite.Run(t, new(OrderedSuite))
+}
+
+func (s *OrderedSuite) TestOrderedObject() {
+	obj := newOrderedObject()
+	obj.Set("b", 1)
+	obj.Set("a", 2)
+	obj.Set("c", 3)
+	obj.Set("b", 4)
+	s.Assert().Equal([]string{"b", "a", "c"}, obj.Keys())
+
+	copied := obj.Copy()
+	obj.Delete("a")
+	obj.Delete("missing")
+	s.Assert().Equal([]string{"b", "c"}, obj.Keys())
+	s.Assert().Equal(2, obj.Len())
+	s.Assert().Equal([]string{"b", "a", "c"}, copied.Keys())
+
+	value, ok := obj.Get("b")
+	s.Assert().True(ok)
+	s.Assert().Equal(4, value)
+	_, ok = obj.Get("a")
+	s.Assert().False(ok)
+
+	data, err := json.Marshal(obj)
+	s.Require().NoError(err)
+	s.Assert().Equal(`{"b":4,"c":3}`, string(data))
+}
+
+func (s *OrderedSuite) TestDecodeOrderedJSON() {
+	tests := []struct {
+		name     string
+		document string
+	}{
+		{name: "object", document: `{"z":1,"a":{"y":[],"b":{}},"m":null}`},
+		{name: "numbers", document: `[12345678901234567890,1.10,1e3,-0.0]`},
+		{name: "scalar", document: `"foo"`},
+		{name: "null", document: `null`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			decoded, err := decodeOrderedJSON([]byte(tt.document))
+			s.Require().NoError(err)
+			data, err := json.Marshal(decoded)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.document, string(data))
+		})
+	}
+
+	_, err := decodeOrderedJSON([]byte(`{"a":1} trailing`))
+	s.Assert().Error(err)
+	_, err = decodeOrderedJSON([]byte(`{"a":`))
+	s.Assert().Error(err)
+}
+
+func (s *OrderedSuite) TestConvertInterfaceToObject() {
+	obj := convertInterfaceToObject(map[string]interface{}{"b": 1, "a": 2})
+	s.Require().NotNil(obj)
+	s.Assert().Equal([]string{"a", "b"}, obj.Keys())
+	s.Assert().Same(obj, convertInterfaceToObject(obj))
+	s.Assert().Nil(convertInterfaceToObject([]interface{}{}))
+	s.Assert().Nil(convertInterfaceToObject(nil))
+}
+
+func (s *OrderedSuite) TestOrderLike() {
+	tests := []struct {
+		name     string
+		value    string
+		template string
+		expected string
+	}{
+		{name: "keys", value: `{"a":1,"c":3,"b":2}`, template: `{"b":0,"a":0}`, expected: `{"b":2,"a":1,"c":3}`},
+		{name: "nested", value: `{"x":[{"b":1,"a":2}]}`, template: `{"x":[{"a":0,"b":0}]}`,
+			expected: `{"x":[{"a":2,"b":1}]}`},
+		{name: "numbers", value: `{"a":1.5,"b":1000,"c":2}`, template: `{"a":1.50,"b":1e3,"c":3.0}`,
+			expected: `{"a":1.50,"b":1e3,"c":2}`},
+		{name: "removed keys", value: `{"a":1}`, template: `{"b":2,"a":1}`, expected: `{"a":1}`},
+		{name: "not object", value: `{"a":1}`, template: `[1]`, expected: `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			value, err := decodeOrderedJSON([]byte(tt.value))
+			s.Require().NoError(err)
+			template, err := decodeOrderedJSON([]byte(tt.template))
+			s.Require().NoError(err)
+			data, err := json.Marshal(orderLike(value, template))
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, string(data))
+		})
+	}
+}
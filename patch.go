@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// jsonPatchOperation is a single operation of an RFC 6902 JSON Patch document.
+type jsonPatchOperation struct {
+	Op   string  `json:"op"`
+	Path *string `json:"path"`
+	From *string `json:"from"`
+	// Value is nil when the member is missing; a null value is kept as the literal null (unlike a *json.RawMessage,
+	// which would be nil for both) so that add, replace and test may use null.
+	Value json.RawMessage `json:"value"`
+
+	// Decoded from the fields above by validate
+	pathTokens []string
+	fromTokens []string
+	value      interface{}
+}
+
+// Patch applies an RFC 7396 JSON merge patch (a json object) or an RFC 6902 JSON Patch (a json array of operations)
+// to the local meta. The whole patch is validated and applied in memory before the meta is written once, so a patch
+// that fails part way leaves the meta untouched.
+func (m *MetaSpec) Patch(patch string) error {
+	if m.IsExternal() {
+		return errors.New("can only meta patch current build meta")
+	}
+	previousMeta, err := m.readMetaForUpdate()
+	if err != nil {
+		return err
+	}
+	patchedMeta, err := applyPatch(previousMeta, []byte(patch))
+	if err != nil {
+		return err
+	}
+	return m.writeMeta(patchedMeta)
+}
+
+// applyPatch applies the merge patch or JSON Patch document in patch to meta and returns the patched meta.
+func applyPatch(meta *orderedObject, patch []byte) (*orderedObject, error) {
+	trimmedPatch := bytes.TrimSpace(patch)
+	if len(trimmedPatch) == 0 {
+		return nil, errors.New("patch is empty")
+	}
+
+	var patched interface{}
+	switch trimmedPatch[0] {
+	case '{':
+		mergePatch, err := decodeOrderedJSON(trimmedPatch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge patch: %v", err)
+		}
+		patched = applyMergePatch(meta, mergePatch)
+	case '[':
+		var operations []*jsonPatchOperation
+		if err := json.Unmarshal(trimmedPatch, &operations); err != nil {
+			return nil, fmt.Errorf("invalid json patch: %v", err)
+		}
+		for i, operation := range operations {
+			if err := operation.validate(); err != nil {
+				return nil, fmt.Errorf("invalid json patch operation %d: %v", i, err)
+			}
+		}
+		var err error
+		if patched, err = applyJSONPatch(meta, operations); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("patch must be a json object (merge patch) or a json array (json patch)")
+	}
+
+	patchedMeta, ok := patched.(*orderedObject)
+	if !ok {
+		return nil, fmt.Errorf("patch must leave the meta as a json object, not %T", patched)
+	}
+	return patchedMeta, nil
+}
+
+// applyMergePatch applies the RFC 7396 merge patch to target and returns the result.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(*orderedObject)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(*orderedObject)
+	if !ok {
+		targetObject = newOrderedObject()
+	}
+	for _, key := range patchObject.Keys() {
+		value, _ := patchObject.Get(key)
+		if value == nil {
+			targetObject.Delete(key)
+			continue
+		}
+		targetValue, _ := targetObject.Get(key)
+		targetObject.Set(key, applyMergePatch(targetValue, value))
+	}
+	return targetObject
+}
+
+// validate checks that the operation has the members required by its op and decodes its pointers and value.
+func (o *jsonPatchOperation) validate() error {
+	var err error
+	if o.Path == nil {
+		return fmt.Errorf(`op "%s" is missing "path"`, o.Op)
+	}
+	if o.pathTokens, err = parseJSONPointer(*o.Path); err != nil {
+		return err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return fmt.Errorf(`op "%s" is missing "value"`, o.Op)
+		}
+		if o.value, err = decodeOrderedJSON(o.Value); err != nil {
+			return err
+		}
+	case "move", "copy":
+		if o.From == nil {
+			return fmt.Errorf(`op "%s" is missing "from"`, o.Op)
+		}
+		if o.fromTokens, err = parseJSONPointer(*o.From); err != nil {
+			return err
+		}
+		if o.Op == "move" && strings.HasPrefix(*o.Path, *o.From+"/") {
+			return fmt.Errorf(`cannot move "%s" into its own child "%s"`, *o.From, *o.Path)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf(`unknown op "%s"`, o.Op)
+	}
+	return nil
+}
+
+// applyJSONPatch applies the validated RFC 6902 operations to doc in order and returns the result.
+func applyJSONPatch(doc interface{}, operations []*jsonPatchOperation) (interface{}, error) {
+	var err error
+	for i, o := range operations {
+		switch o.Op {
+		case "add":
+			doc, err = jsonPointerAdd(doc, o.pathTokens, o.value)
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, o.pathTokens)
+		case "replace":
+			// Replacing the whole document is an add; otherwise the value must exist to be removed and re-added.
+			if len(o.pathTokens) != 0 {
+				doc, _, err = jsonPointerRemove(doc, o.pathTokens)
+			}
+			if err == nil {
+				doc, err = jsonPointerAdd(doc, o.pathTokens, o.value)
+			}
+		case "move":
+			var value interface{}
+			if doc, value, err = jsonPointerRemove(doc, o.fromTokens); err == nil {
+				doc, err = jsonPointerAdd(doc, o.pathTokens, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, o.fromTokens); err == nil {
+				if value, err = deepCopyJSON(value); err == nil {
+					doc, err = jsonPointerAdd(doc, o.pathTokens, value)
+				}
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, o.pathTokens); err == nil && !jsonEqual(value, o.value) {
+				err = fmt.Errorf(`test failed for "%s"`, *o.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("json patch operation %d (%s) failed: %v", i, o.Op, err)
+		}
+	}
+	return doc, nil
+}
+
+// parseJSONPointer parses the RFC 6901 JSON pointer into its unescaped reference tokens.
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf(`json pointer "%s" must be empty or start with "/"`, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// jsonPointerIndex converts the token to an index of an array of the given length. When allowEnd is true, the index
+// may be equal to the length (including the "-" token) for appending.
+func jsonPointerIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.IndexFunc(token, func(r rune) bool {
+		return r < '0' || r > '9'
+	}) >= 0 {
+		return 0, fmt.Errorf(`invalid array index "%s"`, token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, err
+	}
+	if index > length || (index == length && !allowEnd) {
+		return 0, fmt.Errorf("array index %d out of range for length %d", index, length)
+	}
+	return index, nil
+}
+
+// jsonPointerGet returns the value referenced by tokens in doc.
+func jsonPointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case *orderedObject:
+			value, ok := node.Get(token)
+			if !ok {
+				return nil, fmt.Errorf(`key "%s" does not exist`, token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := jsonPointerIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf(`cannot reference "%s" in %T`, token, doc)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerUpdateParent calls update with the parent of the value referenced by the non-empty tokens and replaces
+// the parent with the one returned, returning the updated doc.
+func jsonPointerUpdateParent(doc interface{}, tokens []string,
+	update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return update(doc, tokens[0])
+	}
+	switch node := doc.(type) {
+	case *orderedObject:
+		child, ok := node.Get(tokens[0])
+		if !ok {
+			return nil, fmt.Errorf(`key "%s" does not exist`, tokens[0])
+		}
+		newChild, err := jsonPointerUpdateParent(child, tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node.Set(tokens[0], newChild)
+		return node, nil
+	case []interface{}:
+		index, err := jsonPointerIndex(tokens[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := jsonPointerUpdateParent(node[index], tokens[1:], update)
+		if err != nil {
+			return nil, err
+		}
+		node[index] = newChild
+		return node, nil
+	default:
+		return nil, fmt.Errorf(`cannot reference "%s" in %T`, tokens[0], doc)
+	}
+}
+
+// jsonPointerAdd adds value at tokens in doc, inserting into arrays and adding or replacing object members.
+func jsonPointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonPointerUpdateParent(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case *orderedObject:
+			node.Set(token, value)
+			return node, nil
+		case []interface{}:
+			index, err := jsonPointerIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf(`cannot add "%s" to %T`, token, parent)
+		}
+	})
+}
+
+// jsonPointerRemove removes the value at tokens in doc and returns the updated doc along with the removed value.
+func jsonPointerRemove(doc interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	var removed interface{}
+	doc, err := jsonPointerUpdateParent(doc, tokens, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case *orderedObject:
+			value, ok := node.Get(token)
+			if !ok {
+				return nil, fmt.Errorf(`key "%s" does not exist`, token)
+			}
+			removed = value
+			node.Delete(token)
+			return node, nil
+		case []interface{}:
+			index, err := jsonPointerIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf(`cannot remove "%s" from %T`, token, parent)
+		}
+	})
+	return doc, removed, err
+}
+
+// deepCopyJSON copies the decoded json value so that copies do not share objects or slices.
+func deepCopyJSON(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOrderedJSON(data)
+}
+
+// jsonEqual compares two decoded json values, in which numbers are equal when they have the same value however they
+// are written. e.g. 1, 1.0 and 1e0
+func jsonEqual(a interface{}, b interface{}) bool {
+	switch a := a.(type) {
+	case *orderedObject:
+		// Objects are equal regardless of the order of their keys
+		bObject, ok := b.(*orderedObject)
+		if !ok || a.Len() != bObject.Len() {
+			return false
+		}
+		for _, key := range a.Keys() {
+			value, _ := a.Get(key)
+			if bValue, ok := bObject.Get(key); !ok || !jsonEqual(value, bValue) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bSlice, ok := b.([]interface{})
+		if !ok || len(a) != len(bSlice) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], bSlice[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		bNumber, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		aRat, aOk := new(big.Rat).SetString(a.String())
+		bRat, bOk := new(big.Rat).SetString(bNumber.String())
+		return aOk && bOk && aRat.Cmp(bRat) == 0
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type PatchSuite struct {
+	suite.Suite
+	MetaSpec MetaSpec
+}
+
+func (s *PatchSuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "patch")
+	s.Require().NoError(err)
+	s.MetaSpec = MetaSpec{
+		MetaSpace: dir,
+		MetaFile:  defaultMetaFile,
+	}
+}
+
+func (s *PatchSuite) TearDownTest() {
+	_ = os.RemoveAll(s.MetaSpec.MetaSpace)
+}
+
+func TestPatchSuite(t *testing.T) {
+	suite.Run(t, new(PatchSuite))
+}
+
+func (s *PatchSuite) TestApplyPatch() {
+	tests := []struct {
+		name     string
+		meta     string
+		patch    string
+		expected string
+		wantErr  bool
+	}{
+		{
+			name:     "merge patch adds, replaces and removes",
+			meta:     `{"release":{"version":"1.0","notes":"old","tags":["a"]},"keep":true}`,
+			patch:    `{"release":{"version":"1.1","notes":null,"tags":["b"],"sha":"abc"}}`,
+			expected: `{"release":{"version":"1.1","tags":["b"],"sha":"abc"},"keep":true}`,
+		},
+		{
+			name:     "merge patch replaces non-object with object",
+			meta:     `{"foo":"bar"}`,
+			patch:    `{"foo":{"bar":"baz"}}`,
+			expected: `{"foo":{"bar":"baz"}}`,
+		},
+		{
+			name: "json patch add",
+			meta: `{"foo":{"bar":[1,3]}}`,
+			patch: `[
+				{"op":"add","path":"/foo/bar/1","value":2},
+				{"op":"add","path":"/foo/bar/-","value":4},
+				{"op":"add","path":"/foo/baz","value":{"a~b":"c/d"}}
+			]`,
+			expected: `{"foo":{"bar":[1,2,3,4],"baz":{"a~b":"c/d"}}}`,
+		},
+		{
+			name: "json patch remove and replace",
+			meta: `{"foo":{"bar":[1,2,3],"a/b":"c","x~y":"z"}}`,
+			patch: `[
+				{"op":"remove","path":"/foo/bar/0"},
+				{"op":"replace","path":"/foo/a~1b","value":"d"},
+				{"op":"remove","path":"/foo/x~0y"}
+			]`,
+			expected: `{"foo":{"bar":[2,3],"a/b":"d"}}`,
+		},
+		{
+			name: "json patch move, copy and test",
+			meta: `{"foo":{"bar":"baz"},"list":[1,2]}`,
+			patch: `[
+				{"op":"test","path":"/foo/bar","value":"baz"},
+				{"op":"copy","from":"/foo","path":"/copied"},
+				{"op":"move","from":"/list/0","path":"/list/-"},
+				{"op":"move","from":"/foo/bar","path":"/moved"}
+			]`,
+			expected: `{"foo":{},"copied":{"bar":"baz"},"list":[2,1],"moved":"baz"}`,
+		},
+		{
+			name:     "json patch replace whole document",
+			meta:     `{"foo":"bar"}`,
+			patch:    `[{"op":"replace","path":"","value":{"baz":1}}]`,
+			expected: `{"baz":1}`,
+		},
+		{
+			name:    "json patch failed test",
+			meta:    `{"foo":"bar"}`,
+			patch:   `[{"op":"add","path":"/baz","value":1},{"op":"test","path":"/foo","value":"qux"}]`,
+			wantErr: true,
+		},
+		{
+			name: "json patch test numbers by value",
+			meta: `{"id":12345678901234567890,"ratio":1.10}`,
+			patch: `[{"op":"test","path":"/id","value":12345678901234567890},` +
+				`{"op":"test","path":"/ratio","value":1.1e0}]`,
+			expected: `{"id":12345678901234567890,"ratio":1.10}`,
+		},
+		{
+			name:    "json patch test large numbers exactly",
+			meta:    `{"id":12345678901234567890}`,
+			patch:   `[{"op":"test","path":"/id","value":12345678901234567891}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch replace missing",
+			meta:    `{"foo":"bar"}`,
+			patch:   `[{"op":"replace","path":"/baz","value":1}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch remove out of range",
+			meta:    `{"foo":[1]}`,
+			patch:   `[{"op":"remove","path":"/foo/1"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch leading zero index",
+			meta:    `{"foo":[1,2]}`,
+			patch:   `[{"op":"remove","path":"/foo/01"}]`,
+			wantErr: true,
+		},
+		{
+			name: "json patch add, replace and test null",
+			meta: `{"foo":"bar","list":[1]}`,
+			patch: `[
+				{"op":"add","path":"/baz","value":null},
+				{"op":"add","path":"/list/0","value":null},
+				{"op":"replace","path":"/foo","value":null},
+				{"op":"test","path":"/foo","value":null},
+				{"op":"test","path":"/baz","value":null}
+			]`,
+			expected: `{"foo":null,"list":[null,1],"baz":null}`,
+		},
+		{
+			name:    "json patch test null fails for a value",
+			meta:    `{"foo":"bar"}`,
+			patch:   `[{"op":"test","path":"/foo","value":null}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch missing value",
+			meta:    `{}`,
+			patch:   `[{"op":"add","path":"/foo"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch unknown op",
+			meta:    `{}`,
+			patch:   `[{"op":"frobnicate","path":"/foo"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch move into own child",
+			meta:    `{"foo":{"bar":{}}}`,
+			patch:   `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch bad pointer",
+			meta:    `{}`,
+			patch:   `[{"op":"add","path":"foo","value":1}]`,
+			wantErr: true,
+		},
+		{
+			name:    "json patch must leave an object",
+			meta:    `{}`,
+			patch:   `[{"op":"replace","path":"","value":[1]}]`,
+			wantErr: true,
+		},
+		{
+			name:    "not a patch",
+			meta:    `{}`,
+			patch:   `"foo"`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			meta:    `{}`,
+			patch:   `{"foo":`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			meta, err := decodeMetaObject([]byte(tt.meta))
+			s.Require().NoError(err)
+			got, err := applyPatch(meta, []byte(tt.patch))
+			if tt.wantErr {
+				s.Require().Error(err)
+				return
+			}
+			s.Require().NoError(err)
+			gotJSON, err := json.Marshal(got)
+			s.Require().NoError(err)
+			s.Assert().JSONEq(tt.expected, string(gotJSON))
+		})
+	}
+}
+
+func (s *PatchSuite) TestMetaSpec_Patch() {
+	Require := s.Require()
+	Require.NoError(s.MetaSpec.Set("foo", "bar"))
+	Require.NoError(s.MetaSpec.Patch(`{"baz":{"qux":1}}`))
+	Require.NoError(s.MetaSpec.Patch(`[{"op":"add","path":"/baz/quux","value":[true]}]`))
+
+	got, err := s.MetaSpec.Get("baz")
+	Require.NoError(err)
+	s.Assert().JSONEq(`{"qux":1,"quux":[true]}`, got)
+}
+
+func (s *PatchSuite) TestMetaSpec_Patch_failureLeavesMetaUntouched() {
+	Require := s.Require()
+	Require.NoError(s.MetaSpec.Set("foo", "bar"))
+	before, err := ioutil.ReadFile(s.MetaSpec.MetaFilePath())
+	Require.NoError(err)
+
+	Require.Error(s.MetaSpec.Patch(`[{"op":"add","path":"/baz","value":1},{"op":"remove","path":"/missing"}]`))
+	after, err := ioutil.ReadFile(s.MetaSpec.MetaFilePath())
+	Require.NoError(err)
+	s.Assert().Equal(string(before), string(after))
+}
+
+func (s *PatchSuite) TestMetaSpec_Patch_externalFails() {
+	s.MetaSpec.MetaFile = externalFile
+	s.Require().Error(s.MetaSpec.Patch(`{"foo":"bar"}`))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	// gjson has @keys and @values but no way to count the members of an object or the characters of a string
+	gjson.AddModifier("length", lengthModifier)
+}
+
+// lengthModifier is the @length query modifier, which gets the number of elements of an array, members of an object or
+// characters of a string.
+func lengthModifier(jsonString, _ string) string {
+	result := gjson.Parse(jsonString)
+	switch {
+	case result.IsArray():
+		return strconv.Itoa(len(result.Array()))
+	case result.IsObject():
+		return strconv.Itoa(len(result.Map()))
+	case result.Type == gjson.String:
+		return strconv.Itoa(utf8.RuneCountInString(result.Str))
+	default:
+		return ""
+	}
+}
+
+// Query evaluates the query over the meta, or over the value of key when it is not empty, and returns the result
+// formatted as in Get. The query uses gjson syntax, e.g. images.#(repo=="bar").tag, images.#.tag, images.# or
+// foo.@keys. See https://github.com/tidwall/gjson/blob/master/SYNTAX.md
+func (m *MetaSpec) Query(key string, query string) (string, error) {
+	s, _, err := m.LookupQuery(key, query)
+	return s, err
+}
+
+// LookupQuery is like Query, but also reports whether the query matches anything, as in Lookup.
+func (m *MetaSpec) LookupQuery(key string, query string) (string, bool, error) {
+	var metaJSON []byte
+	if key == "" {
+		data, err := m.GetData()
+		if err != nil {
+			return "", false, err
+		}
+		metaJSON = data
+	} else {
+		// Get the value of the key as json to query it
+		keySpec := *m
+		keySpec.JSONValue = true
+		value, err := keySpec.Get(key)
+		if err != nil {
+			return "", false, err
+		}
+		metaJSON = []byte(value)
+	}
+
+	result, found, err := queryMetaJSON(metaJSON, query)
+	if err != nil {
+		return "", false, err
+	}
+	s, err := formatMetaValueForGet(result, m.JSONValue)
+	return s, found, err
+}
+
+// queryMetaJSON evaluates the gjson query over the json document and decodes the result, reporting whether it
+// matched anything. A query that does not match anything gets nil.
+func queryMetaJSON(metaJSON []byte, query string) (interface{}, bool, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, false, errors.New("query is empty")
+	}
+	if !gjson.ValidBytes(metaJSON) {
+		return nil, false, errors.New("cannot query meta that is not valid json")
+	}
+	result := gjson.GetBytes(metaJSON, query)
+	if !result.Exists() {
+		return nil, false, nil
+	}
+
+	// Decode integers as integers, not float64, and keep the order of keys
+	value, err := decodeOrderedJSON([]byte(result.Raw))
+	return value, err == nil, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type QuerySuite struct {
+	suite.Suite
+	MetaSpec MetaSpec
+}
+
+func (s *QuerySuite) SetupTest() {
+	dir, err := ioutil.TempDir("", "query")
+	s.Require().NoError(err)
+	s.MetaSpec = MetaSpec{MetaSpace: dir, MetaFile: defaultMetaFile}
+	s.Require().NoError(ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(
+		`{"images":[{"repo":"foo","tag":"1.0"},{"repo":"bar","tag":"2.0","size":12345678901234567890}],`+
+			`"release":{"version":"1.1","notes":"résumé"}}`), 0666))
+}
+
+func (s *QuerySuite) TearDownTest() {
+	_ = os.RemoveAll(s.MetaSpec.MetaSpace)
+}
+
+func TestQuerySuite(t *testing.T) {
+	suite.Run(t, new(QuerySuite))
+}
+
+func (s *QuerySuite) TestQuery() {
+	tests := []struct {
+		name      string
+		key       string
+		query     string
+		jsonValue bool
+		expected  string
+	}{
+		{name: "predicate", query: `images.#(repo=="bar").tag`, expected: "2.0"},
+		{name: "predicate json", query: `images.#(repo=="bar").tag`, jsonValue: true, expected: `"2.0"`},
+		{name: "all matches", query: `images.#(repo%"*a*")#.repo`, expected: `["bar"]`},
+		{name: "projection", query: `images.#.repo`, expected: `["foo","bar"]`},
+		{name: "multipath", query: `{release.version,tags:images.#.tag}`,
+			expected: `{"version":"1.1","tags":["1.0","2.0"]}`},
+		{name: "array length", query: `images.#`, expected: "2"},
+		{name: "length modifier", query: `release|@length`, expected: "2"},
+		{name: "string length", query: `release.notes|@length`, expected: "6"},
+		{name: "keys", query: `release|@keys`, expected: `["version","notes"]`},
+		{name: "large number", query: `images.1.size`, expected: "12345678901234567890"},
+		{name: "no match", query: `images.#(repo=="baz").tag`, expected: "null"},
+		{name: "within key", key: "images[-1]", query: `tag`, expected: "2.0"},
+		{name: "within quoted key", key: `release."version"`, query: `@this`, expected: "1.1"},
+		{name: "within missing key", key: "missing", query: `foo`, expected: "null"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.MetaSpec.JSONValue = tt.jsonValue
+			got, err := s.MetaSpec.Query(tt.key, tt.query)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *QuerySuite) TestLookupQuery() {
+	tests := []struct {
+		name     string
+		key      string
+		query    string
+		expected bool
+	}{
+		{name: "match", query: `images.#(repo=="bar").tag`, expected: true},
+		{name: "no match", query: `images.#(repo=="baz").tag`, expected: false},
+		{name: "empty matches", query: `images.#(repo=="baz")#.tag`, expected: true},
+		{name: "within key", key: "images[-1]", query: `tag`, expected: true},
+		{name: "within missing key", key: "missing", query: `foo`, expected: false},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			_, found, err := s.MetaSpec.LookupQuery(tt.key, tt.query)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, found)
+		})
+	}
+}
+
+func (s *QuerySuite) TestQuery_errors() {
+	_, err := s.MetaSpec.Query("", " ")
+	s.Assert().EqualError(err, "query is empty")
+
+	_, err = s.MetaSpec.Query("foo.", "bar")
+	s.Assert().Error(err)
+
+	_, _, err = queryMetaJSON([]byte(`{"foo":`), "foo")
+	s.Assert().EqualError(err, "cannot query meta that is not valid json")
+}
+
+func (s *QuerySuite) TestLengthModifier() {
+	tests := []struct {
+		json     string
+		expected string
+	}{
+		{json: `[1,2,3]`, expected: "3"},
+		{json: `{"a":1}`, expected: "1"},
+		{json: `"héllo"`, expected: "5"},
+		{json: `12`, expected: ""},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.json, func() {
+			s.Assert().Equal(tt.expected, lengthModifier(tt.json, ""))
+		})
+	}
+}
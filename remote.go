@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/screwdriver-cd/meta-cli/internal/atomicfile"
+	"github.com/screwdriver-cd/meta-cli/internal/fetch"
+	"github.com/sirupsen/logrus"
+)
+
+const syncedSuffix = ".synced"
+
+// syncedFilePath returns the path of the copy of the meta file at path as it was last synced to the build.
+func syncedFilePath(path string) string {
+	return path + syncedSuffix
+}
+
+// Sync writes the local meta back to the build with buildID with the SD API, so that it isn't lost when the build
+// crashes and others can see the progress of a long build. When the meta of the build was changed by someone else
+// since it was last synced (or, before the first sync, has keys that the local meta doesn't), Sync fails with
+// fetch.ErrConflict unless force is set. With dryRun, the meta that would be written is written to w instead.
+func (m *MetaSpec) Sync(buildID int64, force bool, dryRun bool, w io.Writer) error {
+	if m.IsExternal() || m.IsNamespace() {
+		return errors.New("can only meta sync current build meta")
+	}
+	if buildID == 0 {
+		return errors.New("meta sync requires --sd-build-id or SD_BUILD_ID")
+	}
+	localJSON, err := m.GetFileData()
+	if err != nil {
+		return err
+	}
+	local, err := decodeMetaObject(localJSON)
+	if err != nil {
+		return err
+	}
+	remoteJSON, err := m.LastSuccessfulMetaRequest.GetBuildMeta(buildID)
+	if err != nil {
+		return err
+	}
+	remote, err := decodeMetaObject(remoteJSON)
+	if err != nil {
+		return err
+	}
+	syncedPath := syncedFilePath(m.MetaFilePath())
+	data, err := json.Marshal(local)
+	if err != nil {
+		return err
+	}
+
+	if jsonEqual(local, remote) {
+		logrus.Infof("Meta of build %d is up to date", buildID)
+		if dryRun {
+			return nil
+		}
+		return atomicfile.WriteFile(syncedPath, data)
+	}
+	if !force {
+		conflict, err := syncConflict(syncedPath, local, remote)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			return fmt.Errorf("%w: meta of build %d %s; use --force to overwrite it", fetch.ErrConflict, buildID,
+				conflict)
+		}
+	}
+
+	if dryRun {
+		logrus.Infof("Dry run; would write this meta to build %d", buildID)
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+	logrus.Debugf("Writing meta to build %d", buildID)
+	if err = m.LastSuccessfulMetaRequest.PutBuildMeta(buildID, data); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(syncedPath, data)
+}
+
+// syncConflict describes how the remote meta of the build conflicts with the local meta, or is "" when it doesn't. It
+// conflicts when it isn't the meta that was last synced (to syncedPath), or, before the first sync, when it has keys
+// that the local meta doesn't.
+func syncConflict(syncedPath string, local *orderedObject, remote *orderedObject) (string, error) {
+	syncedJSON, err := ioutil.ReadFile(syncedPath)
+	if os.IsNotExist(err) {
+		var missing []string
+		for _, key := range remote.Keys() {
+			if _, ok := local.Get(key); !ok {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Sprintf("has keys that are not in the local meta (%s)", strings.Join(missing, ", ")), nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	synced, err := decodeMetaObject(syncedJSON)
+	if err != nil {
+		return "", err
+	}
+	if changed := changedMetaKeys(synced, remote); len(changed) != 0 {
+		return fmt.Sprintf("was changed since it was last synced (%s)", strings.Join(changed, ", ")), nil
+	}
+	return "", nil
+}
+
+// changedMetaKeys returns the keys whose values differ between the before and after meta, in the order of after and
+// then before.
+func changedMetaKeys(before *orderedObject, after *orderedObject) []string {
+	var ret []string
+	for _, key := range after.Keys() {
+		afterValue, _ := after.Get(key)
+		if beforeValue, ok := before.Get(key); !ok || !jsonEqual(beforeValue, afterValue) {
+			ret = append(ret, key)
+		}
+	}
+	for _, key := range before.Keys() {
+		if _, ok := after.Get(key); !ok {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
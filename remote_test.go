@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	"github.com/screwdriver-cd/meta-cli/internal/fetch"
+	"github.com/tidwall/gjson"
+)
+
+// buildServer is an SD API with the meta of build 42
+type buildServer struct {
+	meta string
+	puts int
+}
+
+func (b *buildServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v4/builds/42" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPut {
+		body, _ := ioutil.ReadAll(r.Body)
+		b.meta = gjson.GetBytes(body, "meta").Raw
+		b.puts++
+	}
+	_, _ = fmt.Fprintf(w, `{"id":42,"jobId":1,"meta":%s}`, b.meta)
+}
+
+// syncTestServer starts a buildServer with the remote meta for MetaSpec.
+func (s *MetaSuite) syncTestServer(remote string) (*buildServer, func()) {
+	server := &buildServer{meta: remote}
+	testServer := httptest.NewServer(server)
+	s.MetaSpec.LastSuccessfulMetaRequest.SdAPIURL = testServer.URL + "/v4/"
+	s.MetaSpec.LastSuccessfulMetaRequest.Transport = testServer.Client().Transport
+	_ = os.Remove(syncedFilePath(s.MetaSpec.MetaFilePath()))
+	return server, testServer.Close
+}
+
+func (s *MetaSuite) TestMetaSpec_Sync() {
+	server, closeServer := s.syncTestServer(`{}`)
+	defer closeServer()
+	s.MetaSpec.JSONValue = true
+	s.Require().NoError(s.MetaSpec.Set("b", "1"))
+	s.Require().NoError(s.MetaSpec.Set("a", `{"x":1.50}`))
+
+	s.Require().NoError(s.MetaSpec.Sync(42, false, false, nil))
+	s.Assert().Equal(1, server.puts)
+	s.Assert().Equal(`{"b":1,"a":{"x":1.50}}`, server.meta)
+	synced, err := ioutil.ReadFile(syncedFilePath(s.MetaSpec.MetaFilePath()))
+	s.Require().NoError(err)
+	s.Assert().Equal(server.meta, string(synced))
+
+	// Changes are synced again
+	s.Require().NoError(s.MetaSpec.Set("c", "true"))
+	s.Require().NoError(s.MetaSpec.Sync(42, false, false, nil))
+	s.Assert().Equal(2, server.puts)
+	s.Assert().Equal(`{"b":1,"a":{"x":1.50},"c":true}`, server.meta)
+
+	// Without changes, nothing is written
+	s.Require().NoError(s.MetaSpec.Sync(42, false, false, nil))
+	s.Assert().Equal(2, server.puts)
+}
+
+func (s *MetaSuite) TestMetaSpec_Sync_conflict() {
+	server, closeServer := s.syncTestServer(`{}`)
+	defer closeServer()
+	s.Require().NoError(s.MetaSpec.Set("a", "1"))
+	s.Require().NoError(s.MetaSpec.Sync(42, false, false, nil))
+
+	// Someone else changes the meta of the build
+	server.meta = `{"a":1,"b":"other"}`
+	s.Require().NoError(s.MetaSpec.Set("a", "2"))
+	err := s.MetaSpec.Sync(42, false, false, nil)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, fetch.ErrConflict), "%v", err)
+	s.Assert().Contains(err.Error(), "meta of build 42 was changed since it was last synced (b)")
+	s.Assert().Equal(exitCodeConflict, exitCode(err))
+	s.Assert().Equal(1, server.puts)
+
+	s.Require().NoError(s.MetaSpec.Sync(42, true, false, nil))
+	s.Assert().Equal(2, server.puts)
+	s.Assert().Equal(`{"a":2}`, server.meta)
+}
+
+func (s *MetaSuite) TestMetaSpec_Sync_firstConflict() {
+	server, closeServer := s.syncTestServer(`{"a":"remote","b":"remote"}`)
+	defer closeServer()
+	s.Require().NoError(s.MetaSpec.Set("a", "local"))
+
+	// Before the first sync, the local meta must have all of the keys of the build
+	err := s.MetaSpec.Sync(42, false, false, nil)
+	s.Require().Error(err)
+	s.Assert().True(errors.Is(err, fetch.ErrConflict), "%v", err)
+	s.Assert().Contains(err.Error(), "has keys that are not in the local meta (b)")
+	s.Assert().Equal(0, server.puts)
+
+	s.Require().NoError(s.MetaSpec.Set("b", "local"))
+	s.Require().NoError(s.MetaSpec.Sync(42, false, false, nil))
+	s.Assert().Equal(`{"a":"local","b":"local"}`, server.meta)
+}
+
+func (s *MetaSuite) TestMetaSpec_Sync_dryRun() {
+	server, closeServer := s.syncTestServer(`{}`)
+	defer closeServer()
+	s.Require().NoError(s.MetaSpec.Set("a", "1"))
+
+	var buf bytes.Buffer
+	s.Require().NoError(s.MetaSpec.Sync(42, false, true, &buf))
+	s.Assert().Equal("{\"a\":1}\n", buf.String())
+	s.Assert().Equal(0, server.puts)
+	s.Assert().Equal(`{}`, server.meta)
+	_, err := os.Stat(syncedFilePath(s.MetaSpec.MetaFilePath()))
+	s.Assert().True(os.IsNotExist(err), "%v", err)
+}
+
+func (s *MetaSuite) TestMetaSpec_Sync_errors() {
+	server, closeServer := s.syncTestServer(`{}`)
+	defer closeServer()
+
+	s.Assert().EqualError(s.MetaSpec.Sync(0, false, false, nil), "meta sync requires --sd-build-id or SD_BUILD_ID")
+
+	err := s.MetaSpec.Sync(43, false, false, nil)
+	s.Assert().True(errors.Is(err, fetch.ErrBuildNotFound), "%v", err)
+
+	s.MetaSpec.Namespace = "scratch"
+	s.Assert().EqualError(s.MetaSpec.Sync(42, false, false, nil), "can only meta sync current build meta")
+	s.MetaSpec.Namespace = ""
+	s.MetaSpec.MetaFile = externalFile
+	s.Assert().EqualError(s.MetaSpec.Sync(42, false, false, nil), "can only meta sync current build meta")
+	s.Assert().Equal(0, server.puts)
+}
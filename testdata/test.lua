@@ -105,6 +105,19 @@ function LuaSuite:Test_cloning_meta()
     assert(m2.MetaSpace == "/dev/null")
 end
 
+-- test local namespaces are kept apart from the build meta
+function LuaSuite:Test_namespace()
+    meta.set("foo", "build")
+    local scratch = meta.clone()
+    assert(scratch.Namespace == "")
+    scratch.Namespace = "scratch"
+    assert(scratch.Namespace == "scratch")
+    scratch:set("foo", "scratch")
+    assert(scratch:get("foo") == "scratch", tostring(scratch:get("foo")))
+    assert(meta.get("foo") == "build", tostring(meta.get("foo")))
+    assert(scratch:metaFilePath() == meta.spec.MetaSpace .. "/local/scratch.json", scratch:metaFilePath())
+end
+
 function LuaSuite:Test_cloning_LastSuccessfulMetaRequest()
     meta.spec.LastSuccessfulMetaRequest.SdToken = 123
     assert(meta.spec.LastSuccessfulMetaRequest.SdToken == "123",
@@ -119,6 +132,24 @@ function LuaSuite:Test_cloning_LastSuccessfulMetaRequest()
             string.format("SdToken=%s", meta.spec.LastSuccessfulMetaRequest.SdToken))
 end
 
+-- test the fetch retry and timeout settings of LastSuccessfulMetaRequest
+function LuaSuite:Test_LastSuccessfulMetaRequest_retries()
+    local request = meta.spec.LastSuccessfulMetaRequest:clone()
+    request.Retries = 5
+    request.RequestTimeout = 1.5
+    request.Timeout = 60
+    assert(request.Retries == 5, tostring(request.Retries))
+    assert(request.RequestTimeout == 1.5, tostring(request.RequestTimeout))
+    assert(request.Timeout == 60, tostring(request.Timeout))
+end
+
+-- test the pull request of LastSuccessfulMetaRequest
+function LuaSuite:Test_LastSuccessfulMetaRequest_pull_request()
+    local request = meta.spec.LastSuccessfulMetaRequest:clone()
+    request.DefaultPullRequest = "45"
+    assert(request.DefaultPullRequest == "45", tostring(request.DefaultPullRequest))
+end
+
 -- test that JSONValue cannot be set
 function LuaSuite:Test_JSONValue_cannot_be_set()
     local ran, errorMsg = pcall(function()
@@ -177,9 +208,115 @@ function LuaSuite:Test_undump_workaround()
     assert(workaround == "achievement unlocked!", tostring(workaround))
 end
 
+-- test undump keeps the order of keys and the numbers that were not changed
+function LuaSuite:Test_undump_keeps_order()
+    meta.patch('[{"op":"replace","path":"","value":{"zeta":{"b":1.50,"a":12345678901234567890},"alpha":"a"}}]')
+    local d = meta.dump()
+    d.alpha = "b"
+    meta.undump(d)
+    local f = assert(io.open(meta.metaFilePath()))
+    local contents = f:read("*a")
+    f:close()
+    assert(contents == '{"zeta":{"b":1.50,"a":12345678901234567890},"alpha":"b"}', contents)
+end
+
 -- test metaFilePath works
 function LuaSuite:Test_metaFilePath_returns_non_empty()
     assert(meta.metaFilePath())
     assert(meta.metaFilePath() == meta.spec:metaFilePath(),
             string.format("%s != %s", meta.metaFilePath(), meta.spec:metaFilePath()))
 end
+
+-- test delete removes the key
+function LuaSuite:Test_delete()
+    meta.set("foo", { bar = "baz", qux = { 1, 2, 3 } })
+    meta.delete("foo.qux[1]")
+    local qux = meta.get("foo.qux")
+    assert(#qux == 2, tostring(#qux))
+    assert(qux[1] == 1 and qux[2] == 3, string.format("%s,%s", qux[1], qux[2]))
+    meta.delete("foo.bar")
+    assert(meta.get("foo.bar") == nil, tostring(meta.get("foo.bar")))
+    assert(meta.spec:get("foo.qux") ~= nil)
+    meta.spec:delete("foo")
+    assert(meta.get("foo") == nil, tostring(meta.get("foo")))
+end
+
+-- test quoted key segments
+function LuaSuite:Test_quoted_keys()
+    meta.set('images["docker.io/foo"].tag', "latest")
+    assert(meta.get("images['docker.io/foo'].tag") == "latest", tostring(meta.get("images['docker.io/foo'].tag")))
+    local images = meta.get("images")
+    assert(images["docker.io/foo"].tag == "latest")
+    meta.delete('images."docker.io/foo"')
+    assert(meta.get('images["docker.io/foo"]') == nil)
+end
+
+-- test wildcard get
+function LuaSuite:Test_wildcard_get()
+    meta.set("images", { { repo = "foo", tag = "1.0" }, { repo = "bar" }, { repo = "baz", tag = "2.0" } })
+    local tags = meta.get("images[*].tag")
+    assert(#tags == 2, tostring(#tags))
+    assert(tags[1] == "1.0" and tags[2] == "2.0", string.format("%s,%s", tags[1], tags[2]))
+    assert(#meta.get("images[*].missing") == 0)
+end
+
+-- test query
+function LuaSuite:Test_query()
+    meta.set("images", { { repo = "foo", tag = "1.0" }, { repo = "bar", tag = "2.0" } })
+    assert(meta.query('images.#(repo=="bar").tag') == "2.0", tostring(meta.query('images.#(repo=="bar").tag')))
+    assert(meta.query("images.#") == 2, tostring(meta.query("images.#")))
+    local repos = meta.query("#.repo", "images")
+    assert(repos[1] == "foo" and repos[2] == "bar", string.format("%s,%s", repos[1], repos[2]))
+    assert(meta.spec:query('images.#(repo=="baz")') == nil)
+end
+
+-- test push, pop, unshift and shift
+function LuaSuite:Test_push_pop_unshift_shift()
+    meta.push("images", { repo = "foo", tags = { "1.0" } })
+    meta.push("images[0].tags", "latest")
+    meta.unshift("images", { repo = "bar" })
+    local images = meta.get("images")
+    assert(#images == 2, tostring(#images))
+    assert(images[1].repo == "bar", tostring(images[1].repo))
+    assert(#images[2].tags == 2, tostring(#images[2].tags))
+
+    local tag = meta.pop("images[1].tags")
+    assert(tag == "latest", tostring(tag))
+    local image = meta.shift("images")
+    assert(image.repo == "bar", tostring(image.repo))
+    assert(meta.spec:pop("images").repo == "foo")
+    assert(meta.pop("images") == nil)
+end
+
+-- test patch with merge patch tables and json patch strings
+function LuaSuite:Test_patch()
+    meta.set("release", { version = "1.0", notes = "old" })
+    meta.patch({ release = { version = "1.1", sha = "abc" } })
+    assert(meta.get("release.version") == "1.1", tostring(meta.get("release.version")))
+    assert(meta.get("release.notes") == "old", tostring(meta.get("release.notes")))
+    meta.patch('[{"op":"remove","path":"/release/notes"}]')
+    assert(meta.get("release.notes") == nil, tostring(meta.get("release.notes")))
+    assert(meta.get("release.sha") == "abc", tostring(meta.get("release.sha")))
+end
+
+-- test listing keys and leaf paths
+function LuaSuite:Test_keys_ls()
+    local json = require 'json'
+    meta.set("foo", { bar = { 1, 2 } })
+    local keys = meta.keys()
+    assert(#keys == 1 and keys[1] == "foo", json.encode(keys))
+    keys = meta.keys("foo.bar")
+    assert(#keys == 2 and keys[2] == "1", json.encode(keys))
+    local entries = meta.ls("foo", true)
+    assert(#entries == 2, json.encode(entries))
+    assert(entries[2].path == "foo.bar[1]", tostring(entries[2].path))
+    assert(entries[2].type == "number", tostring(entries[2].type))
+end
+
+function LuaSuite:Test_exists()
+    meta.set("foo.bar", nil)
+    assert(meta.get("foo.bar") == nil, tostring(meta.get("foo.bar")))
+    assert(meta.exists("foo.bar"), "foo.bar should exist")
+    assert(not meta.exists("foo.baz"), "foo.baz should not exist")
+    assert(not meta.exists("missing[0]"), "missing[0] should not exist")
+end
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Types of values that may be given to set, push and unshift, which override inferring the type from the value.
+const (
+	valueTypeString = "string"
+	valueTypeInt    = "int"
+	valueTypeFloat  = "float"
+	valueTypeBool   = "bool"
+)
+
+var jsonNumberRegExp = regexp.MustCompile(`^-?(0|[1-9]\d*)(\.\d+)?([eE][+-]?\d+)?$`)
+
+// parseValue converts the value from the CLI to the value stored in meta. The value is parsed as json with
+// JSONValue, as the ValueType when one is given and otherwise its type is inferred unless StrictTypes is set, in which
+// case it is a string.
+func (m *MetaSpec) parseValue(value string) (interface{}, error) {
+	switch {
+	case m.JSONValue && m.ValueType != "":
+		return nil, fmt.Errorf("--json-value cannot be used with --%s", m.ValueType)
+	case m.JSONValue:
+		return parseMetaValue(value, true)
+	case m.ValueType != "":
+		return parseTypedMetaValue(value, m.ValueType)
+	case m.StrictTypes:
+		return value, nil
+	default:
+		return parseMetaValue(value, false)
+	}
+}
+
+// parseTypedMetaValue converts the value to the valueType. Ints of any size and floats that are valid json numbers
+// are kept exactly as written as a json.Number. e.g. --int 007 is 7 and --float 1.10 is 1.10
+func parseTypedMetaValue(value string, valueType string) (interface{}, error) {
+	switch valueType {
+	case valueTypeString:
+		return value, nil
+	case valueTypeInt:
+		i, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an int", value)
+		}
+		return json.Number(i.String()), nil
+	case valueTypeFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("%s is not a float", value)
+		}
+		if isJSONNumber(value) {
+			return json.Number(value), nil
+		}
+		return f, nil
+	case valueTypeBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a bool", value)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %s", valueType)
+	}
+}
+
+// isJSONNumber determines whether the value is written exactly as a json number. e.g. 10, -1.5 or 1e5, but not 007
+func isJSONNumber(value string) bool {
+	return jsonNumberRegExp.MatchString(value)
+}
+
+// metaValueTypeFromFlags returns the value type whose flag is set (or "" for none) in flags, which is keyed by
+// value type. At most one may be set and not with --json-value.
+func metaValueTypeFromFlags(jsonValue bool, flags map[string]*bool) (string, error) {
+	var valueTypes []string
+	for valueType, isSet := range flags {
+		if *isSet {
+			valueTypes = append(valueTypes, valueType)
+		}
+	}
+	sort.Strings(valueTypes)
+	switch {
+	case len(valueTypes) > 1:
+		return "", fmt.Errorf("only one value type may be used, but got --%s", strings.Join(valueTypes, " and --"))
+	case len(valueTypes) == 0:
+		return "", nil
+	case jsonValue:
+		return "", errors.New("--json-value cannot be used with --" + valueTypes[0])
+	default:
+		return valueTypes[0], nil
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ValueSuite struct {
+	suite.Suite
+}
+
+func TestValueSuite(t *testing.T) {
+	suite.Run(t, new(ValueSuite))
+}
+
+func (s *ValueSuite) TestParseMetaValue() {
+	tests := []struct {
+		value    string
+		expected interface{}
+	}{
+		{value: "10", expected: 10},
+		{value: "007", expected: 7},
+		{value: "15.5", expected: json.Number("15.5")},
+		{value: "1.10", expected: json.Number("1.10")},
+		{value: "12345678901234567890", expected: json.Number("12345678901234567890")},
+		{value: "-12345678901234567890.000000000001", expected: json.Number("-12345678901234567890.000000000001")},
+		{value: ".5", expected: 0.5},
+		{value: "+1.5", expected: 1.5},
+		{value: "1e5", expected: "1e5"},
+		{value: "true", expected: true},
+		{value: "foo", expected: "foo"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.value, func() {
+			got, err := parseMetaValue(tt.value, false)
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *ValueSuite) TestParseMetaValue_json() {
+	got, err := parseMetaValue(`{"id":12345678901234567890,"ratio":1.10,"list":[1]}`, true)
+	s.Require().NoError(err)
+	s.Require().IsType(&orderedObject{}, got)
+	s.Assert().Equal([]string{"id", "ratio", "list"}, got.(*orderedObject).Keys())
+	s.Assert().Equal(map[string]interface{}{
+		"id":    json.Number("12345678901234567890"),
+		"ratio": json.Number("1.10"),
+		"list":  []interface{}{json.Number("1")},
+	}, got.(*orderedObject).values)
+
+	_, err = parseMetaValue(`{"id":1} trailing`, true)
+	s.Assert().Error(err)
+}
+
+func (s *ValueSuite) TestParseTypedMetaValue() {
+	tests := []struct {
+		valueType string
+		value     string
+		expected  interface{}
+		wantErr   string
+	}{
+		{valueType: valueTypeString, value: "007", expected: "007"},
+		{valueType: valueTypeString, value: "true", expected: "true"},
+		{valueType: valueTypeInt, value: "007", expected: json.Number("7")},
+		{valueType: valueTypeInt, value: "-12345678901234567890123", expected: json.Number("-12345678901234567890123")},
+		{valueType: valueTypeInt, value: "+5", expected: json.Number("5")},
+		{valueType: valueTypeInt, value: "1.5", wantErr: "1.5 is not an int"},
+		{valueType: valueTypeInt, value: "", wantErr: " is not an int"},
+		{valueType: valueTypeFloat, value: "1.10", expected: json.Number("1.10")},
+		{valueType: valueTypeFloat, value: "1e5", expected: json.Number("1e5")},
+		{valueType: valueTypeFloat, value: "10", expected: json.Number("10")},
+		{valueType: valueTypeFloat, value: ".5", expected: 0.5},
+		{valueType: valueTypeFloat, value: "Inf", wantErr: "Inf is not a float"},
+		{valueType: valueTypeFloat, value: "NaN", wantErr: "NaN is not a float"},
+		{valueType: valueTypeFloat, value: "one", wantErr: "one is not a float"},
+		{valueType: valueTypeBool, value: "false", expected: false},
+		{valueType: valueTypeBool, value: "1", expected: true},
+		{valueType: valueTypeBool, value: "yes", wantErr: "yes is not a bool"},
+		{valueType: "date", value: "today", wantErr: "unknown value type date"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.valueType+" "+tt.value, func() {
+			got, err := parseTypedMetaValue(tt.value, tt.valueType)
+			if tt.wantErr != "" {
+				s.Require().EqualError(err, tt.wantErr)
+				return
+			}
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *ValueSuite) TestMetaSpec_parseValue() {
+	tests := []struct {
+		name     string
+		metaSpec MetaSpec
+		value    string
+		expected interface{}
+		wantErr  string
+	}{
+		{name: "infer", metaSpec: MetaSpec{}, value: "true", expected: true},
+		{name: "strict", metaSpec: MetaSpec{StrictTypes: true}, value: "true", expected: "true"},
+		{name: "strict with type", metaSpec: MetaSpec{StrictTypes: true, ValueType: valueTypeBool}, value: "true",
+			expected: true},
+		{name: "strict with json", metaSpec: MetaSpec{StrictTypes: true, JSONValue: true}, value: "true",
+			expected: true},
+		{name: "json with type", metaSpec: MetaSpec{JSONValue: true, ValueType: valueTypeInt}, value: "1",
+			wantErr: "--json-value cannot be used with --int"},
+	}
+
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			got, err := tt.metaSpec.parseValue(tt.value)
+			if tt.wantErr != "" {
+				s.Require().EqualError(err, tt.wantErr)
+				return
+			}
+			s.Require().NoError(err)
+			s.Assert().Equal(tt.expected, got)
+		})
+	}
+}
+
+func (s *ValueSuite) TestMetaValueTypeFromFlags() {
+	flags := func(set ...string) map[string]*bool {
+		ret := map[string]*bool{
+			valueTypeString: new(bool),
+			valueTypeInt:    new(bool),
+			valueTypeFloat:  new(bool),
+			valueTypeBool:   new(bool),
+		}
+		for _, valueType := range set {
+			*ret[valueType] = true
+		}
+		return ret
+	}
+
+	valueType, err := metaValueTypeFromFlags(false, flags())
+	s.Require().NoError(err)
+	s.Assert().Equal("", valueType)
+
+	valueType, err = metaValueTypeFromFlags(true, flags())
+	s.Require().NoError(err)
+	s.Assert().Equal("", valueType)
+
+	valueType, err = metaValueTypeFromFlags(false, flags(valueTypeInt))
+	s.Require().NoError(err)
+	s.Assert().Equal(valueTypeInt, valueType)
+
+	_, err = metaValueTypeFromFlags(false, flags(valueTypeString, valueTypeInt))
+	s.Assert().EqualError(err, "only one value type may be used, but got --int and --string")
+
+	_, err = metaValueTypeFromFlags(true, flags(valueTypeBool))
+	s.Assert().EqualError(err, "--json-value cannot be used with --bool")
+}